@@ -3,9 +3,19 @@ package main
 import (
     "fmt"
     "os"
+    "os/exec"
     "flag"
     "io/ioutil"
     "strconv"
+    "strings"
+    "math/big"
+    "crypto/ecdsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/asn1"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
 
     "Ruben"
 )
@@ -19,7 +29,20 @@ eg:
                 -c CRPs/Challenge/challenge_128_819200_0_220370.bin \
                 -r CRPs/Response/response_128_819200_0_220370.bin \
                 -key File/cipherResponseKey.txt \
-                -pub File/node_eccpublic.pem
+                -receiver Org1MSP:peer11.org1,Org2MSP:peer02.org2,Org2MSP:peer12.org2 \
+                -cacerts Org1MSP=crypto-config/peerOrganizations/org1/ca/ca.org1-cert.pem,Org2MSP=crypto-config/peerOrganizations/org2/ca/ca.org2-cert.pem \
+                -channel goodwayhouse \
+                -cc chaincode_ruben
+
+    Each receiver's ECC public key is read from the ledger (getPublicKey), so it
+    must have been published with publishKey first. Receivers are named as
+    MSPID:name, like a shard's Receiver; give one for every shard, or a single
+    receiver for all of them. The peer CLI must be on PATH and set up for the
+    channel (CORE_PEER_* environment).
+
+    A key is only used once its signature checks out against the certificate
+    stored with it, and that certificate was issued to the receiver by the CA
+    given for the receiver's MSP with -cacerts.
 
 **/
 var IPaddress      *string = flag.String("ip",    "Null", "Please input the IPaddress: ")
@@ -30,7 +53,127 @@ var challengPath   *string = flag.String("c",     "Null", "Please input the chal
 var responsePath   *string = flag.String("r",     "Null", "Please input the responsePath: ")
 var key            *string = flag.String("key",   "Null", "Please input the secret key1(16Byte): ")
 
-var receiverPubKey *string = flag.String("pub",   "Null", "Please input the secret key1(16Byte): ")
+var receivers      *string = flag.String("receiver", "Null",            "Please input the receivers of the shards as MSPID:name, comma separated: ")
+var channelName    *string = flag.String("channel",  "goodwayhouse",    "Please input the channel name: ")
+var chaincodeName  *string = flag.String("cc",       "chaincode_ruben", "Please input the chaincode name: ")
+var caCerts        *string = flag.String("cacerts",  "Null",            "Please input the CA certificate of each receiver MSP as MSPID=file, comma separated: ")
+
+// receiverKey is the part of the chaincode's encryptionKey record used here
+type receiverKey struct {
+    Owner       string `json:"Owner"`
+    OwnerMSP    string `json:"OwnerMSP"`
+    PublicKey   string `json:"PublicKey"`
+    Signature   string `json:"Signature"`
+    Certificate string `json:"Certificate"`
+    Version     int    `json:"Version"`
+    Status      string `json:"Status"`
+}
+
+// ecdsaSignature is the ASN.1 form of the key's Signature
+type ecdsaSignature struct {
+    R, S *big.Int
+}
+
+// loadCACert reads the CA certificate given with -cacerts for an MSP
+func loadCACert(mspID string) (*x509.Certificate, error) {
+    for _, entry := range strings.Split(*caCerts, ",") {
+        parts := strings.SplitN(entry, "=", 2)
+        if len(parts) != 2 || parts[0] != mspID {
+            continue
+        }
+        certPEM, err := ioutil.ReadFile(parts[1])
+        if err != nil {
+            return nil, err
+        }
+        block, _ := pem.Decode(certPEM)
+        if block == nil {
+            return nil, fmt.Errorf("%s is not a PEM certificate", parts[1])
+        }
+        return x509.ParseCertificate(block.Bytes)
+    }
+    return nil, fmt.Errorf("no CA certificate given for %s, add %s=file to -cacerts", mspID, mspID)
+}
+
+// verifyKey checks that the receiver signed its public key: the stored
+// certificate must be the receiver's, issued by its MSP's CA, and the
+// Signature must be its ECDSA signature of the SHA-256 of the PEM key
+func verifyKey(key *receiverKey, mspID string, owner string) error {
+    block, _ := pem.Decode([]byte(key.Certificate))
+    if block == nil {
+        return fmt.Errorf("the key carries no certificate, it must be rotated before use")
+    }
+    cert, err := x509.ParseCertificate(block.Bytes)
+    if err != nil {
+        return err
+    }
+    if strings.ToLower(cert.Subject.CommonName) != owner {
+        return fmt.Errorf("the key carries the certificate of %s", cert.Subject.CommonName)
+    }
+    ca, err := loadCACert(mspID)
+    if err != nil {
+        return err
+    }
+    roots := x509.NewCertPool()
+    roots.AddCert(ca)
+    _, err = cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+    if err != nil {
+        return fmt.Errorf("the certificate was not issued by the CA of %s: %s", mspID, err)
+    }
+
+    signerKey, ok := cert.PublicKey.(*ecdsa.PublicKey)
+    if !ok {
+        return fmt.Errorf("the certificate does not hold an ECDSA key")
+    }
+    der, err := base64.StdEncoding.DecodeString(key.Signature)
+    if err != nil {
+        return fmt.Errorf("the signature is not base64")
+    }
+    sig := ecdsaSignature{}
+    if rest, err := asn1.Unmarshal(der, &sig); err != nil || len(rest) > 0 || sig.R == nil || sig.S == nil {
+        return fmt.Errorf("the signature is not an ASN.1 ECDSA signature")
+    }
+    digest := sha256.Sum256([]byte(key.PublicKey))
+    if !ecdsa.Verify(signerKey, digest[:], sig.R, sig.S) {
+        return fmt.Errorf("the signature does not match the key and the certificate")
+    }
+    return nil
+}
+
+// fetchPublicKey queries the ledger for the current public key of a receiver,
+// given as MSPID:name, and checks that it is active, belongs to that receiver
+// and was signed by it
+func fetchPublicKey(receiver string) ([]byte, error) {
+    parts := strings.SplitN(receiver, ":", 2)
+    if len(parts) != 2 || len(parts[0]) <= 0 || len(parts[1]) <= 0 {
+        return nil, fmt.Errorf("receiver %s must be of the form MSPID:name, e.g. Org1MSP:peer11.org1", receiver)
+    }
+    mspID, owner := parts[0], strings.ToLower(parts[1])
+
+    args, _ := json.Marshal(map[string][]string{"Args": {"getPublicKey", receiver}})
+    out, err := exec.Command("peer", "chaincode", "query", "-C", *channelName, "-n", *chaincodeName, "-c", string(args)).Output()
+    if err != nil {
+        return nil, fmt.Errorf("getPublicKey %s failed: %s", receiver, err)
+    }
+
+    key := receiverKey{}
+    if err := json.Unmarshal(out, &key); err != nil {
+        return nil, fmt.Errorf("getPublicKey %s returned %q: %s", receiver, out, err)
+    }
+    if key.OwnerMSP != mspID || key.Owner != owner {
+        return nil, fmt.Errorf("getPublicKey %s returned the key of %s:%s", receiver, key.OwnerMSP, key.Owner)
+    }
+    if key.Status != "active" {
+        return nil, fmt.Errorf("the key of %s is %s", receiver, key.Status)
+    }
+    if block, _ := pem.Decode([]byte(key.PublicKey)); block == nil {
+        return nil, fmt.Errorf("the key of %s is not PEM encoded", receiver)
+    }
+    if err := verifyKey(&key, mspID, owner); err != nil {
+        return nil, fmt.Errorf("the key of %s: %s", receiver, err)
+    }
+    fmt.Printf("\n%s %s:%s (version %d)", "The public key is from the ledger for:", key.OwnerMSP, key.Owner, key.Version)
+    return []byte(key.PublicKey), nil
+}
 
 func main(){
     flag.Parse()
@@ -40,12 +183,17 @@ func main(){
         fmt.Println("Failed to convert string to integer")
     }
 
+    receiverList := strings.Split(*receivers, ",")
+    if len(receiverList) != 1 && len(receiverList) != n {
+        fmt.Println("Please input one receiver, or one receiver per shard")
+        return
+    }
+
     dir, _ := os.Getwd()
     shardDir,          _, shardNameOnly,              shardSuffix              := Ruben.DirFileNameSuffix(*shardPath)
     challengDir,       _, challengFilenameOnly,       challengFileSuffix       := Ruben.DirFileNameSuffix(*challengPath)
     responseDir,       _, responseFilenameOnly,       responseFileSuffix       := Ruben.DirFileNameSuffix(*responsePath)
     keyDir,            _, keyFilenameOnly,            keyFileSuffix            := Ruben.DirFileNameSuffix(*key)
-    receiverPubKeyDir, _, receiverPubKeyFilenameOnly, receiverPubKeyFileSuffix := Ruben.DirFileNameSuffix(*receiverPubKey)
 
 
     for x := 0; x < n; x++ {
@@ -82,15 +230,20 @@ func main(){
 
 
                         plainCRPs := string(challeng) + string(cipherResponse)
-                        eccpublic, err := ioutil.ReadFile(dir + "\\" + receiverPubKeyDir + "\\" + receiverPubKeyFilenameOnly + "-" + strconv.Itoa(x) + receiverPubKeyFileSuffix)
-                        fmt.Printf("\n%s %s","The key-file is:", dir + "\\" + receiverPubKeyDir + "\\" + receiverPubKeyFilenameOnly + "-" + strconv.Itoa(x) + receiverPubKeyFileSuffix)
+                        receiver := receiverList[0]
+                        if len(receiverList) > 1 {
+                            receiver = strings.TrimSpace(receiverList[x])
+                        }
+                        eccpublic, err := fetchPublicKey(strings.TrimSpace(receiver))
                         if err != nil {
                             fmt.Print("err:", err)
                         } else{
                             publicKey:=[]byte(string(eccpublic))
                             cipherCRPs,_:=Ruben.EccPublicEncrypt([]byte(plainCRPs),publicKey)
 
-                            cipherCRPsPath := dir + "\\" + shardDir + "\\" + receiverPubKeyFilenameOnly + "-" + strconv.Itoa(x) +  "-cipherCRPs" + challengFileSuffix
+                            // ':' is not allowed in Windows file names
+                            receiverFileName := strings.Replace(strings.TrimSpace(receiver), ":", "_", -1)
+                            cipherCRPsPath := dir + "\\" + shardDir + "\\" + receiverFileName + "-" + strconv.Itoa(x) +  "-cipherCRPs" + challengFileSuffix
                             Ruben.WriteHashInFile(cipherCRPsPath, string(cipherCRPs))
                             fmt.Println("\n")
 
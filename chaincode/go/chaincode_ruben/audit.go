@@ -0,0 +1,341 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright Receivership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// auditEntry is one change to one shard in the getAuditTrailForData timeline
+type auditEntry struct {
+	ShardId		string    `json:"ShardId"`
+	TxId		string    `json:"TxId"`
+	Timestamp	string    `json:"Timestamp"`	// RFC 3339 with nanoseconds
+	Function	string    `json:"Function"`	// chaincode function that made the change
+	MSPID		string    `json:"MSPID"`	// creator's MSP, empty for changes made before shards recorded it
+	Subject		string    `json:"Subject"`	// creator's certificate subject
+	IsDelete	bool      `json:"IsDelete"`
+	Reason		string    `json:"Reason,omitempty"`	// Reason given to deleteShard
+	Changes		[]fieldChange `json:"Changes"`
+}
+
+// fieldChange is one shard field that differs from the previous version.
+// Old is null for a new shard, New is null for a deleted one.
+type fieldChange struct {
+	Field	string    		`json:"Field"`
+	Old	json.RawMessage		`json:"Old"`
+	New	json.RawMessage		`json:"New"`
+}
+
+// auditFields are written on every change and describe it rather than the shard,
+// so they are reported in the entry instead of in its Changes
+var auditFields = []string{"ModifiedByMSP", "ModifiedBySubject", "ModifiedIn", "UpdatedAt"}
+
+
+// ===========================================================
+// stampShard records who is writing a shard, from which function and when, so
+// its history says who made each change
+// ===========================================================
+func stampShard(stub shim.ChaincodeStubInterface, s *shard) error {
+	mspID, subject, err := getCallerSubject(stub)
+	if err != nil {
+		return err
+	}
+	updatedAt, err := getTxTimestamp(stub)
+	if err != nil {
+		return err
+	}
+	function, _ := stub.GetFunctionAndParameters()
+	s.ModifiedByMSP = mspID
+	s.ModifiedBySubject = subject
+	s.ModifiedIn = function
+	s.UpdatedAt = updatedAt
+	return nil
+}
+
+// getCallerSubject returns the caller's MSP ID and certificate subject
+func getCallerSubject(stub shim.ChaincodeStubInterface) (string, string, error) {
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to get caller MSP ID: %s", err.Error())
+	}
+	cert, err := cid.GetX509Certificate(stub)
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to get caller certificate: %s", err.Error())
+	}
+	return mspID, cert.Subject.String(), nil
+}
+
+
+// ============================================================
+// getAuditTrailForData - merge the history of every shard of a DataId, deleted
+// ones included, into one timeline ordered by transaction timestamp. Each entry
+// names the creator and lists the fields the transaction changed.
+// Timestamps are set by the clients, so they need not grow along a key's
+// history; each shard's changes stay in the order they were committed.
+// ============================================================
+func (t *SimpleChaincode) getAuditTrailForData(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	if len(args) != 1 {
+		return queryError("Incorrect number of arguments. Expecting 1(DataId)")
+	}
+	if len(args[0]) <= 0 {
+		return queryError("1st argument must be a non-empty string")
+	}
+	dataId := strings.ToLower(args[0])
+	fmt.Println("- start getAuditTrailForData ", dataId)
+
+	shardIds, err := getShardIdsForAudit(stub, dataId)
+	if err != nil {
+		return queryError(err.Error())
+	}
+
+	trails := [][]auditEntry{}
+	for _, shardId := range shardIds {
+		shardEntries, err := getAuditTrailForShard(stub, shardId)
+		if err != nil {
+			return queryError(err.Error())
+		}
+		trails = append(trails, shardEntries)
+	}
+	entries := mergeAuditTrails(trails)
+
+	queryResults, err := newQueryResponse(entries, nil)
+	if err != nil {
+		return queryError(err.Error())
+	}
+	return shim.Success(queryResults)
+}
+
+
+// getShardIdsForAudit lists every ShardId of a DataId: those its data document
+// lists, added or not, and any other shard still indexed under the DataId
+func getShardIdsForAudit(stub shim.ChaincodeStubInterface, dataId string) ([]string, error) {
+	shardIds := []string{}
+	d, err := getData(stub, dataId)
+	if err == nil {
+		shardIds = append(shardIds, d.ShardIds...)
+	} else if err != errDataNotFound {
+		return nil, err
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(dataIdIndexName, []string{dataId})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		indexEntry, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, compositeKeyParts, err := stub.SplitCompositeKey(indexEntry.Key)
+		if err != nil {
+			return nil, err
+		}
+		shardId := compositeKeyParts[len(compositeKeyParts)-1]
+		if !containsString(shardIds, shardId) {
+			shardIds = append(shardIds, shardId)
+		}
+	}
+	if len(shardIds) == 0 {
+		return nil, fmt.Errorf("no shards found for DataId %s", dataId)
+	}
+	return shardIds, nil
+}
+
+// mergeAuditTrails merges the trails of several shards by timestamp, then
+// TxId, taking each trail's entries in their own order
+func mergeAuditTrails(trails [][]auditEntry) []auditEntry {
+	entries := []auditEntry{}
+	for {
+		next := -1
+		for i, trail := range trails {
+			if len(trail) == 0 {
+				continue
+			}
+			if next < 0 || auditEntryBefore(&trail[0], &trails[next][0]) {
+				next = i
+			}
+		}
+		if next < 0 {
+			return entries
+		}
+		entries = append(entries, trails[next][0])
+		trails[next] = trails[next][1:]
+	}
+}
+
+// auditEntryBefore orders two entries of different shards
+func auditEntryBefore(a *auditEntry, b *auditEntry) bool {
+	if a.Timestamp != b.Timestamp {
+		return timestampBefore(a.Timestamp, b.Timestamp)
+	}
+	return a.TxId < b.TxId
+}
+
+// getAuditTrailForShard turns the history of one shard key into audit entries,
+// in the order the changes were committed
+func getAuditTrailForShard(stub shim.ChaincodeStubInterface, shardId string) ([]auditEntry, error) {
+	resultsIterator, err := stub.GetHistoryForKey(shardId)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+	records, err := constructHistoryFromIterator(resultsIterator)
+	if err != nil {
+		return nil, err
+	}
+
+	tombstones, err := getTombstonesByTxId(stub, shardId)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []auditEntry{}
+	var previous map[string]json.RawMessage
+	for _, record := range records {
+		entry := auditEntry{
+			ShardId:   shardId,
+			TxId:      record.TxId,
+			Timestamp: record.Timestamp,
+			IsDelete:  record.IsDelete,
+		}
+
+		var current map[string]json.RawMessage
+		if record.IsDelete {
+			entry.Function = "deleteShard"
+			if tomb, ok := tombstones[record.TxId]; ok {
+				entry.MSPID = tomb.DeletedByMSP
+				entry.Subject = tomb.DeletedBySubject
+				entry.Reason = tomb.Reason
+			}
+		} else {
+			err = json.Unmarshal(record.Value, &current)
+			if err != nil {
+				return nil, err
+			}
+			entry.Function = jsonString(current["ModifiedIn"])
+			entry.MSPID = jsonString(current["ModifiedByMSP"])
+			entry.Subject = jsonString(current["ModifiedBySubject"])
+		}
+		entry.Changes = diffFields(previous, current)
+
+		entries = append(entries, entry)
+		previous = current
+	}
+	return entries, nil
+}
+
+// getTombstonesByTxId returns every tombstone ever written for a shard, by the
+// transaction that deleted it
+func getTombstonesByTxId(stub shim.ChaincodeStubInterface, shardId string) (map[string]*tombstone, error) {
+	tombstoneKey, err := stub.CreateCompositeKey(tombstoneIndexName, []string{shardId})
+	if err != nil {
+		return nil, err
+	}
+	resultsIterator, err := stub.GetHistoryForKey(tombstoneKey)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	tombstones := map[string]*tombstone{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if response.IsDelete {
+			continue
+		}
+		tomb := &tombstone{}
+		err = json.Unmarshal(response.Value, tomb)
+		if err != nil {
+			return nil, err
+		}
+		tombstones[tomb.TxId] = tomb
+	}
+	return tombstones, nil
+}
+
+// diffFields lists the fields that differ between two versions of a shard,
+// in field name order, leaving out the audit fields
+func diffFields(previous map[string]json.RawMessage, current map[string]json.RawMessage) []fieldChange {
+	fields := []string{}
+	for field := range previous {
+		fields = append(fields, field)
+	}
+	for field := range current {
+		if _, ok := previous[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	changes := []fieldChange{}
+	null := json.RawMessage("null")
+	for _, field := range fields {
+		if containsString(auditFields, field) {
+			continue
+		}
+		old, ok := previous[field]
+		if !ok {
+			old = null
+		}
+		new, ok := current[field]
+		if !ok {
+			new = null
+		}
+		if !bytes.Equal(old, new) {
+			changes = append(changes, fieldChange{Field: field, Old: old, New: new})
+		}
+	}
+	return changes
+}
+
+// jsonString decodes a JSON string value, returning "" for anything else
+func jsonString(value json.RawMessage) string {
+	s := ""
+	if json.Unmarshal(value, &s) != nil {
+		return ""
+	}
+	return s
+}
+
+// timestampBefore orders two history timestamps. RFC3339Nano drops trailing
+// zeros, so they do not sort as strings; unparsable ones sort first.
+func timestampBefore(a string, b string) bool {
+	ta, errA := time.Parse(time.RFC3339Nano, a)
+	tb, errB := time.Parse(time.RFC3339Nano, b)
+	if errA != nil || errB != nil {
+		return errA != nil && errB == nil
+	}
+	return ta.Before(tb)
+}
@@ -0,0 +1,270 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright Receivership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// shardEntry is one element of the addShards JSON array, the same seven values
+// addShard takes as positional arguments
+type shardEntry struct {
+	Sender		string    `json:"Sender"`
+	ShardId		string    `json:"ShardId"`
+	DataId		string    `json:"DataId"`
+	Receiver	string    `json:"Receiver"`
+	Threshold	int 	  `json:"Threshold"`
+	PUFNum		int 	  `json:"PUFNum"`	// may be left out when PUFIds is given
+	PUFIds		[]string  `json:"PUFIds,omitempty"`	// optional, registered PUF devices the shard depends on
+	SuccessNum	int 	  `json:"SuccessNum"`	// optional, must be 0
+	Challenges	[]shardChallenge `json:"Challenges,omitempty"`	// optional, reserved for the shard's verification
+}
+
+// maxBatchSize caps the number of shards one addShards transaction may add
+const maxBatchSize = 100
+
+const eventShardsAdded = "ShardsAdded"
+
+
+// ============================================================
+// addShards - create several shards in one transaction, e.g. all the shards of
+// a file computed by File_Operation/1-3ShardId_DataId.go:
+//
+//   [{"Sender":"peer01.org1","ShardId":"...","DataId":"...","Receiver":"Org1MSP:peer11.org1",
+//     "Threshold":2,"PUFNum":3}, ...]
+//
+// Every entry is checked as addShard would before anything is written, so
+// either all the shards and their index entries are stored or none is.
+// ============================================================
+func (t *SimpleChaincode) addShards(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1(JSON array of shards)")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	entries := []shardEntry{}
+	err := json.Unmarshal([]byte(args[0]), &entries)
+	if err != nil {
+		return shim.Error("1st argument must be a JSON array of shards: " + err.Error())
+	}
+	if len(entries) == 0 {
+		return shim.Error("1st argument must contain at least one shard")
+	}
+	if len(entries) > maxBatchSize {
+		return shim.Error(fmt.Sprintf("at most %d shards may be added in one transaction, got %d", maxBatchSize, len(entries)))
+	}
+	fmt.Println("- start addShards ", len(entries))
+
+	// ==== Check every entry before writing anything ====
+	// A transaction does not read its own writes, so duplicates within the batch
+	// and the data documents shared by several entries are tracked here.
+	shards := make([]*shard, 0, len(entries))
+	shardIds := make([]string, 0, len(entries))
+	dataDocs := map[string]*data{}
+	dataIds := []string{}
+	spender := newChallengeSpender(stub)
+	for i, entry := range entries {
+		s, err := newShardFromEntry(stub, entry)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("shard %d: %s", i, err.Error()))
+		}
+		if containsString(shardIds, s.ShardId) {
+			return shim.Error(fmt.Sprintf("shard %d: ShardId %s appears more than once", i, s.ShardId))
+		}
+
+		shardAsBytes, err := stub.GetState(s.ShardId)
+		if err != nil {
+			return shim.Error("Failed to get shard: " + err.Error())
+		} else if shardAsBytes != nil {
+			return shim.Error(fmt.Sprintf("shard %d: This shard already exists: %s", i, s.ShardId))
+		}
+
+		d, ok := dataDocs[s.DataId]
+		if !ok {
+			d, err = getData(stub, s.DataId)
+			if err != nil {
+				return shim.Error(fmt.Sprintf("shard %d: %s: %s", i, err.Error(), s.DataId))
+			}
+			dataDocs[s.DataId] = d
+			dataIds = append(dataIds, s.DataId)
+		}
+		err = checkShardForData(d, s)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("shard %d: %s", i, err.Error()))
+		}
+		err = reserveChallenges(spender, s, entry.Challenges, "addShards")
+		if err != nil {
+			return shim.Error(fmt.Sprintf("shard %d: %s", i, err.Error()))
+		}
+
+		shards = append(shards, s)
+		shardIds = append(shardIds, s.ShardId)
+	}
+
+	err = chargeQuota(stub, len(shards), 0)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ==== Save the shards, their index entries and the updated data documents ====
+	for _, s := range shards {
+		err = stampShard(stub, s)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		s.CreatedAt = s.UpdatedAt
+		shardJSONasBytes, err := json.Marshal(s)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = stub.PutState(s.ShardId, shardJSONasBytes)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = applyShardEndorsement(stub, s)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = updateShardIndexes(stub, nil, s)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		dataDocs[s.DataId].ShardsAdded++
+	}
+	err = spender.flush()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, dataId := range dataIds {
+		d := dataDocs[dataId]
+		d.Complete = d.ShardsAdded >= d.ShardCount
+		err = putData(stub, d)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	// ==== A transaction carries a single event, so the batch gets one ====
+	err = emitShardsEvent(stub, eventShardsAdded, shards)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end addShards (success)")
+	return shim.Success(nil)
+}
+
+
+// ============================================================
+// newShardFromEntry checks an addShards entry the way addShard checks its
+// arguments and builds the shard it describes
+// ============================================================
+func newShardFromEntry(stub shim.ChaincodeStubInterface, entry shardEntry) (*shard, error) {
+	if len(entry.Sender) <= 0 {
+		return nil, fmt.Errorf("Sender must be a non-empty string")
+	}
+	if len(entry.ShardId) <= 0 {
+		return nil, fmt.Errorf("ShardId must be a non-empty string")
+	}
+	if len(entry.DataId) <= 0 {
+		return nil, fmt.Errorf("DataId must be a non-empty string")
+	}
+	if len(entry.Receiver) <= 0 {
+		return nil, fmt.Errorf("Receiver must be a non-empty string")
+	}
+	receiver, err := parseIdentity(entry.Receiver)
+	if err != nil {
+		return nil, fmt.Errorf("Receiver %s", err.Error())
+	}
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get caller identity: %s", err.Error())
+	}
+	if caller.Name != strings.ToLower(entry.Sender) {
+		return nil, fmt.Errorf("Caller %s is not the Sender %s", caller.String(), strings.ToLower(entry.Sender))
+	}
+	if len(entry.PUFIds) > 0 {
+		if entry.PUFNum != 0 && entry.PUFNum != len(entry.PUFIds) {
+			return nil, fmt.Errorf("PUFNum must match the number of PUFIds")
+		}
+		err = checkPUFIds(stub, entry.PUFIds)
+		if err != nil {
+			return nil, err
+		}
+		entry.PUFNum = len(entry.PUFIds)
+	}
+	if entry.PUFNum <= 0 {
+		return nil, fmt.Errorf("PUFNum must be a positive number")
+	}
+	if entry.Threshold <= 0 || entry.Threshold > entry.PUFNum {
+		return nil, fmt.Errorf("Threshold must be between 1 and PUFNum")
+	}
+	if entry.SuccessNum != 0 {
+		return nil, fmt.Errorf("SuccessNum must be 0, SuccessNum is only raised by verifyPUFResponse")
+	}
+
+	s := &shard{
+		ObjectType:    "shard",
+		SchemaVersion: schemaVersions["shard"],
+		Sender:        strings.ToLower(entry.Sender),
+		SenderMSP:     caller.MSPID,
+		ShardId:       entry.ShardId,
+		DataId:        strings.ToLower(entry.DataId),
+		Receiver:      receiver.Name,
+		ReceiverMSP:   receiver.MSPID,
+		Threshold:     entry.Threshold,
+		PUFNum:        entry.PUFNum,
+		PUFIds:        entry.PUFIds,
+		SuccessNum:    0,
+		Status:        statusCreated,
+	}
+	return s, nil
+}
+
+// ===========================================================
+// emitShardsEvent sets one chaincode event listing every shard of a batch
+// ===========================================================
+func emitShardsEvent(stub shim.ChaincodeStubInterface, eventName string, shards []*shard) error {
+	event := &shardEvent{
+		TxId: stub.GetTxID(),
+	}
+	for _, s := range shards {
+		event.ShardIds = append(event.ShardIds, s.ShardId)
+		event.Shards = append(event.Shards, shardSummary{
+			ShardId:  s.ShardId,
+			DataId:   s.DataId,
+			Sender:   s.Sender,
+			Receiver: s.Receiver,
+		})
+	}
+	eventAsBytes, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent(eventName, eventAsBytes)
+}
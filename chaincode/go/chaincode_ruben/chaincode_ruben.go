@@ -20,13 +20,13 @@ under the License.
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
 )
@@ -37,16 +37,95 @@ type SimpleChaincode struct {
 
 type shard struct {
 	ObjectType	string    `json:"docType"`	// docType is used to distinguish the various types of objects in state database
+	SchemaVersion	int 	  `json:"SchemaVersion"`	// see schema.go
 	Sender		string    `json:"Sender"`	// peer01.Org1
 	ShardId		string    `json:"ShardId"`	// ShardId: Hash256{ IP, x, shard }
 	DataId		string    `json:"DataId"`	// DataId: Hash256{ (c1,c1,···cN), K(r1,r1···rN), ShardId }
 	Receiver	string    `json:"Receiver"`	// peer11.Org1, peer02.Org2, peer12.Org2
+	SenderMSP	string    `json:"SenderMSP,omitempty"`	// Sender's MSP, from its certificate when it adds the shard
+	ReceiverMSP	string    `json:"ReceiverMSP,omitempty"`	// Receiver's MSP, given with its name as MSPID:name
 
-	Threshold	int 	  `json:"Threshold"`	// τ
+	Threshold	int 	  `json:"Threshold"`	// PUFs that must pass verifyPUFResponse before release
 	PUFNum		int 	  `json:"PUFNum"`	// 6 PUFs
+	PUFIds		[]string  `json:"PUFIds,omitempty"`	// registered PUF devices the shard depends on, see puf_registry.go
+	SuccessNum	int 	  `json:"SuccessNum"`	// PUFs that have passed verifyPUFResponse
+
+	PrevReceiver	string    `json:"PrevReceiver,omitempty"`	// Receiver before the last transferShard
+	TransferredBy	string    `json:"TransferredBy,omitempty"`	// caller that performed the last transferShard
+
+	ReleasedTo	string    `json:"ReleasedTo,omitempty"`	// Receiver the shard was last released to
+	ReleasedAt	string    `json:"ReleasedAt,omitempty"`	// transaction timestamp of the last releaseShard, RFC 3339
+	Status		string    `json:"Status"`	// lifecycle status, see lifecycle.go
+	RevokeReason	string    `json:"RevokeReason,omitempty"`	// Reason given to revokeShard
+
+	CreatedAt	string    `json:"CreatedAt,omitempty"`	// transaction timestamp of addShard, RFC 3339
+	UpdatedAt	string    `json:"UpdatedAt,omitempty"`	// transaction timestamp of the last write, RFC 3339
+
+	ModifiedByMSP		string    `json:"ModifiedByMSP,omitempty"`	// MSP of the caller that last wrote the shard
+	ModifiedBySubject	string    `json:"ModifiedBySubject,omitempty"`	// certificate subject of that caller
+	ModifiedIn		string    `json:"ModifiedIn,omitempty"`	// chaincode function that last wrote the shard, see audit.go
+}
+
+// tombstone is left in place of a shard removed by deleteShard
+type tombstone struct {
+	ObjectType	string    `json:"docType"`	// "tombstone"
+	SchemaVersion	int 	  `json:"SchemaVersion"`
+	ShardId		string    `json:"ShardId"`
+	DataId		string    `json:"DataId"`
+	Sender		string    `json:"Sender"`
+	Receiver	string    `json:"Receiver"`
+
+	DeletedBy	string    `json:"DeletedBy"`	// caller that performed the deleteShard
+	DeletedByMSP	string    `json:"DeletedByMSP,omitempty"`	// MSP of that caller
+	DeletedBySubject	string    `json:"DeletedBySubject,omitempty"`	// certificate subject of that caller
+	DeletedAt	string    `json:"DeletedAt"`	// transaction timestamp, RFC 3339
+	Reason		string    `json:"Reason"`
+	TxId		string    `json:"TxId"`
+}
+
+// shardEvent is the JSON payload of every chaincode event emitted for a shard
+type shardEvent struct {
+	ShardId		string    `json:"ShardId"`
+	DataId		string    `json:"DataId"`
+	Sender		string    `json:"Sender"`
+	Receiver	string    `json:"Receiver"`
+	TxId		string    `json:"TxId"`
+
+	PrevReceiver	string    `json:"PrevReceiver,omitempty"`
 	SuccessNum	int 	  `json:"SuccessNum"`
+	Threshold	int 	  `json:"Threshold"`
+	Status		string    `json:"Status"`
+	ShardIds	[]string  `json:"ShardIds,omitempty"`	// every shard of a batch event; ShardId is then empty
+	Shards		[]shardSummary `json:"Shards,omitempty"`	// the same shards with their DataId, Sender and Receiver
 }
 
+// shardSummary describes one shard of a batch event
+type shardSummary struct {
+	ShardId		string    `json:"ShardId"`
+	DataId		string    `json:"DataId"`
+	Sender		string    `json:"Sender"`
+	Receiver	string    `json:"Receiver"`
+}
+
+const (
+	senderIndexName    = "Sender~ShardId"
+	receiverIndexName  = "Receiver~ShardId"
+	dataIdIndexName    = "DataId~ShardId"
+	tombstoneIndexName = "Tombstone~ShardId"
+)
+
+// maxPageSize caps the page size of every paginated query, whatever the client asks for
+const maxPageSize = 100
+
+// chaincode event names, one per shard state change
+const (
+	eventShardAdded       = "ShardAdded"
+	eventShardTransferred = "ShardTransferred"
+	eventShardDeleted     = "ShardDeleted"
+	eventPUFVerified      = "PUFVerified"
+	eventShardReleased    = "ShardReleased"
+)
+
 
 // ===================================================================================
 // Main
@@ -60,8 +139,15 @@ func main() {
 
 
 // Init initializes chaincode
+// Init arguments are optional key=value settings, see chaincodeConfig
 // ===========================
 func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	_, args := stub.GetFunctionAndParameters()
+
+	err := initConfig(stub, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	return shim.Success(nil)
 }
 
@@ -72,9 +158,93 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	function, args := stub.GetFunctionAndParameters()
 	fmt.Println("invoke is running " + function)
 
+	// functions without roles are not callable, whatever the dispatch below knows
+	if _, ok := functionRoles[function]; !ok {
+		return unknownFunction(function)
+	}
+	if denied := checkAccess(stub, function); denied != nil {
+		fmt.Println("invoke denied: " + denied.Message)
+		return *denied
+	}
+
 	if function == "addShard" {
 		return t.addShard(stub, args)
+	} else if function == "addShards" {
+		return t.addShards(stub, args)
 	} else if function == "transferShard" {
+		return t.transferShard(stub, args)
+	} else if function == "deleteShard" {
+		return t.deleteShard(stub, args)
+	} else if function == "readTombstone" {
+		return t.readTombstone(stub, args)
+	} else if function == "enrollPUFReference" {
+		return t.enrollPUFReference(stub, args)
+	} else if function == "verifyPUFResponse" {
+		return t.verifyPUFResponse(stub, args)
+	} else if function == "releaseShard" {
+		return t.releaseShard(stub, args)
+	} else if function == "readShardForReceiver" {
+		return t.readShardForReceiver(stub, args)
+	} else if function == "getReleaseStatus" {
+		return t.getReleaseStatus(stub, args)
+	} else if function == "registerData" {
+		return t.registerData(stub, args)
+	} else if function == "getData" {
+		return t.getData(stub, args)
+	} else if function == "getShardsForData" {
+		return t.getShardsForData(stub, args)
+	} else if function == "putCRPs" {
+		return t.putCRPs(stub, args)
+	} else if function == "getCRPs" {
+		return t.getCRPs(stub, args)
+	} else if function == "getCRPsHash" {
+		return t.getCRPsHash(stub, args)
+	} else if function == "verifyCRPs" {
+		return t.verifyCRPs(stub, args)
+	} else if function == "getFunctionRoles" {
+		return t.getFunctionRoles(stub, args)
+	} else if function == "getCallerRoles" {
+		return t.getCallerRoles(stub, args)
+	} else if function == "confirmRetrieval" {
+		return t.confirmRetrieval(stub, args)
+	} else if function == "revokeShard" {
+		return t.revokeShard(stub, args)
+	} else if function == "getShardsByStatus" {
+		return t.getShardsByStatus(stub, args)
+	} else if function == "queryShardsByStatus" {
+		return t.queryShardsByStatus(stub, args)
+	} else if function == "migrateShards" {
+		return t.migrateShards(stub, args)
+	} else if function == "setChallengeBudget" {
+		return t.setChallengeBudget(stub, args)
+	} else if function == "getRemainingChallenges" {
+		return t.getRemainingChallenges(stub, args)
+	} else if function == "registerPUF" {
+		return t.registerPUF(stub, args)
+	} else if function == "revokePUF" {
+		return t.revokePUF(stub, args)
+	} else if function == "getPUF" {
+		return t.getPUF(stub, args)
+	} else if function == "listPUFsByOrg" {
+		return t.listPUFsByOrg(stub, args)
+	} else if function == "publishKey" {
+		return t.publishKey(stub, args)
+	} else if function == "rotateKey" {
+		return t.rotateKey(stub, args)
+	} else if function == "revokeKey" {
+		return t.revokeKey(stub, args)
+	} else if function == "getPublicKey" {
+		return t.getPublicKey(stub, args)
+	} else if function == "setQuota" {
+		return t.setQuota(stub, args)
+	} else if function == "getQuotaUsage" {
+		return t.getQuotaUsage(stub, args)
+	} else if function == "getMetadata" {
+		return t.getMetadata(stub, args)
+	} else if function == "getShardEndorsement" {
+		return t.getShardEndorsement(stub, args)
+	} else if function == "setShardEndorsement" {
+		return t.setShardEndorsement(stub, args)
 	} else if function == "readShard" {
 		return t.readShard(stub, args)
 	} else if function == "queryShardsBySender" {
@@ -83,23 +253,55 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return t.queryShards(stub, args)
 	} else if function == "getHistoryForShard" {
 		return t.getHistoryForShard(stub, args)
+	} else if function == "getAuditTrailForData" {
+		return t.getAuditTrailForData(stub, args)
 	} else if function == "getShardsByRange" {
 		return t.getShardsByRange(stub, args)
+	} else if function == "queryShardsStructured" {
+		return t.queryShardsStructured(stub, args)
+	} else if function == "queryShardsByReceiver" {
+		return t.queryShardsByReceiver(stub, args)
+	} else if function == "queryShardsByDataId" {
+		return t.queryShardsByDataId(stub, args)
+	} else if function == "queryShardsBySenderInWindow" {
+		return t.queryShardsBySenderInWindow(stub, args)
+	} else if function == "queryShardsByReceiverInWindow" {
+		return t.queryShardsByReceiverInWindow(stub, args)
+	} else if function == "queryShardsByDataIdInWindow" {
+		return t.queryShardsByDataIdInWindow(stub, args)
+	} else if function == "getShardsBySender" {
+		return t.getShardsBySender(stub, args)
+	} else if function == "getShardsByReceiver" {
+		return t.getShardsByReceiver(stub, args)
+	} else if function == "getShardsByDataId" {
+		return t.getShardsByDataId(stub, args)
+	} else if function == "queryShardsWithPagination" {
+		return t.queryShardsWithPagination(stub, args)
+	} else if function == "queryShardsBySenderWithPagination" {
+		return t.queryShardsBySenderWithPagination(stub, args)
+	} else if function == "getShardsByRangeWithPagination" {
+		return t.getShardsByRangeWithPagination(stub, args)
 	}
 
+	return unknownFunction(function)
+}
+
+// unknownFunction is the response to a function Invoke does not dispatch
+func unknownFunction(function string) pb.Response {
 	fmt.Println("invoke did not find func: " + function)
 	return shim.Error("Received unknown function invocation(Receive unknown function calls)")
 }
 
 // 1
 // ============================================================
-// addShard - create a new shard, store into chaincode state
+// addShard - create a new shard, store into chaincode state. The caller must
+// be the Sender.
 // ============================================================
 func (t *SimpleChaincode) addShard(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
 
-	if len(args) != 7 {
-		return shim.Error("Incorrect number of arguments. Expecting 7(7parameters：Sender, ShardId, DataId, Receiver, Threshold, PUFNum, SuccessNum)")
+	if len(args) != 7 && len(args) != 8 {
+		return shim.Error("Incorrect number of arguments. Expecting 7(7parameters：Sender, ShardId, DataId, Receiver, Threshold, PUFNum, SuccessNum) or 8(..., Challenges)")
 	}
 
 	// ==== Input sanitation ====
@@ -126,24 +328,38 @@ func (t *SimpleChaincode) addShard(stub shim.ChaincodeStubInterface, args []stri
 	if len(args[6]) <= 0 {
 		return shim.Error("7rd argument must be a non-empty string")
 	}
-	Sender := strings.ToLower(args[0])
-	ShardId := args[1]
-	DataId := strings.ToLower(args[2])
-	Receiver := strings.ToLower(args[3])
-
-	Threshold, err := strconv.Atoi(args[4])
+	entry := shardEntry{
+		Sender:   args[0],
+		ShardId:  args[1],
+		DataId:   args[2],
+		Receiver: args[3],
+	}
+	entry.Threshold, err = strconv.Atoi(args[4])
 	if err != nil {
 		return shim.Error("5rd argument must be a numeric string")
 	}
-	PUFNum, err := strconv.Atoi(args[5])
+	entry.PUFNum, entry.PUFIds, err = parsePUFIds(args[5])
 	if err != nil {
-		return shim.Error("6rd argument must be a numeric string")
+		return shim.Error("6rd argument " + err.Error())
 	}
-	SuccessNum, err := strconv.Atoi(args[6])
+	entry.SuccessNum, err = strconv.Atoi(args[6])
 	if err != nil {
 		return shim.Error("7rd argument must be a numeric string")
 	}
+	// ==== Optional challenges reserved for the shard's verification, see challenges.go ====
+	if len(args) == 8 {
+		err = json.Unmarshal([]byte(args[7]), &entry.Challenges)
+		if err != nil {
+			return shim.Error("8th argument must be a JSON array of {PUFId, ChallengeHash}")
+		}
+	}
 
+	// ==== Check the shard the way addShards checks each of its entries ====
+	shard, err := newShardFromEntry(stub, entry)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	ShardId := shard.ShardId
 
 	// ==== Check if shard already exists ====
 	shardAsBytes, err := stub.GetState(ShardId)
@@ -154,9 +370,33 @@ func (t *SimpleChaincode) addShard(stub shim.ChaincodeStubInterface, args []stri
 		return shim.Error("This shard already exists: " + ShardId)
 	}
 
-	// ==== Create shard object and marshal to JSON ====
-	objectType := "shard"
-	shard := &shard{objectType, Sender, ShardId, DataId, Receiver, Threshold, PUFNum, SuccessNum}
+	// ==== Check that the shard belongs to a registered, incomplete file ====
+	d, err := getData(stub, shard.DataId)
+	if err != nil {
+		return shim.Error(err.Error() + ": " + shard.DataId)
+	}
+	err = checkShardForData(d, shard)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	spender := newChallengeSpender(stub)
+	err = reserveChallenges(spender, shard, entry.Challenges, "addShard")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = spender.flush()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = chargeQuota(stub, 1, 0)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stampShard(stub, shard)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	shard.CreatedAt = shard.UpdatedAt
 	shardJSONasBytes, err := json.Marshal(shard)
 	if err != nil {
 		return shim.Error(err.Error())
@@ -167,22 +407,31 @@ func (t *SimpleChaincode) addShard(stub shim.ChaincodeStubInterface, args []stri
 	if err != nil {
 		return shim.Error(err.Error())
 	}
+	err = applyShardEndorsement(stub, shard)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	//  ==== Index the shard to enable Sender-based range queries, e.g. return all peer01.Org1 shards ====
+	//  ==== Index the shard to enable Sender, Receiver and DataId based range queries, e.g. return all peer01.Org1 shards ====
 	//  An 'index' is a normal key/value entry in state.
 	//  The key is a composite key, with the elements that you want to range query on listed first.
-	//  In our case, the composite key is based on indexName~Sender~ShardId.
+	//  In our case, the composite keys are based on indexName~Sender~ShardId, indexName~Receiver~ShardId
+	//  and indexName~DataId~ShardId.
 	//  This will enable very efficient state range queries based on composite keys matching indexName~Sender~*
-	indexName := "Sender~ShardId"
-	senderShardIdIndexKey, err := stub.CreateCompositeKey(indexName, []string{shard.Sender, shard.ShardId})
+	err = updateShardIndexes(stub, nil, shard)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	//  Save index entry to state. Only the key name is needed, no need to store a duplicate copy of the shard.
-	//  Note - passing a 'nil' value will effectively delete the key from state, therefore we pass null character as value
-	value := []byte{0x00}
-	stub.PutState(senderShardIdIndexKey, value)
+	err = addShardToData(stub, d)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = emitShardEvent(stub, eventShardAdded, shard)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	// ==== shard saved and indexed. Return success ====
 	fmt.Println("- end init shard")
@@ -192,17 +441,32 @@ func (t *SimpleChaincode) addShard(stub shim.ChaincodeStubInterface, args []stri
 
 // 2
 // ===========================================================
-// transfer a shard by setting a new Receiver name on the shard
+// transfer a shard by setting a new Receiver, given as MSPID:name, on the shard
+// Only the shard's current Receiver or its Sender may transfer it.
 // ===========================================================
 func (t *SimpleChaincode) transferShard(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	if len(args) < 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2(ShardId, newReceiver)")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
 	}
 
 	shardId := args[0]
-	newReceiver := strings.ToLower(args[1])
-	fmt.Println("- start transferShard ", shardId, newReceiver)
+	newReceiver, err := parseIdentity(args[1])
+	if err != nil {
+		return shim.Error("2nd argument " + err.Error())
+	}
+	fmt.Println("- start transferShard ", shardId, newReceiver.String())
+
+	caller, err := getCaller(stub)
+	if err != nil {
+		return shim.Error("Failed to get caller identity: " + err.Error())
+	}
 
 	shardAsBytes, err := stub.GetState(shardId)
 	if err != nil {
@@ -211,36 +475,137 @@ func (t *SimpleChaincode) transferShard(stub shim.ChaincodeStubInterface, args [
 		return shim.Error("shard does not exist")
 	}
 
-	shardToTransfer := shard{}
-	err = json.Unmarshal(shardAsBytes, &shardToTransfer) //unmarshal it aka JSON.parse()
+	decoded, err := decodeShard(shardAsBytes) //unmarshal it aka JSON.parse()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	shardToTransfer := *decoded
+	previous := shardToTransfer
+	if !caller.is(shardToTransfer.Receiver, shardToTransfer.ReceiverMSP) && !caller.is(shardToTransfer.Sender, shardToTransfer.SenderMSP) {
+		return shim.Error("Caller " + caller.String() + " is neither the Receiver nor the Sender of shard " + shardId)
+	}
+	// once verification has started against the Receiver's PUFs the shard stays with it
+	err = checkShardStatus(&shardToTransfer, "transferShard", statusCreated, statusAssigned)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if newReceiver.is(shardToTransfer.Receiver, shardToTransfer.ReceiverMSP) {
+		return shim.Error("shard " + shardId + " is already assigned to " + newReceiver.String())
+	}
+
+	shardToTransfer.PrevReceiver = shardToTransfer.Receiver
+	shardToTransfer.TransferredBy = caller.Name
+	shardToTransfer.Receiver = newReceiver.Name //change the Receiver
+	shardToTransfer.ReceiverMSP = newReceiver.MSPID
+	err = stampShard(stub, &shardToTransfer)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	shardToTransfer.Receiver = newReceiver //change the Receiver
 
 	shardJSONasBytes, _ := json.Marshal(shardToTransfer)
 	err = stub.PutState(shardId, shardJSONasBytes) //rewrite the shard
 	if err != nil {
 		return shim.Error(err.Error())
 	}
+	// the new Receiver's org replaces the old one in the key's policy
+	err = applyShardEndorsement(stub, &shardToTransfer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// move the Receiver~ShardId index entry to the new Receiver
+	err = updateShardIndexes(stub, &previous, &shardToTransfer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = emitShardEvent(stub, eventShardTransferred, &shardToTransfer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	fmt.Println("- end transferShard (success)")
 	return shim.Success(nil)
 }
 
 
-/*
+// identity names a client by its MSP ID and the common name of its X.509
+// certificate. Any org's CA can issue a certificate with any common name, so a
+// name on its own proves nothing and parties are always compared on both.
+type identity struct {
+	MSPID	string
+	Name	string	// lower case, e.g. peer01.org1
+}
+
+// ===========================================================
+// getCaller returns the identity of the invoking client, taken from the
+// creator's MSP ID and the common name of its X.509 certificate
+// ===========================================================
+func getCaller(stub shim.ChaincodeStubInterface) (*identity, error) {
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := cid.GetX509Certificate(stub)
+	if err != nil {
+		return nil, err
+	}
+	if cert == nil || len(cert.Subject.CommonName) <= 0 {
+		return nil, fmt.Errorf("creator certificate has no common name")
+	}
+	return &identity{MSPID: mspID, Name: strings.ToLower(cert.Subject.CommonName)}, nil
+}
+
+// is reports whether the identity is the party with the given name and MSP ID.
+// Shards written before parties carried their MSP ID match no one.
+func (id *identity) is(name string, mspID string) bool {
+	return len(mspID) > 0 && id.MSPID == mspID && id.Name == name
+}
+
+// String returns the identity as MSPID:name, the form parseIdentity reads
+func (id *identity) String() string {
+	return id.MSPID + ":" + id.Name
+}
+
+// ===========================================================
+// parseIdentity reads a party given as MSPID:name, e.g. Org1MSP:peer11.org1.
+// The name is lower-cased like every stored Sender and Receiver.
+// ===========================================================
+func parseIdentity(arg string) (*identity, error) {
+	parts := strings.SplitN(arg, ":", 2)
+	if len(parts) != 2 || len(parts[0]) <= 0 || len(parts[1]) <= 0 {
+		return nil, fmt.Errorf("must be of the form MSPID:name, e.g. Org1MSP:peer11.org1")
+	}
+	return &identity{MSPID: parts[0], Name: strings.ToLower(parts[1])}, nil
+}
+
+
 // 3
 // ==================================================
-// delete - remove a shard key/value pair from state
+// deleteShard - remove a shard key/value pair, its index entries and PUF references from state,
+// leaving a tombstone that records who deleted it, when and why.
+// Only the shard's original Sender may delete it.
 // ==================================================
-func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+func (t *SimpleChaincode) deleteShard(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var jsonResp string
 	var shardJSON shard
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2(ShardId, Reason)")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
 	}
 	shardId := args[0]
+	reason := args[1]
+	fmt.Println("- start deleteShard ", shardId)
+
+	caller, err := getCaller(stub)
+	if err != nil {
+		return shim.Error("Failed to get caller identity: " + err.Error())
+	}
 
 	// to maintain the Sender~ShardId index, we need to read the shard first and get its Sender
 	valAsbytes, err := stub.GetState(shardId) //get the shard from chaincode state
@@ -252,38 +617,256 @@ func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string
 		return shim.Error(jsonResp)
 	}
 
-	err = json.Unmarshal([]byte(valAsbytes), &shardJSON)
+	decoded, err := decodeShard(valAsbytes)
 	if err != nil {
 		jsonResp = "{\"Error\":\"Failed to decode JSON of: " + shardId + "\"}"
 		return shim.Error(jsonResp)
 	}
+	shardJSON = *decoded
+
+	if !caller.is(shardJSON.Sender, shardJSON.SenderMSP) {
+		return shim.Error("Caller " + caller.String() + " is not the Sender of shard " + shardId)
+	}
 
 	err = stub.DelState(shardId) //remove the shard from chaincode state
 	if err != nil {
 		return shim.Error("Failed to delete state:" + err.Error())
 	}
+	err = releaseQuota(stub, 1)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	// maintain the index
-	indexName := "Sender~ShardId"
-	senderShardIdIndexKey, err := stub.CreateCompositeKey(indexName, []string{shardJSON.Sender, shardJSON.ShardId})
+	// maintain the indexes
+	err = updateShardIndexes(stub, &shardJSON, nil)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	//  Delete index entry to state.
-	err = stub.DelState(senderShardIdIndexKey)
+	// the file is incomplete again until the shard is added back
+	err = removeShardFromData(stub, shardJSON.DataId)
 	if err != nil {
-		return shim.Error("Failed to delete state:" + err.Error())
+		return shim.Error(err.Error())
+	}
+
+	// a shard added back under the same ShardId starts without references or passes
+	err = deletePUFRecords(stub, shardJSON.ShardId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ==== Leave a tombstone so the gap in the shard's history can be explained ====
+	deletedAt, err := getTxTimestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	deletedByMSP, deletedBySubject, err := getCallerSubject(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	tomb := &tombstone{
+		ObjectType:    "tombstone",
+		SchemaVersion: schemaVersions["tombstone"],
+		ShardId:       shardJSON.ShardId,
+		DataId:        shardJSON.DataId,
+		Sender:        shardJSON.Sender,
+		Receiver:      shardJSON.Receiver,
+		DeletedBy:        caller.Name,
+		DeletedByMSP:     deletedByMSP,
+		DeletedBySubject: deletedBySubject,
+		DeletedAt:        deletedAt,
+		Reason:        reason,
+		TxId:          stub.GetTxID(),
+	}
+	tombJSONasBytes, err := json.Marshal(tomb)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	tombstoneKey, err := stub.CreateCompositeKey(tombstoneIndexName, []string{shardJSON.ShardId})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(tombstoneKey, tombJSONasBytes)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
+
+	err = emitShardEvent(stub, eventShardDeleted, &shardJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end deleteShard (success)")
 	return shim.Success(nil)
 }
-*/
+
+
+// ===========================================================
+// readTombstone - read the tombstone left behind by deleteShard
+// ===========================================================
+func (t *SimpleChaincode) readTombstone(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var jsonResp string
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting shardid of the deleted shard")
+	}
+
+	shardId := args[0]
+	tombstoneKey, err := stub.CreateCompositeKey(tombstoneIndexName, []string{shardId})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	valAsbytes, err := stub.GetState(tombstoneKey)
+	if err != nil {
+		jsonResp = "{\"Error\":\"Failed to get tombstone for " + shardId + "\"}"
+		return shim.Error(jsonResp)
+	} else if valAsbytes == nil {
+		jsonResp = "{\"Error\":\"tombstone does not exist: " + shardId + "\"}"
+		return shim.Error(jsonResp)
+	}
+
+	return shim.Success(valAsbytes)
+}
+
+
+// ===========================================================
+// getTxTimestamp returns the transaction timestamp as an RFC 3339 string.
+// It is chosen by the client, so every endorser sees the same value.
+// ===========================================================
+func getTxTimestamp(stub shim.ChaincodeStubInterface) (string, error) {
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return "", fmt.Errorf("Failed to get transaction timestamp: %s", err.Error())
+	}
+	return time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC().Format(time.RFC3339), nil
+}
+
+
+// ===========================================================
+// emitShardEvent sets the transaction's chaincode event for a shard state change.
+// Fabric keeps a single event per transaction, so each function emits exactly one.
+// ===========================================================
+func emitShardEvent(stub shim.ChaincodeStubInterface, eventName string, s *shard) error {
+	event := &shardEvent{
+		ShardId:      s.ShardId,
+		DataId:       s.DataId,
+		Sender:       s.Sender,
+		Receiver:     s.Receiver,
+		TxId:         stub.GetTxID(),
+		PrevReceiver: s.PrevReceiver,
+		SuccessNum:   s.SuccessNum,
+		Threshold:    s.Threshold,
+		Status:       s.Status,
+	}
+	eventAsBytes, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent(eventName, eventAsBytes)
+}
+
+
+// ===========================================================
+// getShard loads and decodes a shard from chaincode state
+// ===========================================================
+func getShard(stub shim.ChaincodeStubInterface, shardId string) (*shard, error) {
+	shardAsBytes, err := stub.GetState(shardId)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get shard: %s", err.Error())
+	} else if shardAsBytes == nil {
+		return nil, fmt.Errorf("shard does not exist: %s", shardId)
+	}
+
+	return decodeShard(shardAsBytes)
+}
+
+
+// ===========================================================
+// shardIndexKeys returns the composite keys of every index entry kept for a shard
+// ===========================================================
+func shardIndexKeys(stub shim.ChaincodeStubInterface, s *shard) ([]string, error) {
+	senderShardIdIndexKey, err := stub.CreateCompositeKey(senderIndexName, []string{s.Sender, s.ShardId})
+	if err != nil {
+		return nil, err
+	}
+	receiverShardIdIndexKey, err := stub.CreateCompositeKey(receiverIndexName, []string{s.Receiver, s.ShardId})
+	if err != nil {
+		return nil, err
+	}
+	dataIdShardIdIndexKey, err := stub.CreateCompositeKey(dataIdIndexName, []string{s.DataId, s.ShardId})
+	if err != nil {
+		return nil, err
+	}
+	statusShardIdIndexKey, err := stub.CreateCompositeKey(statusIndexName, []string{s.Status, s.ShardId})
+	if err != nil {
+		return nil, err
+	}
+	return []string{senderShardIdIndexKey, receiverShardIdIndexKey, dataIdShardIdIndexKey, statusShardIdIndexKey}, nil
+}
+
+
+// ===========================================================
+// updateShardIndexes moves a shard's index entries from the old to the new version
+// of the shard: entries only the old version has are deleted and entries only the
+// new version has are written. Pass nil as old when adding and nil as new when deleting.
+// ===========================================================
+func updateShardIndexes(stub shim.ChaincodeStubInterface, old *shard, new *shard) error {
+	var oldKeys, newKeys []string
+	var err error
+	if old != nil {
+		oldKeys, err = shardIndexKeys(stub, old)
+		if err != nil {
+			return err
+		}
+	}
+	if new != nil {
+		newKeys, err = shardIndexKeys(stub, new)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, key := range oldKeys {
+		if containsString(newKeys, key) {
+			continue
+		}
+		//  Delete index entry to state.
+		err = stub.DelState(key)
+		if err != nil {
+			return fmt.Errorf("Failed to delete state:%s", err.Error())
+		}
+	}
+	//  Save index entries to state. Only the key name is needed, no need to store a duplicate copy of the shard.
+	//  Note - passing a 'nil' value will effectively delete the key from state, therefore we pass null character as value
+	value := []byte{0x00}
+	for _, key := range newKeys {
+		if containsString(oldKeys, key) {
+			continue
+		}
+		err = stub.PutState(key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
 
 
 
 // 4
 // ===============================================
-// readShard - read a shard from chaincode state
+// readShard - read a shard from chaincode state. Auditors, admins and the
+// Sender see any shard; its Receiver only once it can be released.
 // ===============================================
 func (t *SimpleChaincode) readShard(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var shardid, jsonResp string
@@ -303,7 +886,29 @@ func (t *SimpleChaincode) readShard(stub shim.ChaincodeStubInterface, args []str
 		return shim.Error(jsonResp)
 	}
 
-	return shim.Success(valAsbytes)
+	// ==== Hand out older shards upgraded to the current schema ====
+	shardJSON, err := decodeShard(valAsbytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ==== Only auditors, admins and the Sender may read a shard before its release ====
+	caller, err := getCallerRoles(stub)
+	if err != nil {
+		return shim.Error("Failed to get caller identity: " + err.Error())
+	}
+	if !containsString(caller.Roles, roleAuditor) && !containsString(caller.Roles, roleAdmin) &&
+		!caller.is(shardJSON.Sender, shardJSON.SenderMSP) {
+		err = checkShardForReceiver(&caller.identity, shardJSON)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	upgradedAsBytes, err := json.Marshal(shardJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(upgradedAsBytes)
 }
 
 
@@ -321,6 +926,7 @@ func (t *SimpleChaincode) readShard(stub shim.ChaincodeStubInterface, args []str
 // Therefore, rich queries should not be used in update transactions, unless the
 // application handles the possibility of result set changes between endorsement and commit time.
 // Rich queries can be used for point-in-time queries against a peer.
+// Every query function returns its results in the versioned queryResponse envelope.
 // ============================================================================================
 //
 // ===== Example: Parameterized rich query =================================================
@@ -335,15 +941,18 @@ func (t *SimpleChaincode) queryShardsBySender(stub shim.ChaincodeStubInterface,
 	//   0
 	// "peer01.Org1"
 	if len(args) < 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+		return queryError("Incorrect number of arguments. Expecting 1")
 	}
 
 	sender := strings.ToLower(args[0])
 
-	queryString := fmt.Sprintf("{\"selector\":{\"docType\":\"shard\",\"Sender\":\"%s\"}}", sender)
+	queryString, err := shardFieldQueryString("Sender", sender, "")
+	if err != nil {
+		return queryError(err.Error())
+	}
 	queryResults, err := getQueryResultForQueryString(stub, queryString)
 	if err != nil {
-		return shim.Error(err.Error())
+		return queryError(err.Error())
 	}
 	return shim.Success(queryResults)
 }
@@ -354,7 +963,8 @@ func (t *SimpleChaincode) queryShardsBySender(stub shim.ChaincodeStubInterface,
 // queryShards uses a query string to perform a query for shards.
 // Query string matching state database syntax is passed in and executed as is.
 // Supports ad hoc queries that can be defined at runtime by the client.
-// If this is not desired, follow the queryShardsForReceiver example for parameterized queries.
+// If this is not desired, use queryShardsStructured or the parameterized queries instead;
+// the operator can turn this entry point off with the rawQueries=false Init argument.
 // Only available on state databases that support rich query (e.g. CouchDB)
 // =========================================================================================
 // 6
@@ -363,18 +973,34 @@ func (t *SimpleChaincode) queryShards(stub shim.ChaincodeStubInterface, args []s
 	//   0
 	// "queryString"
 	if len(args) < 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+		return queryError("Incorrect number of arguments. Expecting 1")
+	}
+	if err := checkRawQueriesEnabled(stub); err != nil {
+		return queryError(err.Error())
 	}
 
 	queryString := args[0]
 
 	queryResults, err := getQueryResultForQueryString(stub, queryString)
 	if err != nil {
-		return shim.Error(err.Error())
+		return queryError(err.Error())
 	}
 	return shim.Success(queryResults)
 }
 // =========================================================================================
+// checkRawQueriesEnabled refuses client supplied selectors when the operator has disabled them
+// =========================================================================================
+func checkRawQueriesEnabled(stub shim.ChaincodeStubInterface) error {
+	config, err := getConfig(stub)
+	if err != nil {
+		return err
+	}
+	if !config.RawQueriesEnabled {
+		return fmt.Errorf("raw queries are disabled on this channel, use queryShardsStructured")
+	}
+	return nil
+}
+// =========================================================================================
 // getQueryResultForQueryString executes the passed in query string.
 // Result set is built and returned as a byte array containing the JSON results.
 // =========================================================================================
@@ -388,35 +1014,17 @@ func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString
 	}
 	defer resultsIterator.Close()
 
-	// buffer is a JSON array containing QueryRecords
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
-
-	bArrayMemberAlreadyWritten := false
-	for resultsIterator.HasNext() {
-		queryResponse, err := resultsIterator.Next()
-		if err != nil {
-			return nil, err
-		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",\n")
-		}
-		buffer.WriteString("\n{\"Key\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(queryResponse.Key)
-		buffer.WriteString("\"")
-
-		buffer.WriteString(",\n \"Record\":")
-		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResponse.Value))
-		buffer.WriteString("\n}")
-		bArrayMemberAlreadyWritten = true
+	records, err := constructQueryResponseFromIterator(resultsIterator)
+	if err != nil {
+		return nil, err
+	}
+	queryResults, err := newQueryResponse(records, nil)
+	if err != nil {
+		return nil, err
 	}
-	buffer.WriteString("]\n")
-	fmt.Printf("- getQueryResultForQueryString queryResult:\n%s\n", buffer.String())
+	fmt.Printf("- getQueryResultForQueryString queryResult:\n%s\n", string(queryResults))
 
-	return buffer.Bytes(), nil
+	return queryResults, nil
 }
 
 
@@ -425,7 +1033,7 @@ func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString
 func (t *SimpleChaincode) getHistoryForShard(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
 	if len(args) < 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+		return queryError("Incorrect number of arguments. Expecting 1")
 	}
 
 	shardId := args[0]
@@ -434,49 +1042,21 @@ func (t *SimpleChaincode) getHistoryForShard(stub shim.ChaincodeStubInterface, a
 
 	resultsIterator, err := stub.GetHistoryForKey(shardId)
 	if err != nil {
-		return shim.Error(err.Error())
+		return queryError(err.Error())
 	}
 	defer resultsIterator.Close()
 
-	// buffer is a JSON array containing historic values for the shard
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
-
-	bArrayMemberAlreadyWritten := false
-	for resultsIterator.HasNext() {
-		response, err := resultsIterator.Next()
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",\n")
-		}
-		buffer.WriteString("\n{\"TxId\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(response.TxId)
-		buffer.WriteString("\"")
-
-		buffer.WriteString(",\n \"Value\":")
-		// if it was a delete operation on given key, then we need to set the
-		//corresponding value null. Else, we will write the response.Value
-		//as-is (as the Value itself a JSON shard)
-		if response.IsDelete {
-			buffer.WriteString("null")
-		} else {
-			buffer.WriteString(string(response.Value))
-		}
-
-		buffer.WriteString(",\n \"Timestamp\":")
-		buffer.WriteString(time.Unix(response.Timestamp.Seconds, int64(response.Timestamp.Nanos)).String())
-		buffer.WriteString("\"")
-		buffer.WriteString("\n}")
-		bArrayMemberAlreadyWritten = true
+	records, err := constructHistoryFromIterator(resultsIterator)
+	if err != nil {
+		return queryError(err.Error())
+	}
+	historyResults, err := newQueryResponse(records, nil)
+	if err != nil {
+		return queryError(err.Error())
 	}
-	buffer.WriteString("]\n")
-	fmt.Printf("- getHistoryForShard returning:\n%s\n", buffer.String())
+	fmt.Printf("- getHistoryForShard returning:\n%s\n", string(historyResults))
 
-	return shim.Success(buffer.Bytes())
+	return shim.Success(historyResults)
 }
 
 
@@ -496,7 +1076,7 @@ func (t *SimpleChaincode) getHistoryForShard(stub shim.ChaincodeStubInterface, a
 func (t *SimpleChaincode) getShardsByRange(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
 	if len(args) < 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+		return queryError("Incorrect number of arguments. Expecting 2")
 	}
 
 	startKey := args[0]
@@ -504,39 +1084,164 @@ func (t *SimpleChaincode) getShardsByRange(stub shim.ChaincodeStubInterface, arg
 
 	resultsIterator, err := stub.GetStateByRange(startKey, endKey)
 	if err != nil {
-		return shim.Error(err.Error())
+		return queryError(err.Error())
 	}
 	defer resultsIterator.Close()
 
-	// buffer is a JSON array containing QueryResults
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
+	records, err := constructQueryResponseFromIterator(resultsIterator)
+	if err != nil {
+		return queryError(err.Error())
+	}
+	queryResults, err := newQueryResponse(records, nil)
+	if err != nil {
+		return queryError(err.Error())
+	}
+
+	fmt.Printf("- getShardsByRange queryResult:\n%s\n", string(queryResults))
 
-	bArrayMemberAlreadyWritten := false
-	for resultsIterator.HasNext() {
-		queryResponse, err := resultsIterator.Next()
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",\n")
-		}
-		buffer.WriteString("\n{\"Key\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(queryResponse.Key)
-		buffer.WriteString("\"")
+	return shim.Success(queryResults)
+}
+
+
+
+// =======Paginated queries ===================================================================
+// The paginated variants below return at most pageSize records per call together with a
+// bookmark; passing the bookmark back returns the next page. The page size is capped at
+// maxPageSize so a single call can never build an unbounded response on the peer.
+// Paginated queries are only valid for read-only transactions.
+// ===========================================================================================
+// 9
+func (t *SimpleChaincode) queryShardsWithPagination(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0              1           2
+	// "queryString", "pageSize", "bookmark"
+	if len(args) != 3 {
+		return queryError("Incorrect number of arguments. Expecting 3(queryString, pageSize, bookmark)")
+	}
+	if err := checkRawQueriesEnabled(stub); err != nil {
+		return queryError(err.Error())
+	}
+
+	queryString := args[0]
+	pageSize, err := parsePageSize(args[1])
+	if err != nil {
+		return queryError(err.Error())
+	}
+	bookmark := args[2]
+
+	queryResults, err := getQueryResultForQueryStringWithPagination(stub, queryString, pageSize, bookmark)
+	if err != nil {
+		return queryError(err.Error())
+	}
+	return shim.Success(queryResults)
+}
+
+
+// 10
+func (t *SimpleChaincode) queryShardsBySenderWithPagination(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0             1           2
+	// "peer01.Org1", "pageSize", "bookmark"
+	if len(args) != 3 {
+		return queryError("Incorrect number of arguments. Expecting 3(Sender, pageSize, bookmark)")
+	}
+
+	sender := strings.ToLower(args[0])
+	pageSize, err := parsePageSize(args[1])
+	if err != nil {
+		return queryError(err.Error())
+	}
+	bookmark := args[2]
+
+	queryString, err := shardFieldQueryString("Sender", sender, "")
+	if err != nil {
+		return queryError(err.Error())
+	}
+	queryResults, err := getQueryResultForQueryStringWithPagination(stub, queryString, pageSize, bookmark)
+	if err != nil {
+		return queryError(err.Error())
+	}
+	return shim.Success(queryResults)
+}
+
+
+// 11
+func (t *SimpleChaincode) getShardsByRangeWithPagination(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0          1         2           3
+	// "startKey", "endKey", "pageSize", "bookmark"
+	if len(args) != 4 {
+		return queryError("Incorrect number of arguments. Expecting 4(startKey, endKey, pageSize, bookmark)")
+	}
+
+	startKey := args[0]
+	endKey := args[1]
+	pageSize, err := parsePageSize(args[2])
+	if err != nil {
+		return queryError(err.Error())
+	}
+	bookmark := args[3]
+
+	resultsIterator, responseMetadata, err := stub.GetStateByRangeWithPagination(startKey, endKey, pageSize, bookmark)
+	if err != nil {
+		return queryError(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	records, err := constructQueryResponseFromIterator(resultsIterator)
+	if err != nil {
+		return queryError(err.Error())
+	}
+	queryResults, err := newQueryResponse(records, responseMetadata)
+	if err != nil {
+		return queryError(err.Error())
+	}
+
+	fmt.Printf("- getShardsByRangeWithPagination queryResult:\n%s\n", string(queryResults))
 
-		buffer.WriteString(",\n \"Record\":")
-		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResponse.Value))
-		buffer.WriteString("\n}")
-		bArrayMemberAlreadyWritten = true
+	return shim.Success(queryResults)
+}
+
+
+// =========================================================================================
+// getQueryResultForQueryStringWithPagination executes the passed in query string with
+// pagination info. Result set is built and returned as a byte array containing the JSON results.
+// =========================================================================================
+func getQueryResultForQueryStringWithPagination(stub shim.ChaincodeStubInterface, queryString string, pageSize int32, bookmark string) ([]byte, error) {
+
+	fmt.Printf("- getQueryResultForQueryStringWithPagination queryString:\n%s\n", queryString)
+
+	resultsIterator, responseMetadata, err := stub.GetQueryResultWithPagination(queryString, pageSize, bookmark)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	records, err := constructQueryResponseFromIterator(resultsIterator)
+	if err != nil {
+		return nil, err
+	}
+	queryResults, err := newQueryResponse(records, responseMetadata)
+	if err != nil {
+		return nil, err
 	}
-	buffer.WriteString("]\n")
 
-	fmt.Printf("- getShardsByRange queryResult:\n%s\n", buffer.String())
+	fmt.Printf("- getQueryResultForQueryStringWithPagination queryResult:\n%s\n", string(queryResults))
 
-	return shim.Success(buffer.Bytes())
+	return queryResults, nil
 }
 
+
+// =========================================================================================
+// parsePageSize parses a client supplied page size and clamps it to maxPageSize
+// =========================================================================================
+func parsePageSize(arg string) (int32, error) {
+	pageSize, err := strconv.ParseInt(arg, 10, 32)
+	if err != nil || pageSize <= 0 {
+		return 0, fmt.Errorf("pageSize must be a positive numeric string")
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+	return int32(pageSize), nil
+}
@@ -0,0 +1,2106 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	testShardId  = "shard-0"
+	testDataId   = "data-0"
+	testSender   = "peer01.org1"
+	testReceiver = "peer11.org1"
+
+	// Receivers as addShard and transferShard take them, MSPID:name
+	testReceiverId = "Org1MSP:peer11.org1"
+	testOtherId    = "Org2MSP:peer02.org2"
+)
+
+// identities used throughout the tests, named after the peers in crypto-config.yaml
+type testIdentities struct {
+	sender   []byte
+	receiver []byte
+	other    []byte
+}
+
+func newTestIdentities(t *testing.T) *testIdentities {
+	return &testIdentities{
+		sender:   newIdentity(t, "Org1MSP", "peer01.org1", map[string]string{roleAttribute: roleUploader}),
+		receiver: newIdentity(t, "Org1MSP", "peer11.org1", map[string]string{roleAttribute: "receiver,verifier"}),
+		other:    newIdentity(t, "Org2MSP", "peer02.org2", map[string]string{roleAttribute: "uploader,receiver,verifier,auditor"}),
+	}
+}
+
+func checkOK(t *testing.T, res pb.Response) {
+	t.Helper()
+	if res.Status != shim.OK {
+		t.Fatalf("expected success, got %d: %s", res.Status, res.Message)
+	}
+}
+
+func checkError(t *testing.T, res pb.Response, contains string) {
+	t.Helper()
+	if res.Status == shim.OK {
+		t.Fatalf("expected an error containing %q, got success", contains)
+	}
+	message := res.Message
+	envelope := &queryResponse{}
+	if err := json.Unmarshal([]byte(message), envelope); err == nil && envelope.Error != "" {
+		message = envelope.Error
+	}
+	if !strings.Contains(message, contains) {
+		t.Fatalf("expected an error containing %q, got %q", contains, res.Message)
+	}
+}
+
+// testChallenge is the hash of a fresh challenge for one PUF of one shard
+func testChallenge(shardId string, pufId string) string {
+	digest := sha256.Sum256([]byte(shardId + "/" + pufId))
+	return hex.EncodeToString(digest[:])
+}
+
+// enrollTestPUF enrolls a hex reference to testChallenge
+func enrollTestPUF(t *testing.T, stub *testStub, creator []byte, shardId string, pufId string, kind string, reference string, maxDistance string) pb.Response {
+	t.Helper()
+	return enrollTestPUFTo(t, stub, creator, shardId, pufId, testChallenge(shardId, pufId), kind, reference, maxDistance)
+}
+
+// enrollTestPUFTo enrolls a hex reference to the given challenge, passing it in
+// the transient map
+func enrollTestPUFTo(t *testing.T, stub *testStub, creator []byte, shardId string, pufId string, challengeHash string, kind string, reference string, maxDistance string) pb.Response {
+	t.Helper()
+	referenceAsBytes, err := hex.DecodeString(reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stub.invokeWithTransient(creator, map[string][]byte{pufReferenceTransientKey: referenceAsBytes}, "enrollPUFReference", shardId, pufId, kind, challengeHash, maxDistance)
+}
+
+// verifyTestPUF submits a hex response to the given challenge, passing it in the
+// transient map
+func verifyTestPUF(t *testing.T, stub *testStub, creator []byte, shardId string, pufId string, response string, challengeHash string) pb.Response {
+	t.Helper()
+	responseAsBytes, err := hex.DecodeString(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stub.invokeWithTransient(creator, map[string][]byte{pufResponseTransientKey: responseAsBytes}, "verifyPUFResponse", shardId, pufId, challengeHash)
+}
+
+func registerTestData(t *testing.T, stub *testStub, ids *testIdentities, dataId string, shardIds ...string) {
+	t.Helper()
+	shardIdsAsBytes, err := json.Marshal(shardIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkOK(t, stub.invoke(ids.sender, "registerData", dataId, strconv.Itoa(len(shardIds)), string(shardIdsAsBytes), "4096"))
+}
+
+func addTestShard(t *testing.T, stub *testStub, ids *testIdentities, shardId string, dataId string, receiver string) {
+	t.Helper()
+	checkOK(t, stub.invoke(ids.sender, "addShard", testSender, shardId, dataId, receiver, "2", "3", "0"))
+}
+
+func getTestShard(t *testing.T, stub *testStub, shardId string) *shard {
+	t.Helper()
+	shardAsBytes := stub.State[shardId]
+	if shardAsBytes == nil {
+		t.Fatalf("shard %s is not in state", shardId)
+	}
+	s := &shard{}
+	if err := json.Unmarshal(shardAsBytes, s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func hasIndexEntry(t *testing.T, stub *testStub, indexName string, attributes ...string) bool {
+	t.Helper()
+	return stub.State[mustCompositeKey(t, stub, indexName, attributes...)] != nil
+}
+
+func mustCompositeKey(t *testing.T, stub *testStub, objectType string, attributes ...string) string {
+	t.Helper()
+	key, err := stub.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// decodeQueryResponse checks the versioned envelope and decodes its items
+func decodeQueryResponse(t *testing.T, res pb.Response, items interface{}) *queryResponse {
+	t.Helper()
+	checkOK(t, res)
+	response := &queryResponse{Items: items}
+	if err := json.Unmarshal(res.Payload, response); err != nil {
+		t.Fatalf("query response is not valid JSON: %s\n%s", err, res.Payload)
+	}
+	if response.APIVersion != queryAPIVersion {
+		t.Fatalf("expected apiVersion %s, got %q", queryAPIVersion, response.APIVersion)
+	}
+	return response
+}
+
+func queryKeys(t *testing.T, res pb.Response) ([]string, *queryResponse) {
+	t.Helper()
+	records := []queryRecord{}
+	response := decodeQueryResponse(t, res, &records)
+	keys := []string{}
+	for _, record := range records {
+		keys = append(keys, record.Key)
+	}
+	return keys, response
+}
+
+func checkKeys(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected keys %v, got %v", want, got)
+	}
+}
+
+func checkEvent(t *testing.T, stub *testStub, name string, shardId string) *shardEvent {
+	t.Helper()
+	event := stub.lastEvent()
+	if event == nil || event.EventName != name {
+		t.Fatalf("expected event %s, got %+v", name, event)
+	}
+	payload := &shardEvent{}
+	if err := json.Unmarshal(event.Payload, payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.ShardId != shardId || payload.TxId != event.TxId {
+		t.Fatalf("unexpected %s payload %+v", name, payload)
+	}
+	return payload
+}
+
+func TestInit(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+
+	checkOK(t, stub.init(ids.sender))
+	config, err := getConfig(stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.RawQueriesEnabled {
+		t.Fatal("raw queries should be enabled by default")
+	}
+
+	checkOK(t, stub.init(ids.sender, "rawQueries=false"))
+	config, err = getConfig(stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.RawQueriesEnabled {
+		t.Fatal("rawQueries=false should disable raw queries")
+	}
+
+	checkError(t, stub.init(ids.sender, "rawQueries"), "key=value")
+	checkError(t, stub.init(ids.sender, "rawQueries=maybe"), "rawQueries must be true or false")
+	checkError(t, stub.init(ids.sender, "colour=blue"), "unknown Init argument")
+}
+
+func TestInvokeUnknownFunction(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+
+	checkError(t, stub.invoke(ids.sender, "delete", testShardId), "Received unknown function invocation")
+}
+
+func TestAccessControl(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+	plain := newIdentity(t, "Org2MSP", "peer12.org2", nil)
+	admin := newIdentity(t, "Org1MSP", "admin.org1", map[string]string{roleAttribute: strings.Join(knownRoles, ",")})
+
+	// every function with roles must be dispatched by Invoke
+	for function := range functionRoles {
+		res := stub.invoke(admin, function)
+		if strings.Contains(res.Message, "unknown function") {
+			t.Fatalf("%s has roles but Invoke does not dispatch it", function)
+		}
+	}
+
+	res := stub.invoke(plain, "readShard", testShardId)
+	if res.Status != statusForbidden {
+		t.Fatalf("expected status %d, got %d: %s", statusForbidden, res.Status, res.Message)
+	}
+	checkError(t, res, "access denied: readShard requires one of the roles")
+	checkError(t, stub.invoke(ids.receiver, "addShard", testReceiver, "shard-a", testDataId, testReceiverId, "2", "3", "0"), "access denied")
+	checkError(t, stub.invoke(ids.sender, "queryShards", `{"selector":{}}`), "access denied")
+
+	res = stub.invoke(plain, "getFunctionRoles")
+	checkOK(t, res)
+	listed := map[string][]string{}
+	if err := json.Unmarshal(res.Payload, &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != len(functionRoles) || strings.Join(listed["addShard"], ",") != roleUploader {
+		t.Fatalf("unexpected function roles %v", listed)
+	}
+	res = stub.invoke(plain, "getFunctionRoles", "releaseShard")
+	checkOK(t, res)
+	if string(res.Payload) != `{"releaseShard":["receiver"]}` {
+		t.Fatalf("unexpected roles for releaseShard %s", res.Payload)
+	}
+	checkError(t, stub.invoke(plain, "getFunctionRoles", "delete"), "is not defined")
+
+	callerRolesOf := func(creator []byte) *callerRoles {
+		res := stub.invoke(creator, "getCallerRoles")
+		checkOK(t, res)
+		caller := &callerRoles{}
+		if err := json.Unmarshal(res.Payload, caller); err != nil {
+			t.Fatal(err)
+		}
+		return caller
+	}
+	if caller := callerRolesOf(plain); len(caller.Roles) != 0 || caller.MSPID != "Org2MSP" || caller.Name != "peer12.org2" {
+		t.Fatalf("unexpected caller roles %+v", caller)
+	}
+
+	// roles granted to an MSP apply to every identity of that MSP
+	checkOK(t, stub.init(ids.sender, "roles=Org2MSP:auditor|receiver"))
+	if caller := callerRolesOf(plain); strings.Join(caller.Roles, ",") != "auditor,receiver" {
+		t.Fatalf("expected the MSP roles, got %+v", caller)
+	}
+	if caller := callerRolesOf(ids.other); strings.Join(caller.Roles, ",") != "auditor,receiver,uploader,verifier" {
+		t.Fatalf("expected attribute and MSP roles merged, got %+v", caller)
+	}
+	checkError(t, stub.invoke(plain, "readShard", testShardId), "shard does not exist")
+	checkOK(t, stub.init(ids.sender, "roles=Org2MSP:"))
+	checkError(t, stub.invoke(plain, "readShard", testShardId), "access denied")
+
+	checkError(t, stub.init(ids.sender, "roles=auditor"), "MSPID:role")
+	checkError(t, stub.init(ids.sender, "roles=Org2MSP:owner"), "unknown role")
+}
+
+func TestAddShard(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+
+	registerTestData(t, stub, ids, testDataId, testShardId)
+	checkOK(t, stub.invoke(ids.sender, "addShard", "Peer01.Org1", testShardId, "DATA-0", "Org1MSP:Peer11.Org1", "2", "3", "0"))
+
+	s := getTestShard(t, stub, testShardId)
+	if s.ObjectType != "shard" || s.Sender != testSender || s.DataId != testDataId || s.Receiver != testReceiver {
+		t.Fatalf("unexpected shard %+v", s)
+	}
+	if s.SenderMSP != "Org1MSP" || s.ReceiverMSP != "Org1MSP" {
+		t.Fatalf("unexpected shard MSPs %+v", s)
+	}
+	if s.Threshold != 2 || s.PUFNum != 3 || s.SuccessNum != 0 {
+		t.Fatalf("unexpected counters %+v", s)
+	}
+
+	if !hasIndexEntry(t, stub, senderIndexName, testSender, testShardId) {
+		t.Fatal("Sender~ShardId index entry missing")
+	}
+	if !hasIndexEntry(t, stub, receiverIndexName, testReceiver, testShardId) {
+		t.Fatal("Receiver~ShardId index entry missing")
+	}
+	if !hasIndexEntry(t, stub, dataIdIndexName, testDataId, testShardId) {
+		t.Fatal("DataId~ShardId index entry missing")
+	}
+
+	event := checkEvent(t, stub, eventShardAdded, testShardId)
+	if event.DataId != testDataId || event.Sender != testSender || event.Receiver != testReceiver {
+		t.Fatalf("unexpected event payload %+v", event)
+	}
+
+	checkError(t, stub.invoke(ids.sender, "addShard", testSender, testShardId, testDataId, testReceiverId, "2", "3", "0"), "This shard already exists")
+}
+
+func TestAddShards(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+	registerTestData(t, stub, ids, "data-a", "shard-a0", "shard-a1")
+	registerTestData(t, stub, ids, "data-b", "shard-b0", "shard-b1")
+
+	batch := func(entries ...shardEntry) string {
+		entriesAsBytes, err := json.Marshal(entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(entriesAsBytes)
+	}
+	entry := func(shardId string, dataId string) shardEntry {
+		return shardEntry{Sender: "PEER01.org1", ShardId: shardId, DataId: dataId, Receiver: testReceiverId, Threshold: 2, PUFNum: 3}
+	}
+
+	// a single bad entry leaves the ledger untouched
+	for _, bad := range []struct {
+		entries []shardEntry
+		message string
+	}{
+		{[]shardEntry{entry("shard-a0", "data-a"), {Sender: testSender, ShardId: "shard-a1", DataId: "data-a", Receiver: testReceiverId, Threshold: 4, PUFNum: 3}}, "shard 1: Threshold must be between 1 and PUFNum"},
+		{[]shardEntry{entry("shard-a0", "data-a"), entry("shard-a0", "data-a")}, "shard 1: ShardId shard-a0 appears more than once"},
+		{[]shardEntry{entry("shard-a0", "data-a"), entry("shard-x", "data-a")}, "shard 1: shard shard-x is not one of the ShardIds of data data-a"},
+		{[]shardEntry{entry("shard-a0", "data-a"), entry("shard-c0", "data-c")}, "shard 1: data does not exist: data-c"},
+		{[]shardEntry{entry("shard-a0", "data-a"), {ShardId: "shard-a1", DataId: "data-a", Receiver: testReceiverId, Threshold: 2, PUFNum: 3}}, "shard 1: Sender must be a non-empty string"},
+		{[]shardEntry{{Sender: testSender, ShardId: "shard-a0", DataId: "data-a", Receiver: testReceiverId, Threshold: 2, PUFNum: 3, SuccessNum: 1}}, "shard 0: SuccessNum must be 0"},
+	} {
+		checkError(t, stub.invoke(ids.sender, "addShards", batch(bad.entries...)), bad.message)
+		if stub.State["shard-a0"] != nil {
+			t.Fatalf("%q: shard-a0 was written by a failed batch", bad.message)
+		}
+	}
+	checkError(t, stub.invoke(ids.sender, "addShards"), "Expecting 1")
+	checkError(t, stub.invoke(ids.sender, "addShards", "{}"), "must be a JSON array")
+	checkError(t, stub.invoke(ids.sender, "addShards", "[]"), "at least one shard")
+	tooMany := make([]shardEntry, maxBatchSize+1)
+	checkError(t, stub.invoke(ids.sender, "addShards", batch(tooMany...)), "at most 100 shards")
+	checkError(t, stub.invoke(ids.receiver, "addShards", batch(entry("shard-a0", "data-a"))), "access denied")
+	checkError(t, stub.invoke(ids.other, "addShards", batch(entry("shard-a0", "data-a"))), "shard 0: Caller Org2MSP:peer02.org2 is not the Sender peer01.org1")
+
+	checkOK(t, stub.invoke(ids.sender, "addShards", batch(entry("shard-a0", "data-a"), entry("shard-b0", "data-b"), entry("shard-a1", "data-a"))))
+	for _, shardId := range []string{"shard-a0", "shard-a1", "shard-b0"} {
+		s := getTestShard(t, stub, shardId)
+		if s.Sender != testSender || s.Status != statusCreated || s.SchemaVersion != schemaVersions["shard"] {
+			t.Fatalf("unexpected shard %+v", s)
+		}
+		if !hasIndexEntry(t, stub, senderIndexName, testSender, shardId) || !hasIndexEntry(t, stub, statusIndexName, statusCreated, shardId) {
+			t.Fatalf("missing index entries for %s", shardId)
+		}
+	}
+	for dataId, complete := range map[string]bool{"data-a": true, "data-b": false} {
+		d, err := getData(stub, dataId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Complete != complete {
+			t.Fatalf("expected %s complete=%v, got %+v", dataId, complete, d)
+		}
+	}
+
+	event := stub.lastEvent()
+	if event == nil || event.EventName != eventShardsAdded {
+		t.Fatalf("expected event %s, got %+v", eventShardsAdded, event)
+	}
+	payload := &shardEvent{}
+	if err := json.Unmarshal(event.Payload, payload); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(payload.ShardIds, ",") != "shard-a0,shard-b0,shard-a1" || payload.TxId != event.TxId {
+		t.Fatalf("unexpected %s payload %+v", eventShardsAdded, payload)
+	}
+	if len(payload.Shards) != 3 || payload.Shards[1] != (shardSummary{ShardId: "shard-b0", DataId: "data-b", Sender: testSender, Receiver: testReceiver}) {
+		t.Fatalf("unexpected %s shards %+v", eventShardsAdded, payload.Shards)
+	}
+
+	checkError(t, stub.invoke(ids.sender, "addShards", batch(entry("shard-b1", "data-b"), entry("shard-b0", "data-b"))), "shard 1: This shard already exists: shard-b0")
+	if stub.State["shard-b1"] != nil {
+		t.Fatal("shard-b1 was written by a failed batch")
+	}
+}
+
+func TestAddShardArgumentErrors(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+
+	tests := []struct {
+		args     []string
+		contains string
+	}{
+		{[]string{testSender, testShardId, testDataId, testReceiverId, "2", "3"}, "Expecting 7"},
+		{[]string{"", testShardId, testDataId, testReceiver, "2", "3", "0"}, "1st argument must be a non-empty string"},
+		{[]string{testSender, "", testDataId, testReceiverId, "2", "3", "0"}, "2nd argument must be a non-empty string"},
+		{[]string{testSender, testShardId, "", testReceiverId, "2", "3", "0"}, "3rd argument must be a non-empty string"},
+		{[]string{testSender, testShardId, testDataId, "", "2", "3", "0"}, "4st argument must be a non-empty string"},
+		{[]string{testSender, testShardId, testDataId, testReceiverId, "", "3", "0"}, "5nd argument must be a non-empty string"},
+		{[]string{testSender, testShardId, testDataId, testReceiverId, "2", "", "0"}, "6rd argument must be a non-empty string"},
+		{[]string{testSender, testShardId, testDataId, testReceiverId, "2", "3", ""}, "7rd argument must be a non-empty string"},
+		{[]string{testSender, testShardId, testDataId, testReceiverId, "two", "3", "0"}, "5rd argument must be a numeric string"},
+		{[]string{testSender, testShardId, testDataId, testReceiverId, "2", "three", "0"}, "6rd argument must be a numeric string"},
+		{[]string{testSender, testShardId, testDataId, testReceiverId, "2", "3", "zero"}, "7rd argument must be a numeric string"},
+		{[]string{testSender, testShardId, testDataId, testReceiverId, "2", "0", "0"}, "PUFNum must be a positive number"},
+		{[]string{testSender, testShardId, testDataId, testReceiverId, "0", "3", "0"}, "Threshold must be between 1 and PUFNum"},
+		{[]string{testSender, testShardId, testDataId, testReceiverId, "4", "3", "0"}, "Threshold must be between 1 and PUFNum"},
+		{[]string{testSender, testShardId, testDataId, testReceiverId, "2", "3", "1"}, "SuccessNum must be 0"},
+		{[]string{testSender, testShardId, testDataId, testReceiver, "2", "3", "0"}, "Receiver must be of the form MSPID:name"},
+	}
+	for _, test := range tests {
+		checkError(t, stub.invoke(ids.sender, "addShard", test.args...), test.contains)
+	}
+	if stub.State[testShardId] != nil {
+		t.Fatal("a rejected addShard must not write the shard")
+	}
+}
+
+func TestData(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+
+	checkError(t, stub.invoke(ids.sender, "addShard", testSender, "shard-a", testDataId, testReceiverId, "2", "3", "0"), "data does not exist")
+
+	registerTestData(t, stub, ids, "DATA-0", "shard-b", "shard-a")
+	checkError(t, stub.invoke(ids.sender, "registerData", testDataId, "1", `["shard-z"]`, "10"), "This data already exists")
+
+	checkError(t, stub.invoke(ids.sender, "addShard", testSender, "shard-z", testDataId, testReceiverId, "2", "3", "0"), "is not one of the ShardIds")
+	checkError(t, stub.invoke(ids.other, "addShard", "peer02.org2", "shard-a", testDataId, testReceiverId, "2", "3", "0"), "does not own data")
+	// naming the owner as Sender does not make the caller its Sender
+	checkError(t, stub.invoke(ids.other, "addShard", testSender, "shard-a", testDataId, testReceiverId, "2", "3", "0"), "Caller Org2MSP:peer02.org2 is not the Sender peer01.org1")
+	impostor := newIdentity(t, "Org2MSP", "peer01.org1", map[string]string{roleAttribute: roleUploader})
+	checkError(t, stub.invoke(impostor, "addShard", testSender, "shard-a", testDataId, testReceiverId, "2", "3", "0"), "does not own data")
+	addTestShard(t, stub, ids, "shard-a", testDataId, testReceiverId)
+	addTestShard(t, stub, ids, "shard-b", testDataId, testReceiverId)
+
+	res := stub.invoke(ids.other, "getData", testDataId)
+	checkOK(t, res)
+	d := &data{}
+	if err := json.Unmarshal(res.Payload, d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Owner != testSender || d.ShardCount != 2 || d.TotalSize != 4096 || d.ShardsAdded != 2 || !d.Complete {
+		t.Fatalf("unexpected data %+v", d)
+	}
+
+	keys, _ := queryKeys(t, stub.invoke(ids.other, "getShardsForData", testDataId))
+	checkKeys(t, keys, "shard-b", "shard-a")
+
+	// deleting a shard makes the file incomplete until it is added back
+	checkOK(t, stub.invoke(ids.sender, "deleteShard", "shard-a", "corrupt"))
+	records := []queryRecord{}
+	decodeQueryResponse(t, stub.invoke(ids.other, "getShardsForData", testDataId), &records)
+	if len(records) != 2 || string(records[1].Record) != "null" {
+		t.Fatalf("expected a null record for the deleted shard, got %+v", records)
+	}
+	addTestShard(t, stub, ids, "shard-a", testDataId, testReceiverId)
+	checkError(t, stub.invoke(ids.sender, "addShard", testSender, "shard-c", testDataId, testReceiverId, "2", "3", "0"), "already complete")
+
+	tests := []struct {
+		args     []string
+		contains string
+	}{
+		{[]string{"data-1", "1", `["s"]`}, "Expecting 4"},
+		{[]string{"", "1", `["s"]`, "10"}, "1st argument must be a non-empty string"},
+		{[]string{"data-1", "0", `[]`, "10"}, "2nd argument must be a positive numeric string"},
+		{[]string{"data-1", "1", `s`, "10"}, "3rd argument must be a JSON array"},
+		{[]string{"data-1", "2", `["s"]`, "10"}, "exactly ShardCount=2"},
+		{[]string{"data-1", "1", `[""]`, "10"}, "must be non-empty strings"},
+		{[]string{"data-1", "2", `["s","s"]`, "10"}, "listed twice"},
+		{[]string{"data-1", "1", `["s"]`, "-1"}, "4th argument must be a non-negative"},
+	}
+	for _, test := range tests {
+		checkError(t, stub.invoke(ids.sender, "registerData", test.args...), test.contains)
+	}
+	checkError(t, stub.invoke(ids.other, "getData"), "Expecting DataId")
+	checkError(t, stub.invoke(ids.other, "getData", "missing"), "data does not exist")
+	checkError(t, stub.invoke(ids.other, "getShardsForData"), "Expecting 1")
+	checkError(t, stub.invoke(ids.other, "getShardsForData", "missing"), "data does not exist")
+}
+
+func TestReadShard(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+	registerTestData(t, stub, ids, testDataId, testShardId)
+	addTestShard(t, stub, ids, testShardId, testDataId, testReceiverId)
+
+	res := stub.invoke(ids.other, "readShard", testShardId)
+	checkOK(t, res)
+	s := &shard{}
+	if err := json.Unmarshal(res.Payload, s); err != nil {
+		t.Fatal(err)
+	}
+	if s.ShardId != testShardId {
+		t.Fatalf("read the wrong shard %+v", s)
+	}
+
+	checkError(t, stub.invoke(ids.other, "readShard"), "Incorrect number of arguments")
+	checkError(t, stub.invoke(ids.other, "readShard", "missing"), "shard does not exist: missing")
+
+	// the Sender reads its shard, the Receiver only once it can be released
+	checkOK(t, stub.invoke(ids.sender, "readShard", testShardId))
+	checkError(t, stub.invoke(ids.receiver, "readShard", testShardId), "is pending verification")
+	stranger := newIdentity(t, "Org2MSP", "peer12.org2", map[string]string{roleAttribute: roleReceiver})
+	checkError(t, stub.invoke(stranger, "readShard", testShardId), "is not the Receiver")
+	checkError(t, stub.invoke(ids.receiver, "getShardsByReceiver", testReceiver), "access denied")
+	for _, pufId := range []string{"puf-1", "puf-2"} {
+		checkOK(t, enrollTestPUF(t, stub, ids.sender, testShardId, pufId, "commitment", "ff", "0"))
+		checkOK(t, verifyTestPUF(t, stub, ids.receiver, testShardId, pufId, "ff", testChallenge(testShardId, pufId)))
+	}
+	checkOK(t, stub.invoke(ids.receiver, "readShard", testShardId))
+	checkError(t, stub.invoke(stranger, "readShard", testShardId), "is not the Receiver")
+}
+
+func TestTransferShard(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+	registerTestData(t, stub, ids, testDataId, testShardId)
+	addTestShard(t, stub, ids, testShardId, testDataId, testReceiverId)
+
+	// a certificate with the Receiver's name from another org's CA is not the Receiver
+	impersonator := newIdentity(t, "Org2MSP", "peer11.org1", map[string]string{roleAttribute: roleReceiver})
+	checkError(t, stub.invoke(impersonator, "transferShard", testShardId, testOtherId), "Caller Org2MSP:peer11.org1 is neither the Receiver nor the Sender")
+	checkError(t, stub.invoke(ids.receiver, "transferShard", testShardId, "peer02.org2"), "2nd argument must be of the form MSPID:name")
+
+	// the current Receiver may pass the shard on
+	checkOK(t, stub.invoke(ids.receiver, "transferShard", testShardId, "Org2MSP:Peer02.Org2"))
+	s := getTestShard(t, stub, testShardId)
+	if s.Receiver != "peer02.org2" || s.ReceiverMSP != "Org2MSP" || s.PrevReceiver != testReceiver || s.TransferredBy != testReceiver {
+		t.Fatalf("unexpected shard after transfer %+v", s)
+	}
+	if hasIndexEntry(t, stub, receiverIndexName, testReceiver, testShardId) {
+		t.Fatal("old Receiver~ShardId index entry should be removed")
+	}
+	if !hasIndexEntry(t, stub, receiverIndexName, "peer02.org2", testShardId) {
+		t.Fatal("new Receiver~ShardId index entry missing")
+	}
+	event := checkEvent(t, stub, eventShardTransferred, testShardId)
+	if event.Receiver != "peer02.org2" || event.PrevReceiver != testReceiver {
+		t.Fatalf("unexpected event payload %+v", event)
+	}
+
+	// the previous Receiver no longer may, the Sender always may
+	checkError(t, stub.invoke(ids.receiver, "transferShard", testShardId, testReceiverId), "is neither the Receiver nor the Sender")
+	checkOK(t, stub.invoke(ids.sender, "transferShard", testShardId, testReceiverId))
+	if s := getTestShard(t, stub, testShardId); s.Receiver != testReceiver || s.TransferredBy != testSender {
+		t.Fatalf("unexpected shard after transfer by Sender %+v", s)
+	}
+
+	checkError(t, stub.invoke(ids.sender, "transferShard", testShardId, testReceiverId), "already assigned")
+	checkError(t, stub.invoke(ids.sender, "transferShard", testShardId), "Expecting 2")
+	checkError(t, stub.invoke(ids.sender, "transferShard", "", testReceiverId), "1st argument must be a non-empty string")
+	checkError(t, stub.invoke(ids.sender, "transferShard", testShardId, ""), "2nd argument must be a non-empty string")
+	checkError(t, stub.invoke(ids.sender, "transferShard", "missing", testReceiverId), "shard does not exist")
+	checkError(t, stub.invoke(nil, "transferShard", testShardId, testOtherId), "access denied: cannot read caller identity")
+}
+
+func TestDeleteShard(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+	registerTestData(t, stub, ids, testDataId, testShardId)
+	addTestShard(t, stub, ids, testShardId, testDataId, testReceiverId)
+
+	checkError(t, stub.invoke(ids.other, "deleteShard", testShardId, "expired"), "is not the Sender")
+	impersonator := newIdentity(t, "Org2MSP", testSender, map[string]string{roleAttribute: roleUploader})
+	checkError(t, stub.invoke(impersonator, "deleteShard", testShardId, "expired"), "Caller Org2MSP:peer01.org1 is not the Sender")
+	checkError(t, stub.invoke(ids.sender, "deleteShard", testShardId), "Expecting 2")
+	checkError(t, stub.invoke(ids.sender, "deleteShard", "", "expired"), "1st argument must be a non-empty string")
+	checkError(t, stub.invoke(ids.sender, "deleteShard", testShardId, ""), "2nd argument must be a non-empty string")
+	checkError(t, stub.invoke(ids.sender, "deleteShard", "missing", "expired"), "shard does not exist: missing")
+
+	checkOK(t, stub.invoke(ids.sender, "deleteShard", testShardId, "expired"))
+	if stub.State[testShardId] != nil {
+		t.Fatal("shard should be deleted")
+	}
+	for _, index := range []struct{ name, value string }{
+		{senderIndexName, testSender},
+		{receiverIndexName, testReceiver},
+		{dataIdIndexName, testDataId},
+	} {
+		if hasIndexEntry(t, stub, index.name, index.value, testShardId) {
+			t.Fatalf("%s index entry should be deleted", index.name)
+		}
+	}
+	checkEvent(t, stub, eventShardDeleted, testShardId)
+
+	res := stub.invoke(ids.other, "readTombstone", testShardId)
+	checkOK(t, res)
+	tomb := &tombstone{}
+	if err := json.Unmarshal(res.Payload, tomb); err != nil {
+		t.Fatal(err)
+	}
+	if tomb.DeletedBy != testSender || tomb.Reason != "expired" || tomb.DataId != testDataId || tomb.TxId == "" {
+		t.Fatalf("unexpected tombstone %+v", tomb)
+	}
+	if _, err := time.Parse(time.RFC3339, tomb.DeletedAt); err != nil {
+		t.Fatalf("DeletedAt is not RFC 3339: %s", err)
+	}
+
+	checkError(t, stub.invoke(ids.other, "readTombstone"), "Incorrect number of arguments")
+	checkError(t, stub.invoke(ids.other, "readTombstone", "missing"), "tombstone does not exist: missing")
+}
+
+func TestVerifyPUFResponse(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+	registerTestData(t, stub, ids, testDataId, testShardId)
+	addTestShard(t, stub, ids, testShardId, testDataId, testOtherId)
+
+	reference := "ff00ff00"
+	checkOK(t, enrollTestPUF(t, stub, ids.sender, testShardId, "puf-1", "response", reference, "2"))
+	checkOK(t, enrollTestPUF(t, stub, ids.sender, testShardId, "puf-2", "response", reference, "2"))
+	checkOK(t, enrollTestPUF(t, stub, ids.sender, testShardId, "puf-3", "commitment", "1234", "0"))
+
+	// neither the reference response nor an unsalted commitment reaches the public state
+	for key, value := range stub.State {
+		if strings.Contains(string(value), reference) {
+			t.Fatalf("reference response stored in public state under %q", key)
+		}
+	}
+	plain := sha256.Sum256([]byte{0x12, 0x34})
+	refAsBytes := stub.State[mustCompositeKey(t, stub, pufRefIndexName, testShardId, "puf-3")]
+	if strings.Contains(string(refAsBytes), hex.EncodeToString(plain[:])) || !strings.Contains(string(refAsBytes), `"Salt":"`) {
+		t.Fatalf("commitment is not salted: %s", refAsBytes)
+	}
+	// the response is kept by the Sender's org only
+	if value := stub.PvtState["collectionPUFReferencesOrg1MSP"][mustCompositeKey(t, stub, pufRefIndexName, testShardId, "puf-1")]; hex.EncodeToString(value) != reference {
+		t.Fatalf("expected reference %s in collectionPUFReferencesOrg1MSP, got %x", reference, value)
+	}
+
+	checkError(t, enrollTestPUF(t, stub, ids.sender, testShardId, "puf-4", "response", reference, "2"), "already has PUFNum=3")
+	checkError(t, enrollTestPUF(t, stub, ids.sender, testShardId, "puf-1", "response", reference, "2"), "already enrolled")
+	checkError(t, enrollTestPUF(t, stub, ids.other, testShardId, "puf-4", "response", reference, "2"), "is not the Sender")
+	checkError(t, stub.invoke(ids.sender, "enrollPUFReference", testShardId, "puf-4", "response", "2"), "Expecting 5")
+	checkError(t, enrollTestPUFTo(t, stub, ids.sender, testShardId, "puf-4", "c1", "response", reference, "2"), "4th argument: challenge hash must be")
+	checkError(t, enrollTestPUF(t, stub, ids.sender, testShardId, "", "response", reference, "2"), "argument 2 must be a non-empty string")
+	checkError(t, stub.invoke(ids.sender, "enrollPUFReference", testShardId, "puf-4", "response", testChallenge(testShardId, "puf-4"), "2"), "must be passed in the transient map")
+	checkError(t, enrollTestPUF(t, stub, ids.sender, testShardId, "puf-4", "response", reference, "-1"), "5th argument must be a non-negative")
+	checkError(t, enrollTestPUF(t, stub, ids.sender, testShardId, "puf-4", "response", reference, "33"), "exceeds the length")
+	checkError(t, enrollTestPUF(t, stub, ids.sender, testShardId, "puf-4", "commitment", reference, "1"), "must be 0")
+	checkError(t, enrollTestPUF(t, stub, ids.sender, testShardId, "puf-4", "guess", reference, "2"), "3rd argument must be")
+	checkError(t, enrollTestPUF(t, stub, ids.sender, "missing", "puf-4", "response", reference, "2"), "shard does not exist")
+
+	// only the Receiver submits responses
+	checkError(t, verifyTestPUF(t, stub, ids.receiver, testShardId, "puf-1", reference, testChallenge(testShardId, "puf-1")), "Caller Org1MSP:peer11.org1 is neither the Receiver of shard shard-0 nor a verifier of its org")
+
+	// three flipped bits exceed τ=2, two do not
+	checkError(t, verifyTestPUF(t, stub, ids.other, testShardId, "puf-1", "fe01fe00", testChallenge(testShardId, "puf-1")), "Hamming distance 3 exceeds τ=2")
+	res := verifyTestPUF(t, stub, ids.other, testShardId, "puf-1", "fe01ff00", testChallenge(testShardId, "puf-1"))
+	checkOK(t, res)
+	result := &verificationResult{}
+	if err := json.Unmarshal(res.Payload, result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Distance != 2 || result.SuccessNum != 1 || result.Threshold != 2 {
+		t.Fatalf("unexpected verification result %+v", result)
+	}
+	checkEvent(t, stub, eventPUFVerified, testShardId)
+
+	checkError(t, verifyTestPUF(t, stub, ids.other, testShardId, "puf-1", reference, testChallenge(testShardId, "puf-1")), "has already been verified")
+	checkError(t, verifyTestPUF(t, stub, ids.other, testShardId, "puf-2", "ff00", testChallenge(testShardId, "puf-2")), "does not match reference length")
+	checkError(t, verifyTestPUF(t, stub, ids.other, testShardId, "puf-3", "1235", testChallenge(testShardId, "puf-3")), "does not match the enrolled commitment")
+	checkOK(t, verifyTestPUF(t, stub, ids.other, testShardId, "puf-3", "1234", testChallenge(testShardId, "puf-3")))
+	if s := getTestShard(t, stub, testShardId); s.SuccessNum != 2 {
+		t.Fatalf("expected SuccessNum 2, got %d", s.SuccessNum)
+	}
+
+	checkError(t, verifyTestPUF(t, stub, ids.other, testShardId, "puf-9", reference, testChallenge(testShardId, "puf-9")), "is not enrolled")
+	checkError(t, stub.invoke(ids.other, "verifyPUFResponse", testShardId, "puf-2", reference, testChallenge(testShardId, "puf-2")), "Expecting 3")
+	checkError(t, verifyTestPUF(t, stub, ids.other, "", "puf-2", reference, testChallenge("", "puf-2")), "1st argument must be a non-empty string")
+	checkError(t, verifyTestPUF(t, stub, ids.other, testShardId, "", reference, testChallenge(testShardId, "")), "2nd argument must be a non-empty string")
+	checkError(t, verifyTestPUF(t, stub, ids.other, testShardId, "puf-2", reference, ""), "3rd argument must be a non-empty string")
+	checkError(t, verifyTestPUF(t, stub, ids.other, testShardId, "puf-2", reference, "c1"), "3rd argument: challenge hash must be")
+	checkError(t, verifyTestPUF(t, stub, ids.other, testShardId, "puf-2", "", testChallenge(testShardId, "puf-2")), "the response must be passed in the transient map")
+
+	// a verifier of the Receiver's org submits on its behalf
+	verifier := newIdentity(t, "Org2MSP", "verifier.org2", map[string]string{roleAttribute: roleVerifier})
+	checkOK(t, verifyTestPUF(t, stub, verifier, testShardId, "puf-2", reference, testChallenge(testShardId, "puf-2")))
+	if !strings.Contains(string(stub.State[mustCompositeKey(t, stub, pufPassIndexName, testShardId, "puf-2")]), `"VerifiedBy":"verifier.org2"`) {
+		t.Fatal("expected the verifier to be recorded on the PUF pass")
+	}
+
+	// a response reference is refused when the Receiver's org would hold it
+	registerTestData(t, stub, ids, "data-1", "shard-1")
+	addTestShard(t, stub, ids, "shard-1", "data-1", testReceiverId)
+	checkError(t, enrollTestPUF(t, stub, ids.sender, "shard-1", "puf-1", "response", reference, "2"), "belongs to Org1MSP, whose peers would hold the reference response")
+	checkOK(t, enrollTestPUF(t, stub, ids.sender, "shard-1", "puf-1", "commitment", reference, "0"))
+
+	// and no longer verifies once a transfer moves the Receiver into that org
+	registerTestData(t, stub, ids, "data-2", "shard-2")
+	addTestShard(t, stub, ids, "shard-2", "data-2", testOtherId)
+	checkOK(t, enrollTestPUF(t, stub, ids.sender, "shard-2", "puf-1", "response", reference, "2"))
+	checkOK(t, stub.invoke(ids.sender, "transferShard", "shard-2", testReceiverId))
+	checkError(t, verifyTestPUF(t, stub, ids.receiver, "shard-2", "puf-1", reference, testChallenge("shard-2", "puf-1")), "is kept in collectionPUFReferencesOrg1MSP, which the Receiver of shard shard-2 belongs to")
+
+	// responses enrolled in the shared collection before version 4 do not verify
+	registerTestData(t, stub, ids, "data-3", "shard-3")
+	addTestShard(t, stub, ids, "shard-3", "data-3", testOtherId)
+	checkOK(t, enrollTestPUF(t, stub, ids.sender, "shard-3", "puf-2", "commitment", reference, "0"))
+	legacyKey := mustCompositeKey(t, stub, pufRefIndexName, "shard-3", "puf-1")
+	stub.putRaw(legacyKey, []byte(`{"docType":"pufReference","SchemaVersion":3,"ShardId":"shard-3","PUFId":"puf-1","Kind":"response","Reference":"","ChallengeHash":"`+testChallenge("shard-3", "puf-1")+`","MaxDistance":2}`))
+	checkError(t, verifyTestPUF(t, stub, ids.other, "shard-3", "puf-1", reference, testChallenge("shard-3", "puf-1")), "in collectionPUFReferences, which Receivers belong to")
+}
+
+func TestDeleteShardDropsPUFRecords(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+	registerTestData(t, stub, ids, testDataId, testShardId)
+	addTestShard(t, stub, ids, testShardId, testDataId, testOtherId)
+	checkOK(t, enrollTestPUF(t, stub, ids.sender, testShardId, "puf-1", "response", "ff", "0"))
+	checkOK(t, verifyTestPUF(t, stub, ids.other, testShardId, "puf-1", "ff", testChallenge(testShardId, "puf-1")))
+
+	checkOK(t, stub.invoke(ids.sender, "deleteShard", testShardId, "re-split"))
+	refKey := mustCompositeKey(t, stub, pufRefIndexName, testShardId, "puf-1")
+	if hasIndexEntry(t, stub, pufRefIndexName, testShardId, "puf-1") || hasIndexEntry(t, stub, pufPassIndexName, testShardId, "puf-1") {
+		t.Fatal("deleteShard left the PUF reference or pass behind")
+	}
+	if _, ok := stub.PvtState["collectionPUFReferencesOrg1MSP"][refKey]; ok {
+		t.Fatal("deleteShard left the reference response in collectionPUFReferencesOrg1MSP")
+	}
+
+	// the shard added back is enrolled and verified afresh, to a fresh challenge
+	addTestShard(t, stub, ids, testShardId, testDataId, testOtherId)
+	checkError(t, enrollTestPUF(t, stub, ids.sender, testShardId, "puf-1", "response", "0f", "1"), "has already been consumed")
+	checkOK(t, enrollTestPUFTo(t, stub, ids.sender, testShardId, "puf-1", testChallenge(testShardId, "again"), "response", "0f", "1"))
+	checkError(t, verifyTestPUF(t, stub, ids.other, testShardId, "puf-1", "ff", testChallenge(testShardId, "again")), "Hamming distance 4 exceeds τ=1")
+	checkOK(t, verifyTestPUF(t, stub, ids.other, testShardId, "puf-1", "0e", testChallenge(testShardId, "again")))
+	if s := getTestShard(t, stub, testShardId); s.SuccessNum != 1 {
+		t.Fatalf("expected SuccessNum 1 after re-adding, got %d", s.SuccessNum)
+	}
+}
+
+func TestChallengeLedger(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+	registerTestData(t, stub, ids, testDataId, "shard-0", "shard-1", "shard-2", "shard-3")
+
+	c1 := testChallenge("c", "1")
+	c2 := testChallenge("c", "2")
+	c3 := testChallenge("c", "3")
+	reserve := func(challenges ...shardChallenge) string {
+		challengesAsBytes, err := json.Marshal(challenges)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(challengesAsBytes)
+	}
+	addShard := func(shardId string, challenges string) pb.Response {
+		return stub.invoke(ids.sender, "addShard", testSender, shardId, testDataId, testReceiverId, "1", "3", "0", challenges)
+	}
+
+	// addShard reserves challenges for the shard
+	checkError(t, addShard("shard-0", "{}"), "8th argument must be a JSON array")
+	checkError(t, addShard("shard-0", reserve(shardChallenge{PUFId: "puf-1", ChallengeHash: "1234"})), "hex SHA-256")
+	checkError(t, addShard("shard-0", reserve(shardChallenge{ChallengeHash: c1})), "must name its PUFId")
+	checkError(t, addShard("shard-0", reserve(shardChallenge{"puf-1", c1}, shardChallenge{"puf-1", strings.ToUpper(c1)})), "appears more than once")
+	checkOK(t, addShard("shard-0", reserve(shardChallenge{"puf-1", c1})))
+	checkError(t, addShard("shard-1", reserve(shardChallenge{"puf-1", c1})), "has already been consumed")
+	checkOK(t, addShard("shard-1", reserve()))
+	// the ledger is kept per PUF, c1 is still fresh for puf-2
+	checkOK(t, addShard("shard-2", reserve(shardChallenge{"puf-2", c1})))
+
+	// enrolling reserves the challenge, unless addShard already did for the shard
+	checkOK(t, enrollTestPUFTo(t, stub, ids.sender, "shard-0", "puf-1", c1, "commitment", "ff", "0"))
+	checkError(t, enrollTestPUFTo(t, stub, ids.sender, "shard-1", "puf-1", c1, "commitment", "ff", "0"), "has already been consumed")
+	checkOK(t, enrollTestPUFTo(t, stub, ids.sender, "shard-1", "puf-1", c2, "commitment", "ff", "0"))
+	checkOK(t, enrollTestPUFTo(t, stub, ids.sender, "shard-0", "puf-2", c3, "commitment", "ff", "0"))
+	checkError(t, enrollTestPUFTo(t, stub, ids.sender, "shard-1", "puf-2", c3, "commitment", "ff", "0"), "challenge "+c3+" of PUF puf-2 has already been consumed")
+
+	remainingOf := func(pufIds ...string) []remainingChallenges {
+		items := []remainingChallenges{}
+		decodeQueryResponse(t, stub.invoke(ids.other, "getRemainingChallenges", pufIds...), &items)
+		return items
+	}
+	if items := remainingOf(); len(items) != 2 || items[0].PUFId != "puf-1" || items[0].Consumed != 2 || items[0].Remaining != nil || items[1].Consumed != 2 {
+		t.Fatalf("unexpected challenge counters %+v", items)
+	}
+
+	// only the owning org sets the budget of a registered PUF, within its CRPCount
+	checkError(t, stub.invoke(ids.sender, "setChallengeBudget", "puf-2", "3"), "PUF is not registered: puf-2")
+	checkOK(t, stub.invoke(newIdentity(t, "Org1MSP", "admin.org1", map[string]string{roleAttribute: roleAdmin}), "registerPUF", "puf-2", "4"))
+	checkError(t, stub.invoke(ids.sender, "setChallengeBudget", "puf-2", "1"), "has already consumed 2 challenges")
+	checkError(t, stub.invoke(ids.sender, "setChallengeBudget", "puf-2", "5"), "was registered with 4 CRPs")
+	checkError(t, stub.invoke(ids.sender, "setChallengeBudget", "puf-2", "none"), "positive numeric string")
+	checkError(t, stub.invoke(ids.receiver, "setChallengeBudget", "puf-2", "3"), "access denied")
+	checkError(t, stub.invoke(ids.other, "setChallengeBudget", "puf-2", "3"), "PUF puf-2 belongs to Org1MSP, not Org2MSP")
+	checkOK(t, stub.invoke(ids.sender, "setChallengeBudget", "puf-2", "3"))
+	checkOK(t, enrollTestPUFTo(t, stub, ids.sender, "shard-1", "puf-2", c2, "commitment", "ff", "0"))
+
+	// a PUF only answers the challenge it was enrolled with, once
+	checkError(t, verifyTestPUF(t, stub, ids.receiver, "shard-0", "puf-1", "ff", "c1"), "hex SHA-256")
+	checkError(t, verifyTestPUF(t, stub, ids.receiver, "shard-0", "puf-1", "ff", c2), "is not the one PUF puf-1 was enrolled with for shard shard-0")
+	checkOK(t, verifyTestPUF(t, stub, ids.receiver, "shard-0", "puf-1", "ff", c1))
+	checkOK(t, verifyTestPUF(t, stub, ids.receiver, "shard-1", "puf-1", "ff", c2))
+	checkOK(t, verifyTestPUF(t, stub, ids.receiver, "shard-0", "puf-2", "ff", c3))
+
+	// a failed verification does not spend its challenge
+	checkError(t, verifyTestPUF(t, stub, ids.receiver, "shard-1", "puf-2", "00", c2), "does not match the enrolled commitment")
+	checkOK(t, verifyTestPUF(t, stub, ids.receiver, "shard-1", "puf-2", "ff", c2))
+	checkError(t, addShard("shard-3", reserve(shardChallenge{"puf-2", testChallenge("c", "4")})), "PUF puf-2 has no challenges left: 3 of 3 consumed")
+
+	// a reference enrolled before challenges were bound answers one reserved for its shard
+	checkOK(t, enrollTestPUFTo(t, stub, ids.sender, "shard-2", "puf-1", testChallenge("c", "4"), "commitment", "ff", "0"))
+	legacy := sha256.Sum256([]byte{0xff})
+	stub.putRaw(mustCompositeKey(t, stub, pufRefIndexName, "shard-2", "puf-2"), []byte(`{"docType":"pufReference","SchemaVersion":2,"ShardId":"shard-2","PUFId":"puf-2","Kind":"commitment","Reference":"`+hex.EncodeToString(legacy[:])+`","MaxDistance":0}`))
+	checkError(t, verifyTestPUF(t, stub, ids.receiver, "shard-2", "puf-2", "ff", testChallenge("c", "5")), "is not reserved for shard shard-2")
+	checkError(t, verifyTestPUF(t, stub, ids.receiver, "shard-2", "puf-2", "ff", c3), "has already been consumed")
+	checkOK(t, verifyTestPUF(t, stub, ids.receiver, "shard-2", "puf-2", "ff", c1))
+
+	items := remainingOf("puf-2", "puf-9")
+	if len(items) != 2 || items[0].Remaining == nil || *items[0].Remaining != 0 || items[1].Consumed != 0 || items[1].Remaining != nil {
+		t.Fatalf("unexpected challenge counters %+v", items)
+	}
+
+	// addShards spends the challenges of every entry in one go
+	entries := []shardEntry{{Sender: testSender, ShardId: "shard-3", DataId: testDataId, Receiver: testReceiverId, Threshold: 1, PUFNum: 3,
+		Challenges: []shardChallenge{{"puf-3", c1}}}}
+	entriesAsBytes, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkOK(t, stub.invoke(ids.sender, "addShards", string(entriesAsBytes)))
+	if items := remainingOf("puf-3"); items[0].Consumed != 1 {
+		t.Fatalf("expected addShards to consume the challenge, got %+v", items)
+	}
+}
+
+// newEncryptionKeyPEM returns a fresh ECC public key in PEM form
+func newEncryptionKeyPEM(t *testing.T) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// signKey signs a PEM public key the way publishKey expects
+func signKey(t *testing.T, signer *ecdsa.PrivateKey, publicKeyPEM string) string {
+	t.Helper()
+	digest := sha256.Sum256([]byte(publicKeyPEM))
+	r, sig, err := ecdsa.Sign(rand.Reader, signer, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := asn1.Marshal(ecdsaSignature{R: r, S: sig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(signature)
+}
+
+func TestEncryptionKeys(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+	receiver, signer := newIdentityWithKey(t, "Org1MSP", "Peer11.Org1", nil)
+	admin := newIdentity(t, "Org1MSP", "admin.org1", map[string]string{roleAttribute: roleAdmin})
+
+	decodeKey := func(res pb.Response) *encryptionKey {
+		t.Helper()
+		checkOK(t, res)
+		k := &encryptionKey{}
+		if err := json.Unmarshal(res.Payload, k); err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	first := newEncryptionKeyPEM(t)
+	checkError(t, stub.invoke(receiver, "publishKey", first, signKey(t, signer, newEncryptionKeyPEM(t))), "signature does not match")
+	_, otherSigner := newIdentityWithKey(t, "Org1MSP", "peer11.org1", nil)
+	checkError(t, stub.invoke(receiver, "publishKey", first, signKey(t, otherSigner, first)), "signature does not match")
+	checkError(t, stub.invoke(receiver, "getPublicKey", testReceiverId), "access denied")
+	checkError(t, stub.invoke(ids.sender, "getPublicKey", testReceiverId), "no encryption key published")
+
+	checkOK(t, stub.invoke(receiver, "publishKey", first, signKey(t, signer, first)))
+
+	// the key belongs to the MSP and name together: the same name in another org has none
+	imposter, imposterSigner := newIdentityWithKey(t, "Org2MSP", "peer11.org1", nil)
+	checkError(t, stub.invoke(ids.sender, "getPublicKey", "Org2MSP:"+testReceiver), "no encryption key published: Org2MSP:peer11.org1")
+	checkError(t, stub.invoke(imposter, "rotateKey", first, signKey(t, imposterSigner, first)), "no encryption key published")
+	checkError(t, stub.invoke(ids.sender, "getPublicKey", testReceiver), "must be of the form MSPID:name")
+	k := decodeKey(stub.invoke(ids.sender, "getPublicKey", "Org1MSP:PEER11.ORG1"))
+	if k.Owner != testReceiver || k.OwnerMSP != "Org1MSP" || k.PublicKey != first || k.Version != 1 || k.Status != keyStatusActive || len(k.Fingerprint) != 64 {
+		t.Fatalf("unexpected key %+v", k)
+	}
+	// senders check the Signature against the Certificate the key carries
+	block, _ := pem.Decode([]byte(k.Certificate))
+	if block == nil {
+		t.Fatalf("key carries no PEM certificate: %q", k.Certificate)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.ToLower(cert.Subject.CommonName) != k.Owner {
+		t.Fatalf("certificate of %s carried by the key of %s", cert.Subject.CommonName, k.Owner)
+	}
+	if err := verifyKeySignature(cert, k.PublicKey, k.Signature); err != nil {
+		t.Fatal(err)
+	}
+	checkError(t, stub.invoke(receiver, "publishKey", first, signKey(t, signer, first)), "use rotateKey")
+
+	// rotation replaces the key and links it to the one it replaces
+	checkError(t, stub.invoke(receiver, "rotateKey", first, signKey(t, signer, first)), "same as the current key")
+	second := newEncryptionKeyPEM(t)
+	checkOK(t, stub.invoke(receiver, "rotateKey", second, signKey(t, signer, second)))
+	rotated := decodeKey(stub.invoke(ids.sender, "getPublicKey", testReceiverId))
+	if rotated.PublicKey != second || rotated.Version != 2 || rotated.PrevFingerprint != k.Fingerprint {
+		t.Fatalf("unexpected rotated key %+v", rotated)
+	}
+
+	// only the owner or an admin may revoke; a revoked key is replaced by publishing
+	checkError(t, stub.invoke(ids.sender, "revokeKey", "compromised", testReceiverId), "may only revoke its own key")
+	otherAdmin := newIdentity(t, "Org2MSP", "admin.org2", map[string]string{roleAttribute: roleAdmin})
+	checkError(t, stub.invoke(otherAdmin, "revokeKey", "compromised", testReceiverId), "Caller Org2MSP:admin.org2 may only revoke keys of Org2MSP")
+	checkOK(t, stub.invoke(admin, "revokeKey", "compromised", testReceiverId))
+	revoked := decodeKey(stub.invoke(ids.sender, "getPublicKey", testReceiverId))
+	if revoked.Status != keyStatusRevoked || revoked.RevokedBy != "admin.org1" || revoked.RevokeReason != "compromised" {
+		t.Fatalf("unexpected revoked key %+v", revoked)
+	}
+	checkError(t, stub.invoke(receiver, "revokeKey", "again"), "already revoked")
+	checkError(t, stub.invoke(receiver, "rotateKey", first, signKey(t, signer, first)), "use publishKey")
+	checkOK(t, stub.invoke(receiver, "publishKey", first, signKey(t, signer, first)))
+	if k := decodeKey(stub.invoke(ids.sender, "getPublicKey", testReceiverId)); k.Version != 3 || k.Status != keyStatusActive {
+		t.Fatalf("unexpected republished key %+v", k)
+	}
+	checkOK(t, stub.invoke(receiver, "revokeKey", "retired"))
+
+	tests := []struct {
+		function string
+		args     []string
+		contains string
+	}{
+		{"publishKey", []string{first}, "Expecting 2"},
+		{"publishKey", []string{"", "sig"}, "1st argument must be a non-empty string"},
+		{"publishKey", []string{first, ""}, "2nd argument must be a non-empty string"},
+		{"publishKey", []string{"not a key", "sig"}, "must be a PEM encoded public key"},
+		{"publishKey", []string{first, "%%%"}, "must be a base64 signature"},
+		{"publishKey", []string{first, base64.StdEncoding.EncodeToString([]byte("sig"))}, "must be an ASN.1 ECDSA signature"},
+		{"rotateKey", []string{first}, "Expecting 2"},
+		{"revokeKey", []string{}, "Expecting 1 or 2"},
+		{"revokeKey", []string{""}, "1st argument must be a non-empty string"},
+	}
+	for _, test := range tests {
+		checkError(t, stub.invoke(receiver, test.function, test.args...), test.contains)
+	}
+	checkError(t, stub.invoke(ids.sender, "getPublicKey"), "Expecting 1")
+	checkError(t, stub.invoke(ids.sender, "revokeKey", "lost"), "no encryption key published")
+	checkError(t, stub.invoke(admin, "revokeKey", "lost", testReceiver), "2nd argument must be of the form MSPID:name")
+}
+
+func TestQuotas(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+	admin := newIdentity(t, "Org1MSP", "admin.org1", map[string]string{roleAttribute: roleAdmin})
+
+	checkError(t, stub.invoke(ids.sender, "setQuota", "org", "Org1MSP", "2", "5000", "0", "0"), "access denied")
+	checkOK(t, stub.invoke(admin, "setQuota", "org", "Org1MSP", "2", "5000", "0", "0"))
+	checkOK(t, stub.invoke(admin, "setQuota", "identity", "*", "0", "0", "2", "3600"))
+
+	// registered bytes and stored shards count against the org
+	registerTestData(t, stub, ids, testDataId, "shard-a", "shard-b", "shard-c")
+	checkError(t, stub.invoke(ids.sender, "registerData", "data-1", "1", `["shard-z"]`, "4096"), "quota exceeded: org Org1MSP may register 5000 bytes")
+	addTestShard(t, stub, ids, "shard-a", testDataId, testReceiverId)
+	addTestShard(t, stub, ids, "shard-b", testDataId, testReceiverId)
+	checkError(t, stub.invoke(ids.sender, "addShard", testSender, "shard-c", testDataId, testReceiverId, "2", "3", "0"), "quota exceeded: org Org1MSP may store 2 shards")
+
+	// deleting gives quota back, but the identity's rate window is still full
+	checkOK(t, stub.invoke(ids.sender, "deleteShard", "shard-a", "corrupt"))
+	checkError(t, stub.invoke(ids.sender, "addShard", testSender, "shard-c", testDataId, testReceiverId, "2", "3", "0"), "rate limit exceeded: identity Org1MSP:peer01.org1 may add 2 shards every 3600 seconds")
+	stub.txTime = stub.txTime.Add(time.Hour)
+	addTestShard(t, stub, ids, "shard-c", testDataId, testReceiverId)
+
+	items := []quotaStatus{}
+	decodeQueryResponse(t, stub.invoke(ids.sender, "getQuotaUsage"), &items)
+	if len(items) != 2 {
+		t.Fatalf("expected the org and identity quota, got %+v", items)
+	}
+	org, identity := items[0], items[1]
+	if org.Usage.Subject != "Org1MSP" || org.Usage.Shards != 2 || org.Usage.Bytes != 4096 || *org.RemainingShards != 0 || *org.RemainingBytes != 904 || org.RemainingInWindow != nil {
+		t.Fatalf("unexpected org quota %+v %+v", org.Quota, org.Usage)
+	}
+	if identity.Usage.Subject != "Org1MSP:"+testSender || identity.Quota.Subject != "*" || identity.RemainingShards != nil || *identity.RemainingInWindow != 1 {
+		t.Fatalf("unexpected identity quota %+v %+v", identity.Quota, identity.Usage)
+	}
+
+	// a batch is charged as a whole
+	checkOK(t, stub.invoke(admin, "setQuota", "org", "Org1MSP", "0", "0", "0", "0"))
+	registerTestData(t, stub, ids, "data-1", "shard-d", "shard-e")
+	batch, err := json.Marshal([]shardEntry{
+		{Sender: testSender, ShardId: "shard-d", DataId: "data-1", Receiver: testReceiverId, Threshold: 2, PUFNum: 3},
+		{Sender: testSender, ShardId: "shard-e", DataId: "data-1", Receiver: testReceiverId, Threshold: 2, PUFNum: 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkError(t, stub.invoke(ids.sender, "addShards", string(batch)), "rate limit exceeded")
+	stub.txTime = stub.txTime.Add(time.Hour)
+	checkOK(t, stub.invoke(ids.sender, "addShards", string(batch)))
+
+	// a backdated transaction counts in the current window rather than reopening an earlier one
+	registerTestData(t, stub, ids, "data-2", "shard-f")
+	stub.txTime = stub.txTime.Add(-2 * time.Hour)
+	checkError(t, stub.invoke(ids.sender, "addShard", testSender, "shard-f", "data-2", testReceiverId, "2", "3", "0"), "rate limit exceeded: identity Org1MSP:peer01.org1 may add 2 shards every 3600 seconds and has added 2")
+	stub.txTime = stub.txTime.Add(2 * time.Hour)
+
+	// a far-future transaction neither moves the org's window nor blocks the org's other identities
+	checkOK(t, stub.invoke(admin, "setQuota", "org", "Org1MSP", "0", "0", "10", "3600"))
+	future := stub.txTime
+	stub.txTime = time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)
+	checkError(t, stub.invoke(ids.sender, "addShard", testSender, "shard-f", "data-2", testReceiverId, "2", "3", "0"), "is more than 300 seconds ahead of the peer's clock")
+	stub.txTime = future
+	uploader := newIdentity(t, "Org1MSP", "peer02.org1", map[string]string{roleAttribute: roleUploader})
+	checkOK(t, stub.invoke(uploader, "registerData", "data-3", "1", `["shard-g"]`, "10"))
+	checkOK(t, stub.invoke(uploader, "addShard", "peer02.org1", "shard-g", "data-3", testReceiverId, "2", "3", "0"))
+	decodeQueryResponse(t, stub.invoke(admin, "getQuotaUsage", "org", "Org1MSP"), &items)
+	if len(items) != 1 || items[0].Usage.WindowStart > stub.txTime.Unix() || items[0].Usage.WindowShards != 1 {
+		t.Fatalf("unexpected org rate window %+v", items)
+	}
+
+	checkError(t, stub.invoke(ids.sender, "getQuotaUsage", "identity", testReceiverId), "may only query its own quota")
+	checkError(t, stub.invoke(ids.sender, "getQuotaUsage", "identity", testSender), "2nd argument must be of the form MSPID:name")
+	decodeQueryResponse(t, stub.invoke(ids.sender, "getQuotaUsage", "identity", "Org1MSP:PEER01.ORG1"), &items)
+	if len(items) != 1 || items[0].Usage.Shards != 4 {
+		t.Fatalf("unexpected identity usage %+v", items)
+	}
+	decodeQueryResponse(t, stub.invoke(admin, "getQuotaUsage", "identity", testReceiverId), &items)
+	if len(items) != 1 || items[0].Usage.Shards != 0 {
+		t.Fatalf("unexpected unused quota %+v", items)
+	}
+
+	tests := []struct {
+		args     []string
+		contains string
+	}{
+		{[]string{"org", "Org1MSP", "1", "1", "1"}, "Expecting 6"},
+		{[]string{"channel", "Org1MSP", "1", "1", "1", "1"}, "1st argument must be org or identity"},
+		{[]string{"org", "", "1", "1", "1", "1"}, "2nd argument must be a non-empty string"},
+		{[]string{"org", "Org1MSP", "-1", "1", "1", "1"}, "3rd argument must be a non-negative"},
+		{[]string{"org", "Org1MSP", "1", "x", "1", "1"}, "4th argument must be a non-negative"},
+		{[]string{"org", "Org1MSP", "1", "1", "-1", "1"}, "5th argument must be a non-negative"},
+		{[]string{"org", "Org1MSP", "1", "1", "1", "x"}, "6th argument must be a non-negative"},
+		{[]string{"org", "Org1MSP", "1", "1", "1", "0"}, "6th argument must be positive when a RateLimit is set"},
+	}
+	for _, test := range tests {
+		checkError(t, stub.invoke(admin, "setQuota", test.args...), test.contains)
+	}
+	checkError(t, stub.invoke(ids.sender, "getQuotaUsage", "org"), "Expecting 0 or 2")
+	checkError(t, stub.invoke(ids.sender, "getQuotaUsage", "channel", "x"), "1st argument must be org or identity")
+}
+
+func TestConcurrentQuotaCharges(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+	sender2 := newIdentity(t, "Org1MSP", "peer03.org1", map[string]string{roleAttribute: roleUploader})
+	registerTestData(t, stub, ids, "data-a", "shard-a")
+	checkOK(t, stub.invoke(sender2, "registerData", "data-b", "1", `["shard-b"]`, "4096"))
+	checkOK(t, stub.invoke(ids.other, "registerData", "data-c", "1", `["shard-c"]`, "4096"))
+
+	// two identities of one org both update the org's usage: the second is invalidated
+	res := stub.invokeBlock(
+		blockTx{ids.sender, "addShard", []string{testSender, "shard-a", "data-a", testReceiverId, "2", "3", "0"}},
+		blockTx{sender2, "addShard", []string{"peer03.org1", "shard-b", "data-b", testReceiverId, "2", "3", "0"}},
+	)
+	checkOK(t, res[0])
+	checkError(t, res[1], "MVCC_READ_CONFLICT on "+mustCompositeKey(t, stub, quotaUsageObjectType, quotaScopeOrg, "Org1MSP"))
+	if stub.State["shard-b"] != nil {
+		t.Fatal("the invalidated addShard was committed")
+	}
+
+	// orgs adding to their own data do not conflict
+	res = stub.invokeBlock(
+		blockTx{sender2, "addShard", []string{"peer03.org1", "shard-b", "data-b", testReceiverId, "2", "3", "0"}},
+		blockTx{ids.other, "addShard", []string{"peer02.org2", "shard-c", "data-c", testReceiverId, "2", "3", "0"}},
+	)
+	checkOK(t, res[0])
+	checkOK(t, res[1])
+
+	items := []quotaStatus{}
+	decodeQueryResponse(t, stub.invoke(ids.sender, "getQuotaUsage"), &items)
+	if items[0].Usage.Shards != 2 {
+		t.Fatalf("expected Org1MSP to be charged for 2 shards, got %+v", items[0].Usage)
+	}
+	for _, shardId := range []string{"shard-a", "shard-b", "shard-c"} {
+		getTestShard(t, stub, shardId)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	stub := newTestStub()
+	superuser := newIdentity(t, "Org1MSP", "admin.org1", map[string]string{roleAttribute: strings.Join(knownRoles, ",")})
+
+	res := stub.invoke(nil, "getMetadata")
+	checkOK(t, res)
+	metadata := &contractMetadata{}
+	if err := json.Unmarshal(res.Payload, metadata); err != nil {
+		t.Fatal(err)
+	}
+	if metadata.APIVersion != queryAPIVersion || len(metadata.Functions) != len(functionRoles) {
+		t.Fatalf("expected %d functions, got %d", len(functionRoles), len(metadata.Functions))
+	}
+	for _, f := range metadata.Functions {
+		roles, ok := functionRoles[f.Name]
+		if !ok {
+			t.Fatalf("%s is described but not dispatched", f.Name)
+		}
+		if strings.Join(f.Roles, ",") != strings.Join(roles, ",") {
+			t.Fatalf("%s: expected roles %v, got %v", f.Name, roles, f.Roles)
+		}
+		if (f.Access != accessRead && f.Access != accessWrite) || f.Description == "" || f.Response == nil {
+			t.Fatalf("%s is not fully described: %+v", f.Name, f)
+		}
+		for _, arg := range f.Args {
+			switch arg.Type {
+			case "string", "integer", "boolean", "json":
+			default:
+				t.Fatalf("%s: argument %s has unknown type %q", f.Name, arg.Name, arg.Type)
+			}
+		}
+
+		// one argument short of the fewest accepted must be rejected as such
+		if len(f.ArgCounts) == 0 || f.ArgCounts[0] == 0 {
+			continue
+		}
+		if last := f.ArgCounts[len(f.ArgCounts)-1]; last != len(f.Args) {
+			t.Fatalf("%s accepts up to %d arguments but describes %d", f.Name, last, len(f.Args))
+		}
+		args := make([]string, f.ArgCounts[0]-1)
+		for i := range args {
+			args[i] = "x"
+		}
+		res := stub.invoke(superuser, f.Name, args...)
+		if res.Status == shim.OK || !strings.Contains(res.Message, "Expecting") {
+			t.Fatalf("%s with %d arguments: expected an argument count error, got %d %q", f.Name, len(args), res.Status, res.Message)
+		}
+	}
+
+	res = stub.invoke(nil, "getMetadata", "addShard")
+	checkOK(t, res)
+	if err := json.Unmarshal(res.Payload, metadata); err != nil {
+		t.Fatal(err)
+	}
+	addShard := metadata.Functions[0]
+	if len(metadata.Functions) != 1 || len(addShard.Args) != 8 || !addShard.Args[7].Optional || fmt.Sprint(addShard.ArgCounts) != "[7 8]" || addShard.Access != accessWrite {
+		t.Fatalf("unexpected addShard metadata %+v", metadata.Functions)
+	}
+	if string(mustMarshal(t, addShard.Response)) != `{"type":"null"}` {
+		t.Fatalf("addShard returns no payload, got schema %s", mustMarshal(t, addShard.Response))
+	}
+
+	res = stub.invoke(nil, "getMetadata", "readShard")
+	checkOK(t, res)
+	if err := json.Unmarshal(res.Payload, metadata); err != nil {
+		t.Fatal(err)
+	}
+	schema := metadata.Functions[0].Response
+	properties := schema["properties"].(map[string]interface{})
+	if schema["type"] != "object" || properties["ShardId"] == nil || properties["PUFIds"] == nil {
+		t.Fatalf("unexpected readShard schema %s", mustMarshal(t, schema))
+	}
+	for _, name := range schema["required"].([]interface{}) {
+		if name == "PUFIds" {
+			t.Fatal("PUFIds is omitempty and should not be required")
+		}
+	}
+
+	// the schema describes exactly the fields getCallerRoles returns, embedded ones included
+	res = stub.invoke(nil, "getMetadata", "getCallerRoles")
+	checkOK(t, res)
+	if err := json.Unmarshal(res.Payload, metadata); err != nil {
+		t.Fatal(err)
+	}
+	schema = metadata.Functions[0].Response
+	res = stub.invoke(superuser, "getCallerRoles")
+	checkOK(t, res)
+	payload := map[string]interface{}{}
+	if err := json.Unmarshal(res.Payload, &payload); err != nil {
+		t.Fatal(err)
+	}
+	described := []string{}
+	for name := range schema["properties"].(map[string]interface{}) {
+		described = append(described, name)
+	}
+	returned := []string{}
+	for name := range payload {
+		returned = append(returned, name)
+	}
+	sort.Strings(described)
+	sort.Strings(returned)
+	if strings.Join(described, ",") != strings.Join(returned, ",") || len(schema["required"].([]interface{})) != len(returned) {
+		t.Fatalf("getCallerRoles returns %v, its schema describes %s", returned, mustMarshal(t, schema))
+	}
+
+	checkError(t, stub.invoke(nil, "getMetadata", "missing"), "Received unknown function invocation")
+	checkError(t, stub.invoke(nil, "getMetadata", "a", "b"), "Expecting 0 or 1")
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestShardEndorsement(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+	admin := newIdentity(t, "Org1MSP", "admin.org1", map[string]string{roleAttribute: roleAdmin})
+	registerTestData(t, stub, ids, testDataId, testShardId)
+
+	endorsement := func(shardId string) *shardEndorsement {
+		t.Helper()
+		res := stub.invoke(ids.other, "getShardEndorsement", shardId)
+		checkOK(t, res)
+		e := &shardEndorsement{}
+		if err := json.Unmarshal(res.Payload, e); err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	checkOrgs := func(shardId string, orgs ...string) {
+		t.Helper()
+		e := endorsement(shardId)
+		if !e.KeyLevel || strings.Join(e.Orgs, ",") != strings.Join(orgs, ",") {
+			t.Fatalf("expected a key-level policy for %v, got %+v", orgs, e)
+		}
+	}
+
+	// both parties are in Org1MSP
+	addTestShard(t, stub, ids, testShardId, testDataId, testReceiverId)
+	checkOrgs(testShardId, "Org1MSP")
+	if s := getTestShard(t, stub, testShardId); s.SenderMSP != "Org1MSP" || s.ReceiverMSP != "Org1MSP" {
+		t.Fatalf("unexpected shard orgs %+v", s)
+	}
+
+	// a transfer to a Receiver of another org adds its org
+	checkOK(t, stub.invoke(ids.sender, "transferShard", testShardId, testOtherId))
+	checkOrgs(testShardId, "Org1MSP", "Org2MSP")
+	if s := getTestShard(t, stub, testShardId); s.ReceiverMSP != "Org2MSP" {
+		t.Fatalf("unexpected shard orgs %+v", s)
+	}
+
+	// only an admin may change the policy
+	checkError(t, stub.invoke(ids.other, "setShardEndorsement", testShardId, `["Org2MSP"]`), "access denied")
+	checkError(t, stub.invoke(ids.sender, "setShardEndorsement", testShardId, `["Org1MSP"]`), "access denied")
+	checkOK(t, stub.invoke(admin, "setShardEndorsement", testShardId, `["Org3MSP","Org1MSP","Org3MSP"]`))
+	checkOrgs(testShardId, "Org1MSP", "Org3MSP")
+	res := stub.invoke(admin, "setShardEndorsement", testShardId)
+	checkOK(t, res)
+	checkOrgs(testShardId, "Org1MSP", "Org2MSP")
+	returned := &shardEndorsement{}
+	if err := json.Unmarshal(res.Payload, returned); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(returned.Orgs, ",") != "Org1MSP,Org2MSP" {
+		t.Fatalf("setShardEndorsement should return the new policy, got %+v", returned)
+	}
+
+	// shards written before key-level policies keep the chaincode-wide one
+	stub.State["legacy"] = []byte(`{"docType":"shard","Sender":"peer01.org1","ShardId":"legacy","DataId":"data-0","Receiver":"peer11.org1","Threshold":2,"PUFNum":3,"SuccessNum":0}`)
+	if e := endorsement("legacy"); e.KeyLevel || len(e.Orgs) != 0 {
+		t.Fatalf("expected no key-level policy, got %+v", e)
+	}
+	// their orgs are unknown, so only an explicit list gives them one
+	checkError(t, stub.invoke(admin, "setShardEndorsement", "legacy"), "does not record the MSP IDs of both its Sender and Receiver")
+	checkOK(t, stub.invoke(admin, "setShardEndorsement", "legacy", `["Org1MSP"]`))
+	checkOrgs("legacy", "Org1MSP")
+	legacy := &shard{ShardId: "legacy", SenderMSP: "Org1MSP"}
+	if err := applyShardEndorsement(stub, legacy); err == nil || !strings.Contains(err.Error(), "does not record the MSP IDs") {
+		t.Fatalf("expected a shard without a ReceiverMSP to be refused a default policy, got %v", err)
+	}
+
+	tests := []struct {
+		args     []string
+		contains string
+	}{
+		{[]string{}, "Expecting 1 or 2"},
+		{[]string{""}, "1st argument must be a non-empty string"},
+		{[]string{"missing"}, "shard does not exist"},
+		{[]string{testShardId, "Org1MSP"}, "2nd argument must be a JSON array"},
+		{[]string{testShardId, `[]`}, "at least one MSP ID"},
+		{[]string{testShardId, `[""]`}, "must be non-empty strings"},
+	}
+	for _, test := range tests {
+		checkError(t, stub.invoke(admin, "setShardEndorsement", test.args...), test.contains)
+	}
+	checkError(t, stub.invoke(ids.other, "getShardEndorsement"), "Expecting 1")
+	checkError(t, stub.invoke(ids.other, "getShardEndorsement", "missing"), "shard does not exist")
+
+	// deleting a shard drops its policy with it
+	checkOK(t, stub.invoke(ids.sender, "deleteShard", testShardId, "expired"))
+	if stub.EndorsementPolicies[testShardId] != nil {
+		t.Fatal("the policy of a deleted shard should be gone")
+	}
+}
+
+func TestPUFRegistry(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+	registerTestData(t, stub, ids, testDataId, "shard-0", "shard-1", "shard-2")
+
+	// only an admin registers devices, for its own org
+	org1Admin := newIdentity(t, "Org1MSP", "admin.org1", map[string]string{roleAttribute: roleAdmin})
+	org2Admin := newIdentity(t, "Org2MSP", "admin.org2", map[string]string{roleAttribute: roleAdmin})
+	checkError(t, stub.invoke(ids.sender, "registerPUF", "puf-a", "100"), "access denied")
+	checkOK(t, stub.invoke(org1Admin, "registerPUF", "puf-a", "100"))
+	checkOK(t, stub.invoke(org1Admin, "registerPUF", "puf-b", "50"))
+	checkOK(t, stub.invoke(org2Admin, "registerPUF", "puf-c", "10"))
+	checkError(t, stub.invoke(org2Admin, "registerPUF", "puf-a", "10"), "already registered")
+	checkError(t, stub.invoke(org1Admin, "registerPUF", "puf-d", "0"), "positive numeric string")
+	checkError(t, stub.invoke(ids.receiver, "registerPUF", "puf-d", "10"), "access denied")
+
+	getPUF := func(pufId string) *puf {
+		res := stub.invoke(ids.other, "getPUF", pufId)
+		checkOK(t, res)
+		p := &puf{}
+		if err := json.Unmarshal(res.Payload, p); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	if p := getPUF("puf-a"); p.OwnerMSP != "Org1MSP" || p.RegisteredBy != "admin.org1" || p.CRPCount != 100 || p.Status != pufStatusActive || p.EnrolledAt != "2026-01-01T00:00:02Z" {
+		t.Fatalf("unexpected PUF %+v", p)
+	}
+	checkError(t, stub.invoke(ids.other, "getPUF", "puf-x"), "PUF is not registered: puf-x")
+
+	// the CRP count is the device's challenge budget
+	items := []remainingChallenges{}
+	decodeQueryResponse(t, stub.invoke(ids.other, "getRemainingChallenges", "puf-a"), &items)
+	if items[0].Remaining == nil || *items[0].Remaining != 100 {
+		t.Fatalf("unexpected challenge budget %+v", items)
+	}
+
+	pufIdsOf := func(res pb.Response) []string {
+		pufs := []puf{}
+		decodeQueryResponse(t, res, &pufs)
+		pufIds := []string{}
+		for _, p := range pufs {
+			pufIds = append(pufIds, p.PUFId)
+		}
+		return pufIds
+	}
+	checkKeys(t, pufIdsOf(stub.invoke(ids.other, "listPUFsByOrg", "Org1MSP")), "puf-a", "puf-b")
+	checkKeys(t, pufIdsOf(stub.invoke(ids.other, "listPUFsByOrg", "Org2MSP")), "puf-c")
+	checkKeys(t, pufIdsOf(stub.invoke(ids.other, "listPUFsByOrg", "Org1MSP", "1", "")), "puf-a")
+	checkError(t, stub.invoke(ids.other, "listPUFsByOrg"), "Expecting 1 or 3")
+
+	// shards name the devices they depend on
+	addShard := func(shardId string, pufs string) pb.Response {
+		return stub.invoke(ids.sender, "addShard", testSender, shardId, testDataId, testReceiverId, "2", pufs, "0")
+	}
+	checkError(t, addShard("shard-0", `["puf-a","puf-x"]`), "PUF is not registered: puf-x")
+	checkError(t, addShard("shard-0", `["puf-a","puf-a"]`), "PUF puf-a is named more than once")
+	checkError(t, addShard("shard-0", `["puf-a"]`), "Threshold must be between 1 and PUFNum")
+	checkError(t, addShard("shard-0", `{"puf-a":1}`), "6rd argument must be a numeric string or a JSON array of PUF IDs")
+	offList := `[{"PUFId":"puf-c","ChallengeHash":"` + testChallenge("shard-0", "puf-c") + `"}]`
+	checkError(t, stub.invoke(ids.sender, "addShard", testSender, "shard-0", testDataId, testReceiverId, "2", `["puf-a","puf-b"]`, "0", offList), "is for PUF puf-c, which is not one of the PUFIds of shard shard-0")
+	checkOK(t, addShard("shard-0", `["puf-a","puf-b"]`))
+	if s := getTestShard(t, stub, "shard-0"); s.PUFNum != 2 || strings.Join(s.PUFIds, ",") != "puf-a,puf-b" {
+		t.Fatalf("unexpected shard %+v", s)
+	}
+
+	checkError(t, enrollTestPUF(t, stub, ids.sender, "shard-0", "puf-c", "commitment", "ff", "0"), "PUF puf-c is not one of the PUFIds of shard shard-0")
+	checkOK(t, enrollTestPUF(t, stub, ids.sender, "shard-0", "puf-a", "commitment", "ff", "0"))
+	checkOK(t, enrollTestPUF(t, stub, ids.sender, "shard-0", "puf-b", "commitment", "ff", "0"))
+
+	checkError(t, stub.invoke(ids.other, "revokePUF", "puf-b", "worn out"), "PUF puf-b belongs to Org1MSP, not Org2MSP")
+	checkError(t, stub.invoke(ids.sender, "revokePUF", "puf-x", "worn out"), "PUF is not registered")
+	checkOK(t, stub.invoke(ids.sender, "revokePUF", "puf-b", "worn out"))
+	checkError(t, stub.invoke(ids.sender, "revokePUF", "puf-b", "again"), "already revoked")
+	if p := getPUF("puf-b"); p.Status != pufStatusRevoked || p.RevokeReason != "worn out" || p.RevokedAt == "" {
+		t.Fatalf("unexpected revoked PUF %+v", p)
+	}
+
+	checkOK(t, verifyTestPUF(t, stub, ids.receiver, "shard-0", "puf-a", "ff", testChallenge("shard-0", "puf-a")))
+	checkError(t, verifyTestPUF(t, stub, ids.receiver, "shard-0", "puf-b", "ff", testChallenge("shard-0", "puf-b")), "PUF puf-b is revoked: worn out")
+	checkError(t, addShard("shard-1", `["puf-a","puf-b"]`), "PUF puf-b is revoked")
+
+	// an admin may revoke any org's device
+	admin := newIdentity(t, "Org2MSP", "admin.org2", map[string]string{roleAttribute: roleAdmin})
+	checkOK(t, stub.invoke(admin, "revokePUF", "puf-a", "compromised"))
+
+	checkOK(t, stub.invoke(org2Admin, "registerPUF", "puf-d", "10"))
+	entries := []shardEntry{{Sender: testSender, ShardId: "shard-2", DataId: testDataId, Receiver: testReceiverId, Threshold: 1, PUFNum: 2, PUFIds: []string{"puf-c"}}}
+	entriesAsBytes, _ := json.Marshal(entries)
+	checkError(t, stub.invoke(ids.sender, "addShards", string(entriesAsBytes)), "PUFNum must match the number of PUFIds")
+	entries[0].PUFNum = 0
+	entries[0].PUFIds = []string{"puf-c", "puf-d"}
+	entriesAsBytes, _ = json.Marshal(entries)
+	checkOK(t, stub.invoke(ids.sender, "addShards", string(entriesAsBytes)))
+	if s := getTestShard(t, stub, "shard-2"); s.PUFNum != 2 || strings.Join(s.PUFIds, ",") != "puf-c,puf-d" {
+		t.Fatalf("unexpected shard %+v", s)
+	}
+}
+
+func TestReleaseShard(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+	registerTestData(t, stub, ids, testDataId, testShardId)
+	addTestShard(t, stub, ids, testShardId, testDataId, testReceiverId)
+
+	releaseStatusOf := func() *releaseStatus {
+		res := stub.invoke(ids.other, "getReleaseStatus", testShardId)
+		checkOK(t, res)
+		status := &releaseStatus{}
+		if err := json.Unmarshal(res.Payload, status); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	if status := releaseStatusOf(); status.Status != releaseStatusPending {
+		t.Fatalf("expected %q, got %+v", releaseStatusPending, status)
+	}
+	checkError(t, stub.invoke(ids.receiver, "releaseShard", testShardId), "pending verification: 0 of 2")
+	checkError(t, stub.invoke(ids.receiver, "readShardForReceiver", testShardId), "pending verification")
+
+	for _, pufId := range []string{"puf-1", "puf-2"} {
+		checkOK(t, enrollTestPUF(t, stub, ids.sender, testShardId, pufId, "commitment", "ff", "0"))
+		checkOK(t, verifyTestPUF(t, stub, ids.receiver, testShardId, pufId, "ff", testChallenge(testShardId, pufId)))
+	}
+	if status := releaseStatusOf(); status.Status != releaseStatusReady {
+		t.Fatalf("expected %q, got %+v", releaseStatusReady, status)
+	}
+
+	// only the shard's Sender and Receiver, auditors and admins see where its release stands
+	stranger := newIdentity(t, "Org2MSP", "peer12.org2", map[string]string{roleAttribute: roleReceiver})
+	checkError(t, stub.invoke(stranger, "getReleaseStatus", testShardId), "Caller Org2MSP:peer12.org2 is neither the Sender nor the Receiver of shard shard-0")
+	checkOK(t, stub.invoke(ids.sender, "getReleaseStatus", testShardId))
+	checkOK(t, stub.invoke(ids.receiver, "getReleaseStatus", testShardId))
+
+	checkError(t, stub.invoke(ids.other, "releaseShard", testShardId), "is not the Receiver")
+	checkOK(t, stub.invoke(ids.receiver, "readShardForReceiver", testShardId))
+	checkOK(t, stub.invoke(ids.receiver, "releaseShard", testShardId))
+	checkEvent(t, stub, eventShardReleased, testShardId)
+	if status := releaseStatusOf(); status.Status != releaseStatusReleased || status.ReleasedTo != testReceiver {
+		t.Fatalf("expected %q, got %+v", releaseStatusReleased, status)
+	}
+
+	for _, function := range []string{"releaseShard", "readShardForReceiver", "getReleaseStatus"} {
+		checkError(t, stub.invoke(ids.receiver, function), "Expecting 1")
+		checkError(t, stub.invoke(ids.receiver, function, ""), "1st argument must be a non-empty string")
+		checkError(t, stub.invoke(ids.receiver, function, "missing"), "shard does not exist")
+	}
+}
+
+func TestCRPs(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+	registerTestData(t, stub, ids, testDataId, testShardId)
+	addTestShard(t, stub, ids, testShardId, testDataId, testOtherId)
+
+	material := []byte("cipherCRPs")
+	transient := map[string][]byte{crpsTransientKey: material}
+	collection := crpsCollectionPrefix + "Org2MSP"
+
+	checkError(t, stub.invoke(ids.sender, "putCRPs", testShardId, "Org2MSP"), "transient map")
+	checkError(t, stub.invokeWithTransient(ids.other, transient, "putCRPs", testShardId, "Org2MSP"), "is not the Sender")
+	checkError(t, stub.invokeWithTransient(ids.sender, transient, "putCRPs", "missing", "Org2MSP"), "shard does not exist")
+	checkError(t, stub.invokeWithTransient(ids.sender, transient, "putCRPs", testShardId, "Org1MSP"), "Org1MSP is not the MSP of the Receiver")
+	checkOK(t, stub.invokeWithTransient(ids.sender, transient, "putCRPs", testShardId, "Org2MSP"))
+	checkError(t, stub.invokeWithTransient(ids.sender, transient, "putCRPs", testShardId, "Org2MSP"), "already stored")
+
+	if !bytes.Equal(stub.PvtState[collection][testShardId], material) {
+		t.Fatalf("expected the material in %s, got %q", collection, stub.PvtState[collection][testShardId])
+	}
+	for key, value := range stub.State {
+		if bytes.Contains(value, material) {
+			t.Fatalf("material leaked to the public ledger under %q", key)
+		}
+	}
+
+	res := stub.invoke(ids.sender, "getCRPsHash", testShardId, "Org2MSP")
+	checkOK(t, res)
+	record := &crpsHash{}
+	if err := json.Unmarshal(res.Payload, record); err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(material)
+	if record.Hash != hex.EncodeToString(digest[:]) || record.Collection != collection || record.Sender != testSender {
+		t.Fatalf("unexpected CRPs hash record %+v", record)
+	}
+
+	res = stub.invoke(ids.other, "getCRPs", testShardId)
+	checkOK(t, res)
+	if !bytes.Equal(res.Payload, material) {
+		t.Fatalf("expected %q, got %q", material, res.Payload)
+	}
+	checkError(t, stub.invoke(ids.receiver, "getCRPs", testShardId), "no CRPs for shard")
+
+	for _, candidate := range []struct {
+		material []byte
+		match    bool
+	}{{material, true}, {[]byte("tampered"), false}} {
+		res = stub.invokeWithTransient(ids.receiver, map[string][]byte{crpsTransientKey: candidate.material}, "verifyCRPs", testShardId, "Org2MSP")
+		checkOK(t, res)
+		result := &crpsVerification{}
+		if err := json.Unmarshal(res.Payload, result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Match != candidate.match {
+			t.Fatalf("expected match %v for %q, got %+v", candidate.match, candidate.material, result)
+		}
+	}
+	checkError(t, stub.invokeWithTransient(ids.receiver, transient, "verifyCRPs", testShardId, "Org1MSP"), "no CRPs hash")
+}
+
+func TestShardLifecycle(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+	registerTestData(t, stub, ids, testDataId, testShardId, "shard-1")
+	addTestShard(t, stub, ids, testShardId, testDataId, testReceiverId)
+	addTestShard(t, stub, ids, "shard-1", testDataId, testReceiverId)
+
+	checkStatus := func(want string) {
+		t.Helper()
+		if s := getTestShard(t, stub, testShardId); s.Status != want {
+			t.Fatalf("expected status %s, got %+v", want, s)
+		}
+		if !hasIndexEntry(t, stub, statusIndexName, want, testShardId) {
+			t.Fatalf("missing %s index entry for %s", statusIndexName, want)
+		}
+	}
+
+	checkStatus(statusCreated)
+	checkOK(t, enrollTestPUF(t, stub, ids.sender, testShardId, "puf-1", "commitment", "ff", "0"))
+	checkStatus(statusAssigned)
+	if hasIndexEntry(t, stub, statusIndexName, statusCreated, testShardId) {
+		t.Fatal("the Created index entry should be gone")
+	}
+	if event := checkEvent(t, stub, eventShardAssigned, testShardId); event.Status != statusAssigned {
+		t.Fatalf("unexpected %s payload %+v", eventShardAssigned, event)
+	}
+	events := len(stub.events)
+	checkOK(t, enrollTestPUF(t, stub, ids.sender, testShardId, "puf-2", "commitment", "ff", "0"))
+	if len(stub.events) != events {
+		t.Fatalf("a later enrollment emitted %+v", stub.lastEvent())
+	}
+	checkOK(t, enrollTestPUF(t, stub, ids.sender, testShardId, "puf-3", "commitment", "ff", "0"))
+	checkError(t, stub.invoke(ids.receiver, "releaseShard", testShardId), "pending verification")
+
+	checkOK(t, verifyTestPUF(t, stub, ids.receiver, testShardId, "puf-1", "ff", testChallenge(testShardId, "puf-1")))
+	checkStatus(statusAssigned)
+	checkOK(t, verifyTestPUF(t, stub, ids.receiver, testShardId, "puf-2", "ff", testChallenge(testShardId, "puf-2")))
+	checkStatus(statusVerified)
+	checkOK(t, verifyTestPUF(t, stub, ids.receiver, testShardId, "puf-3", "ff", testChallenge(testShardId, "puf-3")))
+	checkStatus(statusVerified)
+
+	checkError(t, stub.invoke(ids.sender, "transferShard", testShardId, testOtherId), "transferShard is not allowed for shard shard-0 in status Verified")
+	checkError(t, stub.invokeWithTransient(ids.sender, map[string][]byte{crpsTransientKey: []byte("late")}, "putCRPs", testShardId, "Org1MSP"), "in status Verified")
+	checkError(t, stub.invoke(ids.receiver, "confirmRetrieval", testShardId), "invalid status transition for shard shard-0: Verified -> Retrieved")
+
+	checkOK(t, stub.invoke(ids.receiver, "releaseShard", testShardId))
+	checkStatus(statusReleased)
+	checkError(t, stub.invoke(ids.receiver, "releaseShard", testShardId), "Released -> Released")
+
+	checkError(t, stub.invoke(ids.other, "confirmRetrieval", testShardId), "is not the Receiver")
+	checkOK(t, stub.invoke(ids.receiver, "confirmRetrieval", testShardId))
+	checkEvent(t, stub, eventShardRetrieved, testShardId)
+	checkStatus(statusRetrieved)
+
+	checkError(t, stub.invoke(ids.other, "revokeShard", testShardId, "leaked"), "is not the Sender")
+	checkError(t, stub.invoke(ids.sender, "revokeShard", testShardId), "Expecting 2")
+	checkOK(t, stub.invoke(ids.sender, "revokeShard", testShardId, "leaked"))
+	if event := checkEvent(t, stub, eventShardRevoked, testShardId); event.Status != statusRevoked {
+		t.Fatalf("expected the event to carry the new status, got %+v", event)
+	}
+	checkStatus(statusRevoked)
+	checkError(t, stub.invoke(ids.sender, "revokeShard", testShardId, "again"), "Revoked -> Revoked")
+	checkError(t, stub.invoke(ids.receiver, "readShardForReceiver", testShardId), "is Revoked: leaked")
+
+	keys, _ := queryKeys(t, stub.invoke(ids.other, "getShardsByStatus", "created"))
+	checkKeys(t, keys, "shard-1")
+	keys, _ = queryKeys(t, stub.invoke(ids.other, "getShardsByStatus", statusRevoked))
+	checkKeys(t, keys, testShardId)
+	keys, _ = queryKeys(t, stub.invoke(ids.other, "queryShardsByStatus", "REVOKED"))
+	checkKeys(t, keys, testShardId)
+	checkError(t, stub.invoke(ids.other, "getShardsByStatus", "stuck"), "unknown status")
+	checkError(t, stub.invoke(ids.other, "queryShardsByStatus", "stuck"), "unknown status")
+
+	// shards written before Status existed get one derived on read; their
+	// client-supplied SuccessNum does not count
+	stub.State["legacy"] = []byte(`{"docType":"shard","ShardId":"legacy","Receiver":"peer11.org1","Threshold":2,"PUFNum":3,"SuccessNum":2}`)
+	res := stub.invoke(ids.other, "getReleaseStatus", "legacy")
+	checkOK(t, res)
+	status := &releaseStatus{}
+	if err := json.Unmarshal(res.Payload, status); err != nil {
+		t.Fatal(err)
+	}
+	if status.ShardStatus != statusCreated || status.Status != releaseStatusPending || status.SuccessNum != 0 {
+		t.Fatalf("unexpected status of a legacy shard %+v", status)
+	}
+}
+
+func TestSchemaMigration(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+	admin := newIdentity(t, "Org1MSP", "admin.org1", map[string]string{roleAttribute: roleAdmin})
+
+	// shards written before SchemaVersion and Status existed, when the client
+	// passed SuccessNum to addShard: legacy-1 claims to be verified
+	for i, fields := range []string{`"SuccessNum":0`, `"SuccessNum":2,"ReceiverMSP":"Org1MSP"`, `"SuccessNum":1,"ReleasedTo":"peer11.org1"`} {
+		shardId := "legacy-" + strconv.Itoa(i)
+		stub.putRaw(shardId, []byte(`{"docType":"shard","Sender":"peer01.org1","ShardId":"`+shardId+`","DataId":"data-0","Receiver":"peer11.org1","Threshold":2,"PUFNum":3,`+fields+`}`))
+	}
+
+	// readers upgrade on load without writing
+	res := stub.invoke(ids.other, "readShard", "legacy-1")
+	checkOK(t, res)
+	read := &shard{}
+	if err := json.Unmarshal(res.Payload, read); err != nil {
+		t.Fatal(err)
+	}
+	if read.SchemaVersion != schemaVersions["shard"] || read.Status != statusCreated || read.SuccessNum != 0 {
+		t.Fatalf("expected an upgraded shard, got %+v", read)
+	}
+	if s := getTestShard(t, stub, "legacy-1"); s.SchemaVersion != 0 {
+		t.Fatalf("readShard should not rewrite the shard, got %+v", s)
+	}
+
+	// so do the queries returning shards
+	stub.putRaw(mustCompositeKey(t, stub, senderIndexName, testSender, "legacy-1"), []byte{0x00})
+	for _, res := range []pb.Response{
+		stub.invoke(ids.other, "getShardsByRange", "legacy-1", "legacy-2"),
+		stub.invoke(ids.other, "getShardsBySender", testSender),
+	} {
+		records := []struct {
+			Key    string
+			Record shard
+		}{}
+		decodeQueryResponse(t, res, &records)
+		if len(records) != 1 || records[0].Record.SchemaVersion != schemaVersions["shard"] || records[0].Record.Status != statusCreated {
+			t.Fatalf("expected an upgraded shard, got %+v", records)
+		}
+	}
+
+	checkError(t, stub.invoke(ids.sender, "migrateShards", "legacy-0", "legacy-9"), "access denied")
+	checkError(t, stub.invoke(admin, "migrateShards", "legacy-0"), "Expecting 2 or 3")
+	checkError(t, stub.invoke(admin, "migrateShards", "legacy-0", "legacy-9", "0"), "positive numeric string")
+
+	migrate := func(startKey string, limit string) *migrationResult {
+		res := stub.invoke(admin, "migrateShards", startKey, "legacy-9", limit)
+		checkOK(t, res)
+		result := &migrationResult{}
+		if err := json.Unmarshal(res.Payload, result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	if result := migrate("legacy-0", "2"); result.Scanned != 2 || result.Migrated != 2 || result.NextKey != "legacy-2" {
+		t.Fatalf("unexpected first batch %+v", result)
+	}
+	if result := migrate("legacy-2", "2"); result.Scanned != 1 || result.Migrated != 1 || result.NextKey != "" {
+		t.Fatalf("unexpected last batch %+v", result)
+	}
+	if result := migrate("legacy-0", "1000"); result.Scanned != 3 || result.Migrated != 0 {
+		t.Fatalf("a second pass should find nothing to migrate, got %+v", result)
+	}
+
+	for shardId, status := range map[string]string{"legacy-0": statusCreated, "legacy-1": statusCreated, "legacy-2": statusReleased} {
+		s := getTestShard(t, stub, shardId)
+		if s.SchemaVersion != schemaVersions["shard"] || s.Status != status {
+			t.Fatalf("unexpected migrated shard %+v", s)
+		}
+		if !hasIndexEntry(t, stub, statusIndexName, status, shardId) {
+			t.Fatalf("missing %s index entry for %s", statusIndexName, shardId)
+		}
+	}
+
+	// only PUF passes counted by verifyPUFResponse let the forged shard be released
+	checkError(t, stub.invoke(ids.receiver, "releaseShard", "legacy-1"), "shard legacy-1 is pending verification: 0 of 2 required PUFs verified")
+
+	// a record from a newer chaincode is refused rather than misread
+	stub.State["future"] = []byte(`{"docType":"shard","SchemaVersion":99,"ShardId":"future"}`)
+	checkError(t, stub.invoke(ids.other, "readShard", "future"), "schema version 99")
+	checkError(t, stub.invoke(admin, "migrateShards", "future", "future~"), "schema version 99")
+}
+
+func TestGetShardsByRange(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+	registerTestData(t, stub, ids, testDataId, "shard-a", "shard-b", "shard-c")
+	for _, shardId := range []string{"shard-a", "shard-b", "shard-c"} {
+		addTestShard(t, stub, ids, shardId, testDataId, testReceiverId)
+	}
+
+	keys, _ := queryKeys(t, stub.invoke(ids.other, "getShardsByRange", "shard-a", "shard-c"))
+	checkKeys(t, keys, "shard-a", "shard-b")
+
+	keys, response := queryKeys(t, stub.invoke(ids.other, "getShardsByRangeWithPagination", "shard-a", "shard-z", "2", ""))
+	checkKeys(t, keys, "shard-a", "shard-b")
+	if response.Bookmark != "shard-b" || response.FetchedRecordsCount != 2 {
+		t.Fatalf("unexpected page metadata %+v", response)
+	}
+	keys, response = queryKeys(t, stub.invoke(ids.other, "getShardsByRangeWithPagination", "shard-a", "shard-z", "2", response.Bookmark))
+	checkKeys(t, keys, "shard-c")
+	if response.Bookmark != "" {
+		t.Fatalf("last page should have no bookmark, got %q", response.Bookmark)
+	}
+
+	checkError(t, stub.invoke(ids.other, "getShardsByRange", "shard-a"), "Expecting 2")
+	checkError(t, stub.invoke(ids.other, "getShardsByRangeWithPagination", "shard-a", "shard-z", "2"), "Expecting 4")
+	checkError(t, stub.invoke(ids.other, "getShardsByRangeWithPagination", "shard-a", "shard-z", "0", ""), "pageSize must be a positive")
+}
+
+func TestPageSizeIsCapped(t *testing.T) {
+	pageSize, err := parsePageSize("100000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pageSize != maxPageSize {
+		t.Fatalf("expected page size to be capped at %d, got %d", maxPageSize, pageSize)
+	}
+	if _, err := parsePageSize("ten"); err == nil {
+		t.Fatal("expected an error for a non-numeric page size")
+	}
+}
+
+func TestGetHistoryForShard(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+	registerTestData(t, stub, ids, testDataId, testShardId)
+	addTestShard(t, stub, ids, testShardId, testDataId, testReceiverId)
+	checkOK(t, stub.invoke(ids.sender, "transferShard", testShardId, testOtherId))
+	checkOK(t, stub.invoke(ids.sender, "deleteShard", testShardId, "expired"))
+
+	history := []historyRecord{}
+	decodeQueryResponse(t, stub.invoke(ids.other, "getHistoryForShard", testShardId), &history)
+	if len(history) != 3 {
+		t.Fatalf("expected 3 history records, got %d", len(history))
+	}
+	for _, record := range history {
+		if record.TxId == "" {
+			t.Fatal("history record without TxId")
+		}
+		if _, err := time.Parse(time.RFC3339, record.Timestamp); err != nil {
+			t.Fatalf("Timestamp is not RFC 3339: %s", err)
+		}
+	}
+
+	transferred := &shard{}
+	if err := json.Unmarshal(history[1].Value, transferred); err != nil {
+		t.Fatal(err)
+	}
+	if transferred.PrevReceiver != testReceiver || transferred.Receiver != "peer02.org2" {
+		t.Fatalf("history should surface the previous and new Receiver, got %+v", transferred)
+	}
+	if !history[2].IsDelete || string(history[2].Value) != "null" {
+		t.Fatalf("expected a delete record with a null value, got %+v", history[2])
+	}
+
+	checkError(t, stub.invoke(ids.other, "getHistoryForShard"), "Expecting 1")
+}
+
+func TestAuditTrail(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+	registerTestData(t, stub, ids, testDataId, "shard-a", "shard-b")
+	addTestShard(t, stub, ids, "shard-a", testDataId, testReceiverId)
+	addTestShard(t, stub, ids, "shard-b", testDataId, testReceiverId)
+	checkOK(t, stub.invoke(ids.receiver, "transferShard", "shard-a", testOtherId))
+	checkOK(t, stub.invoke(ids.sender, "deleteShard", "shard-b", "corrupt"))
+	registerTestData(t, stub, ids, "other-data", "shard-c")
+	addTestShard(t, stub, ids, "shard-c", "other-data", testReceiverId)
+
+	entries := []auditEntry{}
+	decodeQueryResponse(t, stub.invoke(ids.other, "getAuditTrailForData", strings.ToUpper(testDataId)), &entries)
+	want := []struct {
+		shardId, function, mspID, subject string
+		isDelete                          bool
+	}{
+		{"shard-a", "addShard", "Org1MSP", "peer01.org1", false},
+		{"shard-b", "addShard", "Org1MSP", "peer01.org1", false},
+		{"shard-a", "transferShard", "Org1MSP", "peer11.org1", false},
+		{"shard-b", "deleteShard", "Org1MSP", "peer01.org1", true},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("expected %d audit entries, got %+v", len(want), entries)
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.ShardId != w.shardId || e.Function != w.function || e.MSPID != w.mspID || e.IsDelete != w.isDelete || e.TxId == "" {
+			t.Fatalf("unexpected audit entry %d: %+v", i, e)
+		}
+		if !strings.Contains(e.Subject, "CN="+w.subject) {
+			t.Fatalf("entry %d: expected subject of %s, got %q", i, w.subject, e.Subject)
+		}
+		if i > 0 && timestampBefore(e.Timestamp, entries[i-1].Timestamp) {
+			t.Fatalf("audit trail is not in timestamp order: %+v", entries)
+		}
+	}
+	if entries[3].Reason != "corrupt" {
+		t.Fatalf("expected the delete Reason, got %+v", entries[3])
+	}
+
+	changed := map[string][2]string{}
+	for _, change := range entries[2].Changes {
+		changed[change.Field] = [2]string{string(change.Old), string(change.New)}
+	}
+	if changed["Receiver"] != [2]string{`"` + testReceiver + `"`, `"peer02.org2"`} || changed["ReceiverMSP"] != [2]string{`"Org1MSP"`, `"Org2MSP"`} || len(changed) != 4 {
+		t.Fatalf("unexpected transfer changes %+v", entries[2].Changes)
+	}
+	for _, change := range entries[3].Changes {
+		if string(change.New) != "null" {
+			t.Fatalf("a delete should clear every field, got %+v", change)
+		}
+	}
+
+	checkError(t, stub.invoke(ids.other, "getAuditTrailForData"), "Expecting 1")
+	checkError(t, stub.invoke(ids.other, "getAuditTrailForData", "missing"), "no shards found")
+	checkError(t, stub.invoke(ids.sender, "getAuditTrailForData", testDataId), "access denied")
+}
+
+func TestAuditTrailKeepsKeyOrder(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+	registerTestData(t, stub, ids, testDataId, "shard-a", "shard-b")
+	addTestShard(t, stub, ids, "shard-a", testDataId, testReceiverId)
+	addTestShard(t, stub, ids, "shard-b", testDataId, testReceiverId)
+	checkOK(t, stub.invoke(ids.receiver, "transferShard", "shard-a", testOtherId))
+	checkOK(t, stub.invoke(ids.sender, "deleteShard", "shard-b", "corrupt"))
+
+	// a client clock running behind stamps the transfer before the shard was added
+	history := stub.history["shard-a"]
+	if len(history) != 2 {
+		t.Fatalf("expected 2 history entries for shard-a, got %d", len(history))
+	}
+	history[1].Timestamp = &timestamp.Timestamp{Seconds: history[0].Timestamp.Seconds - 3600}
+
+	entries := []auditEntry{}
+	decodeQueryResponse(t, stub.invoke(ids.other, "getAuditTrailForData", testDataId), &entries)
+	got := []string{}
+	for _, e := range entries {
+		got = append(got, e.ShardId+" "+e.Function)
+	}
+	if strings.Join(got, ",") != "shard-a addShard,shard-a transferShard,shard-b addShard,shard-b deleteShard" {
+		t.Fatalf("unexpected audit trail order %v", got)
+	}
+	for _, change := range entries[1].Changes {
+		if change.Field == "Receiver" && string(change.New) != `"peer02.org2"` {
+			t.Fatalf("transfer diffed against the wrong version: %+v", entries[1].Changes)
+		}
+	}
+	if len(entries[1].Changes) != 4 {
+		t.Fatalf("unexpected transfer changes %+v", entries[1].Changes)
+	}
+}
+
+func TestRichQueries(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+	registerTestData(t, stub, ids, "data-a", "shard-a", "shard-c")
+	registerTestData(t, stub, ids, "data-b", "shard-b")
+	addTestShard(t, stub, ids, "shard-a", "data-a", testReceiverId)
+	addTestShard(t, stub, ids, "shard-b", "data-b", testOtherId)
+	addTestShard(t, stub, ids, "shard-c", "data-a", testReceiverId)
+
+	keys, _ := queryKeys(t, stub.invoke(ids.other, "queryShardsBySender", "PEER01.ORG1"))
+	checkKeys(t, keys, "shard-a", "shard-b", "shard-c")
+	keys, _ = queryKeys(t, stub.invoke(ids.other, "queryShardsBySender", `peer01.org1","docType":{"$ne":"x`))
+	checkKeys(t, keys)
+
+	keys, _ = queryKeys(t, stub.invoke(ids.other, "queryShards", `{"selector":{"docType":"shard","Receiver":"peer02.org2"}}`))
+	checkKeys(t, keys, "shard-b")
+
+	keys, response := queryKeys(t, stub.invoke(ids.other, "queryShardsWithPagination", `{"selector":{"docType":"shard"}}`, "2", ""))
+	checkKeys(t, keys, "shard-a", "shard-b")
+	keys, _ = queryKeys(t, stub.invoke(ids.other, "queryShardsWithPagination", `{"selector":{"docType":"shard"}}`, "2", response.Bookmark))
+	checkKeys(t, keys, "shard-c")
+
+	keys, _ = queryKeys(t, stub.invoke(ids.other, "queryShardsBySenderWithPagination", testSender, "1", ""))
+	checkKeys(t, keys, "shard-a")
+
+	keys, _ = queryKeys(t, stub.invoke(ids.other, "queryShardsByReceiver", testReceiver, "desc"))
+	checkKeys(t, keys, "shard-c", "shard-a")
+	keys, _ = queryKeys(t, stub.invoke(ids.other, "queryShardsByDataId", "data-a", "asc", "1", ""))
+	checkKeys(t, keys, "shard-a")
+
+	checkError(t, stub.invoke(ids.other, "queryShardsBySender"), "Expecting 1")
+	checkError(t, stub.invoke(ids.other, "queryShards"), "Expecting 1")
+	checkError(t, stub.invoke(ids.other, "queryShards", "not json"), "invalid query")
+	checkError(t, stub.invoke(ids.other, "queryShardsWithPagination", "{}"), "Expecting 3")
+	checkError(t, stub.invoke(ids.other, "queryShardsBySenderWithPagination", testSender), "Expecting 3")
+	checkError(t, stub.invoke(ids.other, "queryShardsByReceiver"), "Expecting 1, 2 or 4")
+	checkError(t, stub.invoke(ids.other, "queryShardsByReceiver", ""), "1st argument must be a non-empty string")
+	checkError(t, stub.invoke(ids.other, "queryShardsByDataId", "data-a", "sideways"), "sortOrder must be")
+
+	// errors come back in the envelope too
+	res := stub.invoke(ids.other, "queryShards")
+	envelope := &queryResponse{}
+	if err := json.Unmarshal([]byte(res.Message), envelope); err != nil || envelope.Error == "" {
+		t.Fatalf("query errors should be returned as an envelope, got %q", res.Message)
+	}
+
+	checkOK(t, stub.init(ids.sender, "rawQueries=false"))
+	checkError(t, stub.invoke(ids.other, "queryShards", `{"selector":{}}`), "raw queries are disabled")
+	checkError(t, stub.invoke(ids.other, "queryShardsWithPagination", `{"selector":{}}`, "2", ""), "raw queries are disabled")
+	keys, _ = queryKeys(t, stub.invoke(ids.other, "queryShardsBySender", testSender))
+	checkKeys(t, keys, "shard-a", "shard-b", "shard-c")
+}
+
+func TestTimeWindowQueries(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+	admin := newIdentity(t, "Org1MSP", "admin.org1", map[string]string{roleAttribute: roleAdmin})
+	registerTestData(t, stub, ids, "data-a", "shard-a", "shard-b")
+	registerTestData(t, stub, ids, "data-b", "shard-c")
+	addTestShard(t, stub, ids, "shard-a", "data-a", testReceiverId)
+	addTestShard(t, stub, ids, "shard-b", "data-a", testReceiverId)
+	addTestShard(t, stub, ids, "shard-c", "data-b", testOtherId)
+	if s := getTestShard(t, stub, "shard-a"); s.CreatedAt != "2026-01-01T00:00:02Z" || s.UpdatedAt != s.CreatedAt {
+		t.Fatalf("expected the addShard transaction timestamp, got %+v", s)
+	}
+
+	// an hour later shard-a changes hands: UpdatedAt moves, CreatedAt stays
+	stub.txTime = stub.txTime.Add(time.Hour)
+	checkOK(t, stub.invoke(ids.receiver, "transferShard", "shard-a", testOtherId))
+	if s := getTestShard(t, stub, "shard-a"); s.CreatedAt != "2026-01-01T00:00:02Z" || s.UpdatedAt != "2026-01-01T01:00:05Z" {
+		t.Fatalf("unexpected times after transfer %+v", s)
+	}
+
+	keys, _ := queryKeys(t, stub.invoke(ids.other, "queryShardsBySenderInWindow", testSender, "created", "2026-01-01T00:00:00Z", "2026-01-01T00:00:04Z"))
+	checkKeys(t, keys, "shard-a", "shard-b")
+	// stored times are whole seconds, so fractional bounds round up
+	keys, _ = queryKeys(t, stub.invoke(ids.other, "queryShardsBySenderInWindow", testSender, "created", "", "2026-01-01T00:00:03.5Z"))
+	checkKeys(t, keys, "shard-a", "shard-b")
+	keys, _ = queryKeys(t, stub.invoke(ids.other, "queryShardsBySenderInWindow", testSender, "created", "2026-01-01T00:00:02.5Z", ""))
+	checkKeys(t, keys, "shard-b", "shard-c")
+	keys, _ = queryKeys(t, stub.invoke(ids.other, "queryShardsBySenderInWindow", testSender, "CREATED", "", ""))
+	checkKeys(t, keys, "shard-a", "shard-b", "shard-c")
+	keys, _ = queryKeys(t, stub.invoke(ids.other, "queryShardsBySenderInWindow", testSender, "changed", "2026-01-01T00:30:00Z", ""))
+	checkKeys(t, keys, "shard-a")
+
+	// oldest change first
+	keys, _ = queryKeys(t, stub.invoke(ids.other, "queryShardsByReceiverInWindow", "Peer02.Org2", "changed", "", ""))
+	checkKeys(t, keys, "shard-c", "shard-a")
+	keys, _ = queryKeys(t, stub.invoke(ids.other, "queryShardsByReceiverInWindow", testReceiver, "changed", "", "2026-01-01T00:30:00Z"))
+	checkKeys(t, keys, "shard-b")
+
+	// bounds in another zone are compared in UTC
+	keys, _ = queryKeys(t, stub.invoke(ids.other, "queryShardsByDataIdInWindow", "data-a", "created", "2026-01-01T01:00:03+01:00", ""))
+	checkKeys(t, keys, "shard-b")
+
+	keys, response := queryKeys(t, stub.invoke(ids.other, "queryShardsBySenderInWindow", testSender, "created", "", "", "2", ""))
+	checkKeys(t, keys, "shard-a", "shard-b")
+	keys, _ = queryKeys(t, stub.invoke(ids.other, "queryShardsBySenderInWindow", testSender, "created", "", "", "2", response.Bookmark))
+	checkKeys(t, keys, "shard-c")
+
+	checkError(t, stub.invoke(ids.other, "queryShardsBySenderInWindow", testSender, "created", ""), "Expecting 4 or 6")
+	checkError(t, stub.invoke(ids.other, "queryShardsBySenderInWindow", "", "created", "", ""), "1st argument must be a non-empty string")
+	checkError(t, stub.invoke(ids.other, "queryShardsBySenderInWindow", testSender, "read", "", ""), `2nd argument must be "created" or "changed"`)
+	checkError(t, stub.invoke(ids.other, "queryShardsBySenderInWindow", testSender, "created", "yesterday", ""), "3rd argument must be an RFC 3339 time")
+	checkError(t, stub.invoke(ids.other, "queryShardsBySenderInWindow", testSender, "created", "", "2026-01-01"), "4th argument must be an RFC 3339 time")
+	checkError(t, stub.invoke(ids.other, "queryShardsBySenderInWindow", testSender, "created", "2026-01-02T00:00:00Z", "2026-01-01T00:00:00Z"), "the window must end after it starts")
+	checkError(t, stub.invoke(nil, "queryShardsByDataIdInWindow", "data-a", "created", "", ""), "access denied")
+
+	// a shard written before version 6 has no CreatedAt, and migrateShards does
+	// not make one up
+	legacy := getTestShard(t, stub, "shard-a")
+	legacy.SchemaVersion = 5
+	legacy.CreatedAt = ""
+	legacy.UpdatedAt = ""
+	stub.State["shard-a"] = mustMarshal(t, legacy)
+	keys, _ = queryKeys(t, stub.invoke(ids.other, "queryShardsBySenderInWindow", testSender, "created", "", ""))
+	checkKeys(t, keys, "shard-b", "shard-c")
+
+	checkOK(t, stub.invoke(admin, "migrateShards", "shard-a", "shard-a~"))
+	s := getTestShard(t, stub, "shard-a")
+	if s.SchemaVersion != schemaVersions["shard"] || s.CreatedAt != "" || s.UpdatedAt != "" || s.ModifiedIn != "migrateShards" {
+		t.Fatalf("unexpected migrated shard %+v", s)
+	}
+	keys, _ = queryKeys(t, stub.invoke(ids.other, "queryShardsBySenderInWindow", testSender, "created", "", ""))
+	checkKeys(t, keys, "shard-b", "shard-c")
+	keys, _ = queryKeys(t, stub.invoke(ids.other, "queryShardsBySenderInWindow", testSender, "changed", "", ""))
+	checkKeys(t, keys, "shard-b", "shard-c")
+
+	// its next change dates it
+	checkOK(t, stub.invoke(ids.sender, "transferShard", "shard-a", testReceiverId))
+	if s := getTestShard(t, stub, "shard-a"); s.CreatedAt != "" || s.UpdatedAt == "" {
+		t.Fatalf("unexpected changed legacy shard %+v", s)
+	}
+	keys, _ = queryKeys(t, stub.invoke(ids.other, "queryShardsBySenderInWindow", testSender, "changed", "", ""))
+	checkKeys(t, keys, "shard-b", "shard-c", "shard-a")
+}
+
+func TestQueryShardsStructured(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+	registerTestData(t, stub, ids, "data-a", "shard-a", "shard-c")
+	registerTestData(t, stub, ids, "data-b", "shard-b")
+	addTestShard(t, stub, ids, "shard-a", "data-a", testReceiverId)
+	addTestShard(t, stub, ids, "shard-b", "data-b", testOtherId)
+	addTestShard(t, stub, ids, "shard-c", "data-a", testReceiverId)
+
+	query := `{"filters":[{"field":"Receiver","op":"$eq","value":"PEER11.ORG1"},{"field":"Threshold","op":"$gte","value":2}],
+	           "sort":[{"field":"ShardId","order":"desc"}]}`
+	keys, _ := queryKeys(t, stub.invoke(ids.other, "queryShardsStructured", query))
+	checkKeys(t, keys, "shard-c", "shard-a")
+
+	query = `{"filters":[{"field":"DataId","op":"$in","value":["data-b","data-x"]}]}`
+	keys, _ = queryKeys(t, stub.invoke(ids.other, "queryShardsStructured", query, "10", ""))
+	checkKeys(t, keys, "shard-b")
+
+	tests := []struct {
+		query    string
+		contains string
+	}{
+		{`not json`, "1st argument must be a structured query"},
+		{`{"filters":[{"field":"docType","op":"$eq","value":"tombstone"}]}`, `field "docType" cannot be queried`},
+		{`{"filters":[{"field":"Sender","op":"$regex","value":".*"}]}`, `operator "$regex" is not allowed`},
+		{`{"filters":[{"field":"Sender","op":"$eq","value":{"$ne":""}}]}`, "value for Sender must be a string"},
+		{`{"filters":[{"field":"PUFNum","op":"$eq","value":"3"}]}`, "value for PUFNum must be an integer"},
+		{`{"filters":[{"field":"DataId","op":"$in","value":[]}]}`, "needs a non-empty array"},
+		{`{"filters":[{"field":"Sender","op":"$eq","value":"a"},{"field":"Sender","op":"$eq","value":"b"}]}`, "given twice"},
+		{`{"sort":[{"field":"Threshold","order":"asc"}]}`, `cannot sort on field "Threshold"`},
+		{`{"sort":[{"field":"ShardId","order":"up"}]}`, "sort order must be"},
+	}
+	for _, test := range tests {
+		checkError(t, stub.invoke(ids.other, "queryShardsStructured", test.query), test.contains)
+	}
+	checkError(t, stub.invoke(ids.other, "queryShardsStructured"), "Expecting 1 or 3")
+}
+
+func TestGetShardsByCompositeKey(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+	registerTestData(t, stub, ids, "data-a", "shard-a", "shard-c")
+	registerTestData(t, stub, ids, "data-b", "shard-b")
+	addTestShard(t, stub, ids, "shard-a", "data-a", testReceiverId)
+	addTestShard(t, stub, ids, "shard-b", "data-b", testOtherId)
+	addTestShard(t, stub, ids, "shard-c", "data-a", testReceiverId)
+
+	keys, _ := queryKeys(t, stub.invoke(ids.other, "getShardsBySender", "Peer01.Org1"))
+	checkKeys(t, keys, "shard-a", "shard-b", "shard-c")
+	keys, _ = queryKeys(t, stub.invoke(ids.other, "getShardsByReceiver", testReceiver))
+	checkKeys(t, keys, "shard-a", "shard-c")
+	keys, _ = queryKeys(t, stub.invoke(ids.other, "getShardsByDataId", "data-b"))
+	checkKeys(t, keys, "shard-b")
+
+	keys, response := queryKeys(t, stub.invoke(ids.other, "getShardsBySender", testSender, "2", ""))
+	checkKeys(t, keys, "shard-a", "shard-b")
+	keys, _ = queryKeys(t, stub.invoke(ids.other, "getShardsBySender", testSender, "2", response.Bookmark))
+	checkKeys(t, keys, "shard-c")
+
+	// the lookups follow transfers and deletes
+	checkOK(t, stub.invoke(ids.sender, "transferShard", "shard-a", testOtherId))
+	checkOK(t, stub.invoke(ids.sender, "deleteShard", "shard-b", "expired"))
+	keys, _ = queryKeys(t, stub.invoke(ids.other, "getShardsByReceiver", "peer02.org2"))
+	checkKeys(t, keys, "shard-a")
+
+	checkError(t, stub.invoke(ids.other, "getShardsBySender"), "Expecting 1 or 3")
+	checkError(t, stub.invoke(ids.other, "getShardsByReceiver", ""), "1st argument must be a non-empty string")
+	checkError(t, stub.invoke(ids.other, "getShardsByDataId", "data-a", "x", ""), "pageSize must be a positive")
+}
+
+func TestFailedTransactionLeavesNoEvent(t *testing.T) {
+	stub := newTestStub()
+	ids := newTestIdentities(t)
+	registerTestData(t, stub, ids, testDataId, testShardId)
+	addTestShard(t, stub, ids, testShardId, testDataId, testReceiverId)
+
+	checkError(t, stub.invoke(ids.other, "transferShard", testShardId, testOtherId), "is neither the Receiver nor the Sender")
+	checkEvent(t, stub, eventShardAdded, testShardId)
+	if len(stub.events) != 1 {
+		t.Fatalf("expected exactly one event, got %d", len(stub.events))
+	}
+}
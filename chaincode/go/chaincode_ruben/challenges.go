@@ -0,0 +1,441 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright Receivership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// =======One-time challenges ===============================================================
+// A PUF challenge may be used once. The chaincode keeps the SHA-256 hash of every
+// challenge it has consumed under Challenge~PUFId~ChallengeHash, so reuse is caught
+// whichever shard or transaction it comes from. A challenge is reserved for one
+// shard and PUF by addShard/addShards or by enrollPUFReference, which ties it to
+// the enrolled reference; the shard's verifyPUFResponse may then redeem it once.
+// verifyPUFResponse refuses any challenge not reserved that way.
+//
+// The challenges themselves never reach the ledger, only their hashes.
+// ===========================================================================================
+
+// challengeRecord marks a challenge hash as consumed
+type challengeRecord struct {
+	ObjectType	string    `json:"docType"`	// "challenge"
+	SchemaVersion	int 	  `json:"SchemaVersion"`
+	PUFId		string    `json:"PUFId"`
+	ChallengeHash	string    `json:"ChallengeHash"`	// hex SHA-256 of the challenge
+	ShardId		string    `json:"ShardId"`
+	ConsumedBy	string    `json:"ConsumedBy"`	// function that consumed it
+	TxId		string    `json:"TxId"`
+	RedeemedTxId	string    `json:"RedeemedTxId,omitempty"`	// verifyPUFResponse that used a reserved challenge
+}
+
+// challengeCounter tracks how many challenges of a PUF have been consumed
+type challengeCounter struct {
+	ObjectType	string    `json:"docType"`	// "challengeCounter"
+	SchemaVersion	int 	  `json:"SchemaVersion"`
+	PUFId		string    `json:"PUFId"`
+	Budget		int 	  `json:"Budget"`	// CRPs the device was enrolled with, 0 if unknown
+	Consumed	int 	  `json:"Consumed"`
+}
+
+// shardChallenge names a challenge reserved for a shard by addShard or addShards
+type shardChallenge struct {
+	PUFId		string    `json:"PUFId"`
+	ChallengeHash	string    `json:"ChallengeHash"`
+}
+
+// remainingChallenges is one element of the getRemainingChallenges result
+type remainingChallenges struct {
+	PUFId		string    `json:"PUFId"`
+	Budget		int 	  `json:"Budget"`
+	Consumed	int 	  `json:"Consumed"`
+	Remaining	*int 	  `json:"Remaining"`	// null while the Budget is unknown
+}
+
+const (
+	challengeIndexName   = "Challenge~PUFId~ChallengeHash"
+	challengeCounterName = "ChallengeCount~PUFId"
+)
+
+
+// ===========================================================
+// challengeSpender consumes challenges for one transaction. A transaction does
+// not read its own writes, so the counters and hashes it has already touched
+// are kept here and written once by flush.
+// ===========================================================
+type challengeSpender struct {
+	stub     shim.ChaincodeStubInterface
+	counters map[string]*challengeCounter
+	pufIds   []string
+	spent    map[string]bool
+}
+
+func newChallengeSpender(stub shim.ChaincodeStubInterface) *challengeSpender {
+	return &challengeSpender{
+		stub:     stub,
+		counters: map[string]*challengeCounter{},
+		spent:    map[string]bool{},
+	}
+}
+
+// consume records a challenge as used by shardId, refusing a challenge that was
+// consumed before or a PUF whose budget is exhausted
+func (c *challengeSpender) consume(pufId string, challengeHash string, shardId string, function string) error {
+	challengeHash, err := parseChallengeHash(challengeHash)
+	if err != nil {
+		return err
+	}
+	key, err := c.stub.CreateCompositeKey(challengeIndexName, []string{pufId, challengeHash})
+	if err != nil {
+		return err
+	}
+	if c.spent[key] {
+		return fmt.Errorf("challenge %s of PUF %s appears more than once", challengeHash, pufId)
+	}
+	recordAsBytes, err := c.stub.GetState(key)
+	if err != nil {
+		return fmt.Errorf("Failed to get challenge: %s", err.Error())
+	} else if recordAsBytes != nil {
+		return fmt.Errorf("challenge %s of PUF %s has already been consumed", challengeHash, pufId)
+	}
+
+	counter, err := c.counter(pufId)
+	if err != nil {
+		return err
+	}
+	if counter.Budget > 0 && counter.Consumed >= counter.Budget {
+		return fmt.Errorf("PUF %s has no challenges left: %d of %d consumed", pufId, counter.Consumed, counter.Budget)
+	}
+	counter.Consumed++
+
+	record := &challengeRecord{
+		ObjectType:    "challenge",
+		SchemaVersion: schemaVersions["challenge"],
+		PUFId:         pufId,
+		ChallengeHash: challengeHash,
+		ShardId:       shardId,
+		ConsumedBy:    function,
+		TxId:          c.stub.GetTxID(),
+	}
+	recordAsBytes, err = json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	c.spent[key] = true
+	return c.stub.PutState(key, recordAsBytes)
+}
+
+// counter returns the PUF's counter, loading it on first use
+func (c *challengeSpender) counter(pufId string) (*challengeCounter, error) {
+	if counter, ok := c.counters[pufId]; ok {
+		return counter, nil
+	}
+	counter, err := getChallengeCounter(c.stub, pufId)
+	if err != nil {
+		return nil, err
+	}
+	c.counters[pufId] = counter
+	c.pufIds = append(c.pufIds, pufId)
+	return counter, nil
+}
+
+// flush writes the counters the transaction changed
+func (c *challengeSpender) flush() error {
+	for _, pufId := range c.pufIds {
+		err := putChallengeCounter(c.stub, c.counters[pufId])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+
+// ===========================================================
+// useChallenge redeems the challenge a verifyPUFResponse was answered with. It
+// must have been reserved for this shard and PUF and not redeemed before.
+// ===========================================================
+func useChallenge(stub shim.ChaincodeStubInterface, shardId string, pufId string, challengeHash string) error {
+	challengeHash, err := parseChallengeHash(challengeHash)
+	if err != nil {
+		return err
+	}
+	key, record, err := getChallengeRecord(stub, pufId, challengeHash)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return fmt.Errorf("challenge %s of PUF %s is not reserved for shard %s", challengeHash, pufId, shardId)
+	}
+	err = checkReservedChallenge(record, shardId)
+	if err != nil {
+		return err
+	}
+	record.RedeemedTxId = stub.GetTxID()
+	recordAsBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, recordAsBytes)
+}
+
+// reserveEnrolledChallenge reserves the challenge a reference answers for the
+// shard, unless addShard or addShards already did
+func reserveEnrolledChallenge(stub shim.ChaincodeStubInterface, shardId string, pufId string, challengeHash string) error {
+	_, record, err := getChallengeRecord(stub, pufId, challengeHash)
+	if err != nil {
+		return err
+	}
+	if record != nil {
+		return checkReservedChallenge(record, shardId)
+	}
+	spender := newChallengeSpender(stub)
+	err = spender.consume(pufId, challengeHash, shardId, "enrollPUFReference")
+	if err != nil {
+		return err
+	}
+	return spender.flush()
+}
+
+// checkReservedChallenge refuses a challenge reserved for another shard, or
+// already redeemed
+func checkReservedChallenge(record *challengeRecord, shardId string) error {
+	if record.ShardId != shardId || record.ConsumedBy == "verifyPUFResponse" || record.RedeemedTxId != "" {
+		return fmt.Errorf("challenge %s of PUF %s has already been consumed", record.ChallengeHash, record.PUFId)
+	}
+	return nil
+}
+
+// getChallengeRecord loads the record of a consumed challenge, nil if it was never consumed
+func getChallengeRecord(stub shim.ChaincodeStubInterface, pufId string, challengeHash string) (string, *challengeRecord, error) {
+	key, err := stub.CreateCompositeKey(challengeIndexName, []string{pufId, challengeHash})
+	if err != nil {
+		return "", nil, err
+	}
+	recordAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to get challenge: %s", err.Error())
+	} else if recordAsBytes == nil {
+		return key, nil, nil
+	}
+	record := &challengeRecord{}
+	err = json.Unmarshal(recordAsBytes, record)
+	if err != nil {
+		return "", nil, err
+	}
+	err = upgradeSchema(record.ObjectType, &record.SchemaVersion)
+	if err != nil {
+		return "", nil, err
+	}
+	return key, record, nil
+}
+
+// reserveChallenges consumes the challenges addShard or addShards reserve for a
+// shard. A shard with PUFIds only reserves challenges of those PUFs.
+func reserveChallenges(spender *challengeSpender, s *shard, challenges []shardChallenge, function string) error {
+	for _, challenge := range challenges {
+		if len(challenge.PUFId) <= 0 {
+			return fmt.Errorf("every challenge must name its PUFId")
+		}
+		if len(s.PUFIds) > 0 && !containsString(s.PUFIds, challenge.PUFId) {
+			return fmt.Errorf("challenge %s is for PUF %s, which is not one of the PUFIds of shard %s", challenge.ChallengeHash, challenge.PUFId, s.ShardId)
+		}
+		err := spender.consume(challenge.PUFId, challenge.ChallengeHash, s.ShardId, function)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseChallengeHash checks a hex SHA-256 challenge hash and returns it in lower case
+func parseChallengeHash(challengeHash string) (string, error) {
+	digest, err := hex.DecodeString(challengeHash)
+	if err != nil || len(digest) != sha256.Size {
+		return "", fmt.Errorf("challenge hash must be a hex SHA-256 digest")
+	}
+	return hex.EncodeToString(digest), nil
+}
+
+// getChallengeCounter loads a PUF's counter, starting a new one for an unseen PUF
+func getChallengeCounter(stub shim.ChaincodeStubInterface, pufId string) (*challengeCounter, error) {
+	key, err := stub.CreateCompositeKey(challengeCounterName, []string{pufId})
+	if err != nil {
+		return nil, err
+	}
+	counterAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get challenge counter: %s", err.Error())
+	}
+	counter := &challengeCounter{
+		ObjectType:    "challengeCounter",
+		SchemaVersion: schemaVersions["challengeCounter"],
+		PUFId:         pufId,
+	}
+	if counterAsBytes == nil {
+		return counter, nil
+	}
+	err = json.Unmarshal(counterAsBytes, counter)
+	if err != nil {
+		return nil, err
+	}
+	err = upgradeSchema(counter.ObjectType, &counter.SchemaVersion)
+	if err != nil {
+		return nil, err
+	}
+	return counter, nil
+}
+
+// putChallengeCounter saves a PUF's counter
+func putChallengeCounter(stub shim.ChaincodeStubInterface, counter *challengeCounter) error {
+	key, err := stub.CreateCompositeKey(challengeCounterName, []string{counter.PUFId})
+	if err != nil {
+		return err
+	}
+	counterAsBytes, err := json.Marshal(counter)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, counterAsBytes)
+}
+
+// newRemainingChallenges reports a counter
+func newRemainingChallenges(counter *challengeCounter) remainingChallenges {
+	remaining := remainingChallenges{
+		PUFId:    counter.PUFId,
+		Budget:   counter.Budget,
+		Consumed: counter.Consumed,
+	}
+	if counter.Budget > 0 {
+		left := counter.Budget - counter.Consumed
+		remaining.Remaining = &left
+	}
+	return remaining
+}
+
+
+// ============================================================
+// setChallengeBudget - set the challenge budget of a registered PUF, which
+// registerPUF started at its CRPCount. Consumption stops once it is spent.
+// Only the org that registered the PUF, or an admin, may set it, and the budget
+// stays between what was already consumed and the CRPCount.
+// ============================================================
+func (t *SimpleChaincode) setChallengeBudget(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1
+	// "PUFId", "Budget"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2(PUFId, Budget)")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	budget, err := strconv.Atoi(args[1])
+	if err != nil || budget <= 0 {
+		return shim.Error("2nd argument must be a positive numeric string")
+	}
+
+	p, err := getPUF(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error() + ": " + args[0])
+	}
+	caller, err := getCallerRoles(stub)
+	if err != nil {
+		return shim.Error("Failed to get caller identity: " + err.Error())
+	}
+	if caller.MSPID != p.OwnerMSP && !containsString(caller.Roles, roleAdmin) {
+		return shim.Error("PUF " + args[0] + " belongs to " + p.OwnerMSP + ", not " + caller.MSPID)
+	}
+	if budget > p.CRPCount {
+		return shim.Error(fmt.Sprintf("PUF %s was registered with %d CRPs, the budget cannot exceed them", args[0], p.CRPCount))
+	}
+
+	counter, err := getChallengeCounter(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if budget < counter.Consumed {
+		return shim.Error(fmt.Sprintf("PUF %s has already consumed %d challenges", args[0], counter.Consumed))
+	}
+	counter.Budget = budget
+	err = putChallengeCounter(stub, counter)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	remainingAsBytes, err := json.Marshal(newRemainingChallenges(counter))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(remainingAsBytes)
+}
+
+
+// ============================================================
+// getRemainingChallenges - report, for the given PUFs or for every PUF that has
+// a counter, how many challenges were consumed and how many are left
+// ============================================================
+func (t *SimpleChaincode) getRemainingChallenges(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	items := []remainingChallenges{}
+	if len(args) > 0 {
+		for _, pufId := range args {
+			if len(pufId) <= 0 {
+				return queryError("PUFId must be a non-empty string")
+			}
+			counter, err := getChallengeCounter(stub, pufId)
+			if err != nil {
+				return queryError(err.Error())
+			}
+			items = append(items, newRemainingChallenges(counter))
+		}
+	} else {
+		resultsIterator, err := stub.GetStateByPartialCompositeKey(challengeCounterName, []string{})
+		if err != nil {
+			return queryError(err.Error())
+		}
+		defer resultsIterator.Close()
+		for resultsIterator.HasNext() {
+			queryResponse, err := resultsIterator.Next()
+			if err != nil {
+				return queryError(err.Error())
+			}
+			counter := &challengeCounter{}
+			err = json.Unmarshal(queryResponse.Value, counter)
+			if err != nil {
+				return queryError(err.Error())
+			}
+			items = append(items, newRemainingChallenges(counter))
+		}
+	}
+
+	queryResults, err := newQueryResponse(items, nil)
+	if err != nil {
+		return queryError(err.Error())
+	}
+	return shim.Success(queryResults)
+}
@@ -0,0 +1,135 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright Receivership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// chaincodeConfig holds the settings the network operator passes to Init when the
+// chaincode is instantiated or upgraded, as key=value arguments
+type chaincodeConfig struct {
+	ObjectType		string    `json:"docType"`	// "config"
+	SchemaVersion		int 	  `json:"SchemaVersion"`
+	RawQueriesEnabled	bool      `json:"RawQueriesEnabled"`	// rawQueries=false disables queryShards and queryShardsWithPagination
+	MSPRoles		map[string][]string `json:"MSPRoles,omitempty"`	// roles=Org1MSP:uploader|receiver grants roles to every identity of an MSP
+}
+
+// configObjectType is the composite key the configuration is stored under
+const configObjectType = "Config"
+
+// defaultConfig is used until Init stores a configuration
+func defaultConfig() *chaincodeConfig {
+	return &chaincodeConfig{
+		ObjectType:        "config",
+		SchemaVersion:     schemaVersions["config"],
+		RawQueriesEnabled: true,
+	}
+}
+
+
+// ===========================================================
+// initConfig parses the Init arguments on top of the stored (or default)
+// configuration and saves the result
+// ===========================================================
+func initConfig(stub shim.ChaincodeStubInterface, args []string) error {
+	config, err := getConfig(stub)
+	if err != nil {
+		return err
+	}
+
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("Init argument %q must be of the form key=value", arg)
+		}
+		switch kv[0] {
+		case "rawQueries":
+			config.RawQueriesEnabled, err = strconv.ParseBool(kv[1])
+			if err != nil {
+				return fmt.Errorf("rawQueries must be true or false")
+			}
+		case "roles":
+			mspID, roles, err := parseMSPRoles(kv[1])
+			if err != nil {
+				return err
+			}
+			if config.MSPRoles == nil {
+				config.MSPRoles = map[string][]string{}
+			}
+			if len(roles) == 0 {
+				delete(config.MSPRoles, mspID)
+			} else {
+				config.MSPRoles[mspID] = roles
+			}
+		default:
+			return fmt.Errorf("unknown Init argument %q", kv[0])
+		}
+	}
+
+	return putConfig(stub, config)
+}
+
+// ===========================================================
+// getConfig loads the chaincode configuration, falling back to the defaults
+// ===========================================================
+func getConfig(stub shim.ChaincodeStubInterface) (*chaincodeConfig, error) {
+	configKey, err := stub.CreateCompositeKey(configObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	configAsBytes, err := stub.GetState(configKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get config: %s", err.Error())
+	} else if configAsBytes == nil {
+		return defaultConfig(), nil
+	}
+
+	config := defaultConfig()
+	err = json.Unmarshal(configAsBytes, config)
+	if err != nil {
+		return nil, err
+	}
+	err = upgradeSchema(config.ObjectType, &config.SchemaVersion)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ===========================================================
+// putConfig saves the chaincode configuration
+// ===========================================================
+func putConfig(stub shim.ChaincodeStubInterface, config *chaincodeConfig) error {
+	configKey, err := stub.CreateCompositeKey(configObjectType, []string{})
+	if err != nil {
+		return err
+	}
+	configAsBytes, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(configKey, configAsBytes)
+}
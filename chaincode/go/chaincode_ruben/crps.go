@@ -0,0 +1,279 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright Receivership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// crpsHash is the public trace of the challenge/response material kept in a
+// receiver org's private data collection
+type crpsHash struct {
+	ObjectType	string    `json:"docType"`	// "crpsHash"
+	SchemaVersion	int 	  `json:"SchemaVersion"`
+	ShardId		string    `json:"ShardId"`
+	MSPID		string    `json:"MSPID"`	// receiver org holding the material
+	Collection	string    `json:"Collection"`
+	Hash		string    `json:"Hash"`	// hex SHA-256 of the material
+	Sender		string    `json:"Sender"`
+	TxId		string    `json:"TxId"`
+}
+
+// crpsVerification is returned by verifyCRPs
+type crpsVerification struct {
+	ShardId		string    `json:"ShardId"`
+	MSPID		string    `json:"MSPID"`
+	Hash		string    `json:"Hash"`
+	Match		bool      `json:"Match"`
+}
+
+const (
+	crpsHashIndexName = "CRPsHash~ShardId~MSPID"
+
+	// crpsTransientKey is the transient map entry carrying the material, e.g. the
+	// cipherCRPs file written by File_Operation/1-3ShardId_DataId.go
+	crpsTransientKey = "crps"
+
+	// crpsCollectionPrefix + MSP ID names each org's collection in collections_config.json
+	crpsCollectionPrefix = "collectionCRPs"
+)
+
+
+// ============================================================
+// putCRPs - store a shard's challenge/response material in the receiver org's
+// private data collection and its hash on the public ledger.
+// The material is passed in the transient map under "crps" so it never
+// appears in the transaction. Only the shard's Sender may store it, and only
+// in the collection of its Receiver's MSP.
+// ============================================================
+func (t *SimpleChaincode) putCRPs(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0          1
+	// "ShardId", "Org2MSP"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2(ShardId, receiver MSPID)")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+	shardId := args[0]
+	mspID := args[1]
+	fmt.Println("- start putCRPs ", shardId, mspID)
+
+	material, err := getTransientCRPs(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	caller, err := getCaller(stub)
+	if err != nil {
+		return shim.Error("Failed to get caller identity: " + err.Error())
+	}
+	shardJSON, err := getShard(stub, shardId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !caller.is(shardJSON.Sender, shardJSON.SenderMSP) {
+		return shim.Error("Caller " + caller.String() + " is not the Sender of shard " + shardId)
+	}
+	if mspID != shardJSON.ReceiverMSP {
+		return shim.Error("2nd argument " + mspID + " is not the MSP of the Receiver of shard " + shardId)
+	}
+	err = checkShardStatus(shardJSON, "putCRPs", statusCreated, statusAssigned)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	hashKey, err := stub.CreateCompositeKey(crpsHashIndexName, []string{shardId, mspID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	hashAsBytes, err := stub.GetState(hashKey)
+	if err != nil {
+		return shim.Error("Failed to get CRPs hash: " + err.Error())
+	} else if hashAsBytes != nil {
+		return shim.Error("CRPs for shard " + shardId + " are already stored for " + mspID)
+	}
+
+	// ==== Material goes to the org's collection, only its hash to the ledger ====
+	collection := crpsCollectionPrefix + mspID
+	err = stub.PutPrivateData(collection, shardId, material)
+	if err != nil {
+		return shim.Error("Failed to put private data in " + collection + ": " + err.Error())
+	}
+
+	digest := sha256.Sum256(material)
+	record := &crpsHash{
+		ObjectType:    "crpsHash",
+		SchemaVersion: schemaVersions["crpsHash"],
+		ShardId:       shardId,
+		MSPID:         mspID,
+		Collection:    collection,
+		Hash:          hex.EncodeToString(digest[:]),
+		Sender:        caller.Name,
+		TxId:          stub.GetTxID(),
+	}
+	recordAsBytes, err := json.Marshal(record)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(hashKey, recordAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end putCRPs (success)")
+	return shim.Success(nil)
+}
+
+
+// ============================================================
+// getCRPs - read a shard's challenge/response material from the caller's own
+// org collection. Must be sent to a peer of that org.
+// ============================================================
+func (t *SimpleChaincode) getCRPs(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1(ShardId)")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	shardId := args[0]
+
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error("Failed to get caller MSP ID: " + err.Error())
+	}
+
+	collection := crpsCollectionPrefix + mspID
+	material, err := stub.GetPrivateData(collection, shardId)
+	if err != nil {
+		return shim.Error("Failed to get private data from " + collection + ": " + err.Error())
+	} else if material == nil {
+		return shim.Error("no CRPs for shard " + shardId + " in " + collection)
+	}
+
+	return shim.Success(material)
+}
+
+
+// ============================================================
+// getCRPsHash - read the public hash of a shard's challenge/response material
+// ============================================================
+func (t *SimpleChaincode) getCRPsHash(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2(ShardId, receiver MSPID)")
+	}
+
+	record, err := getCRPsHashRecord(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	recordAsBytes, err := json.Marshal(record)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(recordAsBytes)
+}
+
+
+// ============================================================
+// verifyCRPs - check material passed in the transient map under "crps"
+// against the public hash. Anyone may verify.
+// ============================================================
+func (t *SimpleChaincode) verifyCRPs(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2(ShardId, receiver MSPID)")
+	}
+
+	material, err := getTransientCRPs(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	record, err := getCRPsHashRecord(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	digest := sha256.Sum256(material)
+	result := &crpsVerification{
+		ShardId: record.ShardId,
+		MSPID:   record.MSPID,
+		Hash:    record.Hash,
+		Match:   hex.EncodeToString(digest[:]) == record.Hash,
+	}
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(resultAsBytes)
+}
+
+
+// getTransientCRPs returns the material passed in the transient map
+func getTransientCRPs(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	transientMap, err := stub.GetTransient()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get transient map: %s", err.Error())
+	}
+	material, ok := transientMap[crpsTransientKey]
+	if !ok || len(material) == 0 {
+		return nil, fmt.Errorf("the CRPs must be passed in the transient map under %q", crpsTransientKey)
+	}
+	return material, nil
+}
+
+// getCRPsHashRecord loads the public hash record of a shard's material
+func getCRPsHashRecord(stub shim.ChaincodeStubInterface, shardId string, mspID string) (*crpsHash, error) {
+	hashKey, err := stub.CreateCompositeKey(crpsHashIndexName, []string{shardId, mspID})
+	if err != nil {
+		return nil, err
+	}
+	hashAsBytes, err := stub.GetState(hashKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get CRPs hash: %s", err.Error())
+	} else if hashAsBytes == nil {
+		return nil, fmt.Errorf("no CRPs hash for shard %s and %s", shardId, mspID)
+	}
+
+	record := &crpsHash{}
+	err = json.Unmarshal(hashAsBytes, record)
+	if err != nil {
+		return nil, err
+	}
+	err = upgradeSchema(record.ObjectType, &record.SchemaVersion)
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
@@ -0,0 +1,270 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright Receivership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// data is the file a set of shards was cut from
+type data struct {
+	ObjectType	string    `json:"docType"`	// "data"
+	SchemaVersion	int 	  `json:"SchemaVersion"`
+	DataId		string    `json:"DataId"`
+	Owner		string    `json:"Owner"`	// caller that registered the file, the Sender of all its shards
+	OwnerMSP	string    `json:"OwnerMSP,omitempty"`	// MSP of that caller
+	ShardCount	int 	  `json:"ShardCount"`
+	ShardIds	[]string  `json:"ShardIds"`	// in the order the file was split
+	TotalSize	int64 	  `json:"TotalSize"`	// bytes
+	ShardsAdded	int 	  `json:"ShardsAdded"`
+	Complete	bool 	  `json:"Complete"`	// every shard in ShardIds has been added
+}
+
+// dataObjectType is the composite key data documents are stored under
+const dataObjectType = "Data"
+
+
+// ============================================================
+// registerData - record a file before its shards are added
+// ============================================================
+func (t *SimpleChaincode) registerData(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0         1             2                      3
+	// "DataId", "ShardCount", "[\"ShardId\", ...]", "TotalSize"
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4(DataId, ShardCount, ShardIds, TotalSize)")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	dataId := strings.ToLower(args[0])
+	shardCount, err := strconv.Atoi(args[1])
+	if err != nil || shardCount <= 0 {
+		return shim.Error("2nd argument must be a positive numeric string")
+	}
+	shardIds := []string{}
+	err = json.Unmarshal([]byte(args[2]), &shardIds)
+	if err != nil {
+		return shim.Error("3rd argument must be a JSON array of ShardIds")
+	}
+	if len(shardIds) != shardCount {
+		return shim.Error("3rd argument must list exactly ShardCount=" + strconv.Itoa(shardCount) + " ShardIds")
+	}
+	seen := map[string]bool{}
+	for _, shardId := range shardIds {
+		if len(shardId) <= 0 {
+			return shim.Error("ShardIds must be non-empty strings")
+		}
+		if seen[shardId] {
+			return shim.Error("ShardId " + shardId + " is listed twice")
+		}
+		seen[shardId] = true
+	}
+	totalSize, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil || totalSize < 0 {
+		return shim.Error("4th argument must be a non-negative numeric string")
+	}
+	fmt.Println("- start registerData ", dataId)
+
+	owner, err := getCaller(stub)
+	if err != nil {
+		return shim.Error("Failed to get caller identity: " + err.Error())
+	}
+
+	existing, err := getData(stub, dataId)
+	if err == nil && existing != nil {
+		return shim.Error("This data already exists: " + dataId)
+	} else if err != nil && err != errDataNotFound {
+		return shim.Error(err.Error())
+	}
+
+	d := &data{
+		ObjectType:    "data",
+		SchemaVersion: schemaVersions["data"],
+		DataId:        dataId,
+		Owner:         owner.Name,
+		OwnerMSP:      owner.MSPID,
+		ShardCount:    shardCount,
+		ShardIds:      shardIds,
+		TotalSize:     totalSize,
+	}
+	err = chargeQuota(stub, 0, totalSize)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = putData(stub, d)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end registerData (success)")
+	return shim.Success(nil)
+}
+
+
+// ============================================================
+// getData - read a data document
+// ============================================================
+func (t *SimpleChaincode) getData(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting DataId of the data to query")
+	}
+
+	d, err := getData(stub, strings.ToLower(args[0]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	dataAsBytes, err := json.Marshal(d)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(dataAsBytes)
+}
+
+
+// ============================================================
+// getShardsForData - return the shards of a file in the order it was split.
+// Shards that have not been added yet are returned with a null Record.
+// ============================================================
+func (t *SimpleChaincode) getShardsForData(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return queryError("Incorrect number of arguments. Expecting 1")
+	}
+
+	d, err := getData(stub, strings.ToLower(args[0]))
+	if err != nil {
+		return queryError(err.Error())
+	}
+
+	records := []queryRecord{}
+	for _, shardId := range d.ShardIds {
+		shardAsBytes, err := stub.GetState(shardId)
+		if err != nil {
+			return queryError("Failed to get shard: " + err.Error())
+		}
+		record := json.RawMessage("null")
+		if shardAsBytes != nil {
+			record, err = shardRecord(shardAsBytes)
+			if err != nil {
+				return queryError(err.Error())
+			}
+		}
+		records = append(records, queryRecord{Key: shardId, Record: record})
+	}
+
+	queryResults, err := newQueryResponse(records, nil)
+	if err != nil {
+		return queryError(err.Error())
+	}
+	return shim.Success(queryResults)
+}
+
+
+// errDataNotFound is returned by getData for an unknown DataId
+var errDataNotFound = fmt.Errorf("data does not exist")
+
+// ============================================================
+// getData loads and decodes a data document
+// ============================================================
+func getData(stub shim.ChaincodeStubInterface, dataId string) (*data, error) {
+	dataKey, err := stub.CreateCompositeKey(dataObjectType, []string{dataId})
+	if err != nil {
+		return nil, err
+	}
+	dataAsBytes, err := stub.GetState(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get data: %s", err.Error())
+	} else if dataAsBytes == nil {
+		return nil, errDataNotFound
+	}
+
+	d := &data{}
+	err = json.Unmarshal(dataAsBytes, d)
+	if err != nil {
+		return nil, err
+	}
+	err = upgradeSchema(d.ObjectType, &d.SchemaVersion)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// ============================================================
+// putData saves a data document
+// ============================================================
+func putData(stub shim.ChaincodeStubInterface, d *data) error {
+	dataKey, err := stub.CreateCompositeKey(dataObjectType, []string{d.DataId})
+	if err != nil {
+		return err
+	}
+	dataAsBytes, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(dataKey, dataAsBytes)
+}
+
+// ============================================================
+// checkShardForData makes sure a shard may be added to its file: the DataId must be
+// registered and not yet complete, list the ShardId, and be owned by the shard's Sender
+// ============================================================
+func checkShardForData(d *data, s *shard) error {
+	if d.Complete {
+		return fmt.Errorf("data %s is already complete", d.DataId)
+	}
+	if !containsString(d.ShardIds, s.ShardId) {
+		return fmt.Errorf("shard %s is not one of the ShardIds of data %s", s.ShardId, d.DataId)
+	}
+	if d.Owner != s.Sender || len(d.OwnerMSP) <= 0 || d.OwnerMSP != s.SenderMSP {
+		return fmt.Errorf("Sender %s of %s does not own data %s", s.Sender, s.SenderMSP, d.DataId)
+	}
+	return nil
+}
+
+// ============================================================
+// addShardToData counts a newly added shard towards its file
+// ============================================================
+func addShardToData(stub shim.ChaincodeStubInterface, d *data) error {
+	d.ShardsAdded++
+	d.Complete = d.ShardsAdded >= d.ShardCount
+	return putData(stub, d)
+}
+
+// ============================================================
+// removeShardFromData uncounts a deleted shard, leaving its file incomplete
+// ============================================================
+func removeShardFromData(stub shim.ChaincodeStubInterface, dataId string) error {
+	d, err := getData(stub, dataId)
+	if err == errDataNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	d.ShardsAdded--
+	d.Complete = false
+	return putData(stub, d)
+}
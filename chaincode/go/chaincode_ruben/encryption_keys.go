@@ -0,0 +1,378 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright Receivership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// encryptionKey is the ECC public key an identity publishes so senders can
+// encrypt CRPs for it (File_Operation/1-3ShardId_DataId.go). OwnerMSP and Owner
+// are the identity's MSP ID and common name, as in a shard's ReceiverMSP and
+// Receiver; the key is stored under both, so an identity of one org cannot
+// publish a key for a same-named identity of another.
+type encryptionKey struct {
+	ObjectType	string    `json:"docType"`	// "encryptionKey"
+	SchemaVersion	int 	  `json:"SchemaVersion"`
+	Owner		string    `json:"Owner"`	// peer11.org1
+	OwnerMSP	string    `json:"OwnerMSP"`
+	PublicKey	string    `json:"PublicKey"`	// PEM encoded PKIX ECC public key
+	Fingerprint	string    `json:"Fingerprint"`	// hex SHA-256 of the DER encoded key
+	Signature	string    `json:"Signature"`	// base64 ECDSA signature of PublicKey by the Owner's enrollment key
+	Certificate	string    `json:"Certificate,omitempty"`	// PEM enrollment certificate of the Owner, to check Signature against
+	Version		int 	  `json:"Version"`	// 1 for the first key, incremented by every publish or rotation
+	PrevFingerprint	string    `json:"PrevFingerprint,omitempty"`	// key replaced by the last rotateKey
+	PublishedAt	string    `json:"PublishedAt"`	// transaction timestamp, RFC 3339
+	TxId		string    `json:"TxId"`
+	Status		string    `json:"Status"`	// "active" or "revoked"
+	RevokedBy	string    `json:"RevokedBy,omitempty"`
+	RevokedAt	string    `json:"RevokedAt,omitempty"`
+	RevokeReason	string    `json:"RevokeReason,omitempty"`
+}
+
+const (
+	encryptionKeyObjectType = "EncryptionKey~MSPID~Owner"
+
+	keyStatusActive  = "active"
+	keyStatusRevoked = "revoked"
+)
+
+// ecdsaSignature is the ASN.1 form of an ECDSA signature
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+
+// ============================================================
+// publishKey - publish the caller's encryption public key. The caller signs the
+// PEM text with its enrollment key, so the record can be checked against the
+// identity's certificate. A revoked key may be replaced this way; an active one
+// has to be rotated.
+// ============================================================
+func (t *SimpleChaincode) publishKey(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0            1
+	// "PublicKey", "Signature"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2(PublicKey, Signature)")
+	}
+	fmt.Println("- start publishKey")
+
+	k, err := newEncryptionKey(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	owner := identity{MSPID: k.OwnerMSP, Name: k.Owner}
+	existing, err := getEncryptionKey(stub, &owner)
+	if err == nil {
+		if existing.Status == keyStatusActive {
+			return shim.Error("identity " + owner.String() + " already has an active key, use rotateKey to replace it")
+		}
+		k.Version = existing.Version + 1
+		k.PrevFingerprint = existing.Fingerprint
+	} else if err != errKeyNotFound {
+		return shim.Error(err.Error())
+	}
+
+	keyAsBytes, err := putEncryptionKey(stub, k)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end publishKey (success)")
+	return shim.Success(keyAsBytes)
+}
+
+
+// ============================================================
+// rotateKey - replace the caller's active encryption public key with a new one
+// ============================================================
+func (t *SimpleChaincode) rotateKey(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0            1
+	// "PublicKey", "Signature"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2(PublicKey, Signature)")
+	}
+	fmt.Println("- start rotateKey")
+
+	k, err := newEncryptionKey(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	owner := identity{MSPID: k.OwnerMSP, Name: k.Owner}
+	existing, err := getEncryptionKey(stub, &owner)
+	if err != nil {
+		return shim.Error(err.Error() + ": " + owner.String())
+	}
+	if existing.Status != keyStatusActive {
+		return shim.Error("key of " + owner.String() + " is " + existing.Status + ", use publishKey to publish a new one")
+	}
+	if existing.Fingerprint == k.Fingerprint {
+		return shim.Error("the new key is the same as the current key of " + owner.String())
+	}
+	k.Version = existing.Version + 1
+	k.PrevFingerprint = existing.Fingerprint
+
+	keyAsBytes, err := putEncryptionKey(stub, k)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end rotateKey (success)")
+	return shim.Success(keyAsBytes)
+}
+
+
+// ============================================================
+// revokeKey - withdraw an encryption public key so no more CRPs are encrypted
+// for it. Identities revoke their own key; an admin may name another Owner of
+// its own org, as MSPID:name.
+// ============================================================
+func (t *SimpleChaincode) revokeKey(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0         1
+	// "Reason", "MSPID:name"(optional)
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2(Reason, Owner)")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	caller, err := getCallerRoles(stub)
+	if err != nil {
+		return shim.Error("Failed to get caller identity: " + err.Error())
+	}
+	owner := &caller.identity
+	if len(args) == 2 {
+		owner, err = parseIdentity(args[1])
+		if err != nil {
+			return shim.Error("2nd argument " + err.Error())
+		}
+	}
+	if !caller.is(owner.Name, owner.MSPID) {
+		if !containsString(caller.Roles, roleAdmin) {
+			return shim.Error("Caller " + caller.String() + " may only revoke its own key")
+		}
+		if owner.MSPID != caller.MSPID {
+			return shim.Error("Caller " + caller.String() + " may only revoke keys of " + caller.MSPID)
+		}
+	}
+	fmt.Println("- start revokeKey ", owner.String())
+
+	k, err := getEncryptionKey(stub, owner)
+	if err != nil {
+		return shim.Error(err.Error() + ": " + owner.String())
+	}
+	if k.Status == keyStatusRevoked {
+		return shim.Error("key of " + owner.String() + " is already revoked")
+	}
+
+	revokedAt, err := getTxTimestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	k.Status = keyStatusRevoked
+	k.RevokedBy = caller.Name
+	k.RevokedAt = revokedAt
+	k.RevokeReason = args[0]
+	keyAsBytes, err := putEncryptionKey(stub, k)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end revokeKey (success)")
+	return shim.Success(keyAsBytes)
+}
+
+
+// ============================================================
+// getPublicKey - read an identity's current encryption public key, naming the
+// identity as MSPID:name like a shard's Receiver. Revoked keys are returned too;
+// callers must check Status before encrypting.
+// ============================================================
+func (t *SimpleChaincode) getPublicKey(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "MSPID:name"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1(Owner)")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	owner, err := parseIdentity(args[0])
+	if err != nil {
+		return shim.Error("1st argument " + err.Error())
+	}
+
+	k, err := getEncryptionKey(stub, owner)
+	if err != nil {
+		return shim.Error(err.Error() + ": " + owner.String())
+	}
+	keyAsBytes, err := json.Marshal(k)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(keyAsBytes)
+}
+
+
+// ============================================================
+// newEncryptionKey checks a key submitted by the caller and the caller's
+// signature of it, and builds an active version 1 record for it
+// ============================================================
+func newEncryptionKey(stub shim.ChaincodeStubInterface, publicKeyPEM string, signature string) (*encryptionKey, error) {
+	if len(publicKeyPEM) <= 0 {
+		return nil, fmt.Errorf("1st argument must be a non-empty string")
+	}
+	if len(signature) <= 0 {
+		return nil, fmt.Errorf("2nd argument must be a non-empty string")
+	}
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("1st argument must be a PEM encoded public key")
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("1st argument must be a PKIX public key: %s", err.Error())
+	}
+	if _, ok := publicKey.(*ecdsa.PublicKey); !ok {
+		return nil, fmt.Errorf("1st argument must be an ECC public key")
+	}
+
+	cert, err := cid.GetX509Certificate(stub)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get caller certificate: %s", err.Error())
+	}
+	err = verifyKeySignature(cert, publicKeyPEM, signature)
+	if err != nil {
+		return nil, err
+	}
+
+	owner, err := getCaller(stub)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get caller identity: %s", err.Error())
+	}
+	publishedAt, err := getTxTimestamp(stub)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := sha256.Sum256(block.Bytes)
+
+	return &encryptionKey{
+		ObjectType:    "encryptionKey",
+		SchemaVersion: schemaVersions["encryptionKey"],
+		Owner:         owner.Name,
+		OwnerMSP:      owner.MSPID,
+		PublicKey:     publicKeyPEM,
+		Fingerprint:   hex.EncodeToString(fingerprint[:]),
+		Signature:     signature,
+		Certificate:   string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+		Version:       1,
+		PublishedAt:   publishedAt,
+		TxId:          stub.GetTxID(),
+		Status:        keyStatusActive,
+	}, nil
+}
+
+// verifyKeySignature checks a base64 ASN.1 ECDSA signature of the SHA-256 of
+// the PEM text against the public key of the signer's certificate
+func verifyKeySignature(cert *x509.Certificate, publicKeyPEM string, signature string) error {
+	signerKey, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("caller certificate does not hold an ECDSA key")
+	}
+	der, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("2nd argument must be a base64 signature")
+	}
+	sig := &ecdsaSignature{}
+	rest, err := asn1.Unmarshal(der, sig)
+	if err != nil || len(rest) > 0 || sig.R == nil || sig.S == nil {
+		return fmt.Errorf("2nd argument must be an ASN.1 ECDSA signature")
+	}
+	digest := sha256.Sum256([]byte(publicKeyPEM))
+	if !ecdsa.Verify(signerKey, digest[:], sig.R, sig.S) {
+		return fmt.Errorf("signature does not match the public key and the caller's certificate")
+	}
+	return nil
+}
+
+
+// errKeyNotFound is returned by getEncryptionKey for an identity without a key
+var errKeyNotFound = fmt.Errorf("no encryption key published")
+
+// ============================================================
+// getEncryptionKey loads and decodes an identity's encryption key
+// ============================================================
+func getEncryptionKey(stub shim.ChaincodeStubInterface, owner *identity) (*encryptionKey, error) {
+	keyKey, err := stub.CreateCompositeKey(encryptionKeyObjectType, []string{owner.MSPID, owner.Name})
+	if err != nil {
+		return nil, err
+	}
+	keyAsBytes, err := stub.GetState(keyKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get encryption key: %s", err.Error())
+	} else if keyAsBytes == nil {
+		return nil, errKeyNotFound
+	}
+
+	k := &encryptionKey{}
+	err = json.Unmarshal(keyAsBytes, k)
+	if err != nil {
+		return nil, err
+	}
+	err = upgradeSchema(k.ObjectType, &k.SchemaVersion)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// ============================================================
+// putEncryptionKey saves an encryption key and returns what was stored. Earlier
+// versions stay in the key's history.
+// ============================================================
+func putEncryptionKey(stub shim.ChaincodeStubInterface, k *encryptionKey) ([]byte, error) {
+	keyKey, err := stub.CreateCompositeKey(encryptionKeyObjectType, []string{k.OwnerMSP, k.Owner})
+	if err != nil {
+		return nil, err
+	}
+	keyAsBytes, err := json.Marshal(k)
+	if err != nil {
+		return nil, err
+	}
+	return keyAsBytes, stub.PutState(keyKey, keyAsBytes)
+}
@@ -0,0 +1,231 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright Receivership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/statebased"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// =======Key-level endorsement ============================================================
+// Every shard key carries a state-based endorsement policy requiring a peer of
+// the Sender's org and a peer of the Receiver's org, so no other org can endorse
+// changes to it on its own. The policy replaces the chaincode-wide one for that
+// key only; like any write, changing it must satisfy the policy it replaces, so a
+// transfer has to be endorsed by the old Receiver's org too.
+//
+// The Sender's MSP ID is taken from its certificate when it adds the shard, which
+// only the Sender may do; the Receiver's is given with its name as MSPID:name to
+// addShard and transferShard. A shard missing either is not written with a
+// policy of fewer orgs: the write fails instead.
+// ===========================================================================================
+
+// shardEndorsement is returned by getShardEndorsement and setShardEndorsement
+type shardEndorsement struct {
+	ShardId		string    `json:"ShardId"`
+	Orgs		[]string  `json:"Orgs"`	// MSP IDs whose peers must all endorse, sorted
+	KeyLevel	bool 	  `json:"KeyLevel"`	// false when the chaincode-wide policy applies, as for shards created before key-level policies
+}
+
+
+// ============================================================
+// getShardEndorsement - report which orgs must endorse changes to a shard
+// ============================================================
+func (t *SimpleChaincode) getShardEndorsement(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1(ShardId)")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	shardId := args[0]
+
+	shardAsBytes, err := stub.GetState(shardId)
+	if err != nil {
+		return shim.Error("Failed to get shard: " + err.Error())
+	} else if shardAsBytes == nil {
+		return shim.Error("shard does not exist: " + shardId)
+	}
+	endorsement, err := getShardEndorsement(stub, shardId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	endorsementAsBytes, err := json.Marshal(endorsement)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(endorsementAsBytes)
+}
+
+
+// ============================================================
+// setShardEndorsement - replace the orgs that must endorse changes to a shard,
+// or without a list reset them to the Sender's and Receiver's orgs. Only an
+// admin may call it, since a list may leave out the Sender's or Receiver's org.
+// ============================================================
+func (t *SimpleChaincode) setShardEndorsement(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0          1
+	// "ShardId", "[\"Org1MSP\", ...]"(optional)
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2(ShardId, MSPIDs)")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	shardId := args[0]
+	fmt.Println("- start setShardEndorsement ", shardId)
+
+	shardAsBytes, err := stub.GetState(shardId)
+	if err != nil {
+		return shim.Error("Failed to get shard: " + err.Error())
+	} else if shardAsBytes == nil {
+		return shim.Error("shard does not exist: " + shardId)
+	}
+	s, err := decodeShard(shardAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var orgs []string
+	if len(args) == 2 {
+		err = json.Unmarshal([]byte(args[1]), &orgs)
+		if err != nil {
+			return shim.Error("2nd argument must be a JSON array of MSP IDs")
+		}
+		for _, org := range orgs {
+			if len(org) <= 0 {
+				return shim.Error("MSP IDs must be non-empty strings")
+			}
+		}
+		if len(orgs) == 0 {
+			return shim.Error("2nd argument must list at least one MSP ID")
+		}
+	} else {
+		orgs, err = shardOrgs(s)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	err = putShardEndorsement(stub, shardId, orgs)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	endorsement, err := getShardEndorsement(stub, shardId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// the new policy is not readable until the transaction commits
+	endorsement.Orgs = sortedOrgs(orgs)
+	endorsement.KeyLevel = true
+	endorsementAsBytes, err := json.Marshal(endorsement)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end setShardEndorsement (success)")
+	return shim.Success(endorsementAsBytes)
+}
+
+
+// shardOrgs lists the orgs the default policy of a shard requires, failing
+// when the shard does not record both the Sender's and the Receiver's org
+func shardOrgs(s *shard) ([]string, error) {
+	if len(s.SenderMSP) <= 0 || len(s.ReceiverMSP) <= 0 {
+		return nil, fmt.Errorf("shard %s does not record the MSP IDs of both its Sender and Receiver, so its endorsing orgs are unknown", s.ShardId)
+	}
+	orgs := []string{s.SenderMSP}
+	if s.ReceiverMSP != s.SenderMSP {
+		orgs = append(orgs, s.ReceiverMSP)
+	}
+	return orgs, nil
+}
+
+// ============================================================
+// applyShardEndorsement gives a newly written shard its default policy
+// ============================================================
+func applyShardEndorsement(stub shim.ChaincodeStubInterface, s *shard) error {
+	orgs, err := shardOrgs(s)
+	if err != nil {
+		return err
+	}
+	return putShardEndorsement(stub, s.ShardId, orgs)
+}
+
+// ============================================================
+// putShardEndorsement sets a shard key's policy to require a peer of every org
+// ============================================================
+func putShardEndorsement(stub shim.ChaincodeStubInterface, shardId string, orgs []string) error {
+	if len(orgs) == 0 {
+		return fmt.Errorf("shard %s needs at least one endorsing org", shardId)
+	}
+	ep, err := statebased.NewStateEP(nil)
+	if err != nil {
+		return err
+	}
+	err = ep.AddOrgs(statebased.RoleTypePeer, orgs...)
+	if err != nil {
+		return err
+	}
+	policy, err := ep.Policy()
+	if err != nil {
+		return err
+	}
+	return stub.SetStateValidationParameter(shardId, policy)
+}
+
+// ============================================================
+// getShardEndorsement reads the orgs a shard key's policy requires
+// ============================================================
+func getShardEndorsement(stub shim.ChaincodeStubInterface, shardId string) (*shardEndorsement, error) {
+	policy, err := stub.GetStateValidationParameter(shardId)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get endorsement policy: %s", err.Error())
+	}
+	endorsement := &shardEndorsement{ShardId: shardId, Orgs: []string{}}
+	if len(policy) == 0 {
+		return endorsement, nil
+	}
+	ep, err := statebased.NewStateEP(policy)
+	if err != nil {
+		return nil, err
+	}
+	endorsement.Orgs = ep.ListOrgs()
+	endorsement.KeyLevel = true
+	return endorsement, nil
+}
+
+// sortedOrgs returns the distinct orgs in the order ListOrgs reports them
+func sortedOrgs(orgs []string) []string {
+	ep, err := statebased.NewStateEP(nil)
+	if err != nil {
+		return orgs
+	}
+	if ep.AddOrgs(statebased.RoleTypePeer, orgs...) != nil {
+		return orgs
+	}
+	return ep.ListOrgs()
+}
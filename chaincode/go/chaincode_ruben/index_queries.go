@@ -0,0 +1,132 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright Receivership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// =======Composite key queries =================================================================
+// The lookups below read the Sender~ShardId, Receiver~ShardId, DataId~ShardId and
+// Status~ShardId indexes written by addShard with partial composite key queries, so unlike the rich queries they
+// work on every state database, LevelDB included.
+// Each takes the value to look up, optionally followed by pageSize and bookmark.
+// ===========================================================================================
+
+// getShardsBySender returns the shards sent by a peer, e.g. peer01.org1
+func (t *SimpleChaincode) getShardsBySender(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return getShardsByIndex(stub, senderIndexName, args)
+}
+
+// getShardsByReceiver returns the shards currently assigned to a peer
+func (t *SimpleChaincode) getShardsByReceiver(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return getShardsByIndex(stub, receiverIndexName, args)
+}
+
+// getShardsByDataId returns the shards belonging to one DataId
+func (t *SimpleChaincode) getShardsByDataId(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return getShardsByIndex(stub, dataIdIndexName, args)
+}
+
+
+// =========================================================================================
+// getShardsByIndex looks up the index entries matching indexName~value~* and returns
+// the shards they point to
+// =========================================================================================
+func getShardsByIndex(stub shim.ChaincodeStubInterface, indexName string, args []string) pb.Response {
+
+	//   0        1           2
+	// "value", "pageSize", "bookmark"
+	if len(args) != 1 && len(args) != 3 {
+		return queryError("Incorrect number of arguments. Expecting 1 or 3(value, pageSize, bookmark)")
+	}
+	if len(args[0]) <= 0 {
+		return queryError("1st argument must be a non-empty string")
+	}
+	value := strings.ToLower(args[0])
+	if indexName == statusIndexName {
+		status, err := parseShardStatus(args[0])
+		if err != nil {
+			return queryError(err.Error())
+		}
+		value = status
+	}
+
+	fmt.Printf("- start getShardsByIndex %s: %s\n", indexName, value)
+
+	var resultsIterator shim.StateQueryIteratorInterface
+	var responseMetadata *pb.QueryResponseMetadata
+	var err error
+	if len(args) == 3 {
+		pageSize, err := parsePageSize(args[1])
+		if err != nil {
+			return queryError(err.Error())
+		}
+		resultsIterator, responseMetadata, err = stub.GetStateByPartialCompositeKeyWithPagination(indexName, []string{value}, pageSize, args[2])
+		if err != nil {
+			return queryError(err.Error())
+		}
+	} else {
+		resultsIterator, err = stub.GetStateByPartialCompositeKey(indexName, []string{value})
+		if err != nil {
+			return queryError(err.Error())
+		}
+	}
+	defer resultsIterator.Close()
+
+	records := []queryRecord{}
+	for resultsIterator.HasNext() {
+		indexEntry, err := resultsIterator.Next()
+		if err != nil {
+			return queryError(err.Error())
+		}
+		// the ShardId is the last attribute of every shard index key
+		_, compositeKeyParts, err := stub.SplitCompositeKey(indexEntry.Key)
+		if err != nil {
+			return queryError(err.Error())
+		}
+		shardId := compositeKeyParts[len(compositeKeyParts)-1]
+
+		shardAsBytes, err := stub.GetState(shardId)
+		if err != nil {
+			return queryError("Failed to get shard: " + err.Error())
+		} else if shardAsBytes == nil {
+			// stale index entry, the shard itself is gone
+			continue
+		}
+		record, err := shardRecord(shardAsBytes)
+		if err != nil {
+			return queryError(err.Error())
+		}
+		records = append(records, queryRecord{Key: shardId, Record: record})
+	}
+
+	queryResults, err := newQueryResponse(records, responseMetadata)
+	if err != nil {
+		return queryError(err.Error())
+	}
+	fmt.Printf("- getShardsByIndex queryResult:\n%s\n", string(queryResults))
+
+	return shim.Success(queryResults)
+}
@@ -0,0 +1,258 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright Receivership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// =======Shard lifecycle ===================================================================
+// Every shard carries a Status that only moves along the transitions below:
+//
+//   Created   - addShard put the shard on the ledger, no PUF reference is enrolled yet
+//   Assigned  - enrollPUFReference gave the Receiver PUFs to verify against
+//   Verified  - verifyPUFResponse passed Threshold PUFs
+//   Released  - releaseShard released the shard to its Receiver
+//   Retrieved - the Receiver confirmed with confirmRetrieval that it fetched the shard
+//   Revoked   - the Sender withdrew the shard with revokeShard; nothing follows
+//
+// Any status but Revoked may move to Revoked.
+// ===========================================================================================
+const (
+	statusCreated   = "Created"
+	statusAssigned  = "Assigned"
+	statusVerified  = "Verified"
+	statusReleased  = "Released"
+	statusRetrieved = "Retrieved"
+	statusRevoked   = "Revoked"
+)
+
+// shardStatuses lists every status in lifecycle order
+var shardStatuses = []string{statusCreated, statusAssigned, statusVerified, statusReleased, statusRetrieved, statusRevoked}
+
+// shardTransitions maps each status to the statuses it may move to
+var shardTransitions = map[string][]string{
+	statusCreated:   {statusAssigned, statusRevoked},
+	statusAssigned:  {statusVerified, statusRevoked},
+	statusVerified:  {statusReleased, statusRevoked},
+	statusReleased:  {statusRetrieved, statusRevoked},
+	statusRetrieved: {statusRevoked},
+	statusRevoked:   {},
+}
+
+const (
+	statusIndexName = "Status~ShardId"
+
+	eventShardAssigned  = "ShardAssigned"
+	eventShardRetrieved = "ShardRetrieved"
+	eventShardRevoked   = "ShardRevoked"
+)
+
+
+// ===========================================================
+// transitionShard moves a shard to a new status, refusing any move the
+// lifecycle does not allow
+// ===========================================================
+func transitionShard(s *shard, to string) error {
+	if !containsString(shardTransitions[s.Status], to) {
+		return fmt.Errorf("invalid status transition for shard %s: %s -> %s", s.ShardId, s.Status, to)
+	}
+	s.Status = to
+	return nil
+}
+
+// ===========================================================
+// checkShardStatus refuses to run function on a shard whose status is not one of allowed
+// ===========================================================
+func checkShardStatus(s *shard, function string, allowed ...string) error {
+	if containsString(allowed, s.Status) {
+		return nil
+	}
+	return fmt.Errorf("%s is not allowed for shard %s in status %s (allowed in %s)", function, s.ShardId, s.Status, strings.Join(allowed, ", "))
+}
+
+// ===========================================================
+// deriveShardStatus fills in the Status of a shard written before shards had
+// one. Their SuccessNum was passed in by the client, not counted from PUF
+// passes, so it is reset and such a shard is Created unless it was released.
+// ===========================================================
+func deriveShardStatus(s *shard) {
+	if s.Status != "" {
+		return
+	}
+	if s.ReleasedTo != "" {
+		s.Status = statusReleased
+		return
+	}
+	s.SuccessNum = 0
+	s.Status = statusCreated
+}
+
+// ===========================================================
+// parseShardStatus returns the status named by a query argument, in any case
+// ===========================================================
+func parseShardStatus(arg string) (string, error) {
+	for _, status := range shardStatuses {
+		if strings.EqualFold(arg, status) {
+			return status, nil
+		}
+	}
+	return "", fmt.Errorf("unknown status %q, expecting one of %s", arg, strings.Join(shardStatuses, ", "))
+}
+
+// ===========================================================
+// putShardStatus saves a shard whose status changed from previous and moves its
+// Status~ShardId index entry
+// ===========================================================
+func putShardStatus(stub shim.ChaincodeStubInterface, previous *shard, s *shard) ([]byte, error) {
+	err := stampShard(stub, s)
+	if err != nil {
+		return nil, err
+	}
+	shardJSONasBytes, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(s.ShardId, shardJSONasBytes)
+	if err != nil {
+		return nil, err
+	}
+	err = updateShardIndexes(stub, previous, s)
+	if err != nil {
+		return nil, err
+	}
+	return shardJSONasBytes, nil
+}
+
+
+// ============================================================
+// confirmRetrieval - the Receiver confirms it fetched a released shard
+// ============================================================
+func (t *SimpleChaincode) confirmRetrieval(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1(ShardId)")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	shardId := args[0]
+	fmt.Println("- start confirmRetrieval ", shardId)
+
+	caller, err := getCaller(stub)
+	if err != nil {
+		return shim.Error("Failed to get caller identity: " + err.Error())
+	}
+	shardJSON, err := getShard(stub, shardId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !caller.is(shardJSON.Receiver, shardJSON.ReceiverMSP) {
+		return shim.Error("Caller " + caller.String() + " is not the Receiver of shard " + shardId)
+	}
+
+	previous := *shardJSON
+	err = transitionShard(shardJSON, statusRetrieved)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	shardJSONasBytes, err := putShardStatus(stub, &previous, shardJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = emitShardEvent(stub, eventShardRetrieved, shardJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end confirmRetrieval (success)")
+	return shim.Success(shardJSONasBytes)
+}
+
+
+// ============================================================
+// revokeShard - the Sender withdraws a shard. The shard stays on the ledger
+// in status Revoked and no function moves it on.
+// ============================================================
+func (t *SimpleChaincode) revokeShard(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0          1
+	// "ShardId", "Reason"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2(ShardId, Reason)")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+	shardId := args[0]
+	fmt.Println("- start revokeShard ", shardId)
+
+	caller, err := getCaller(stub)
+	if err != nil {
+		return shim.Error("Failed to get caller identity: " + err.Error())
+	}
+	shardJSON, err := getShard(stub, shardId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !caller.is(shardJSON.Sender, shardJSON.SenderMSP) {
+		return shim.Error("Caller " + caller.String() + " is not the Sender of shard " + shardId)
+	}
+
+	previous := *shardJSON
+	err = transitionShard(shardJSON, statusRevoked)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	shardJSON.RevokeReason = args[1]
+	shardJSONasBytes, err := putShardStatus(stub, &previous, shardJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = emitShardEvent(stub, eventShardRevoked, shardJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end revokeShard (success)")
+	return shim.Success(shardJSONasBytes)
+}
+
+
+// getShardsByStatus returns the shards in one status, e.g. the Assigned shards
+// still waiting for verification, from the Status~ShardId index
+func (t *SimpleChaincode) getShardsByStatus(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return getShardsByIndex(stub, statusIndexName, args)
+}
+
+// queryShardsByStatus is the rich query counterpart of getShardsByStatus
+func (t *SimpleChaincode) queryShardsByStatus(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return queryShardsByField(stub, "Status", args)
+}
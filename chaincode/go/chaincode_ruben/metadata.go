@@ -0,0 +1,710 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright Receivership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// contractMetadata is returned by getMetadata
+type contractMetadata struct {
+	APIVersion	string    		`json:"apiVersion"`	// version of the query envelope, see query_response.go
+	Functions	[]functionMetadata	`json:"functions"`	// sorted by Name
+}
+
+// functionMetadata describes one function Invoke dispatches
+type functionMetadata struct {
+	Name		string    		`json:"Name"`
+	Description	string    		`json:"Description"`
+	Access		string    		`json:"Access"`	// "read" or "write"
+	Roles		[]string  		`json:"Roles"`	// any one of them is required, empty for any caller; from functionRoles
+	Args		[]argMetadata		`json:"Args"`	// positional, every argument is passed as a string
+	ArgCounts	[]int 			`json:"ArgCounts"`	// numbers of arguments accepted, empty when the last argument is variadic
+	Transient	[]argMetadata		`json:"Transient,omitempty"`	// transient map entries the function reads
+	Response	map[string]interface{}	`json:"Response"`	// JSON schema of a successful payload
+}
+
+// argMetadata describes one argument. Type is the JSON schema type the string
+// argument is parsed as: "string", "integer", "boolean", or "json" for JSON text.
+type argMetadata struct {
+	Name		string    `json:"Name"`
+	Type		string    `json:"Type"`
+	Description	string    `json:"Description,omitempty"`
+	Optional	bool 	  `json:"Optional,omitempty"`
+	Variadic	bool 	  `json:"Variadic,omitempty"`
+	Enum		[]string  `json:"Enum,omitempty"`
+}
+
+const (
+	accessRead  = "read"
+	accessWrite = "write"
+)
+
+
+// ============================================================
+// getMetadata - describe every function, or the named one, so clients can be
+// generated instead of written against the source
+// ============================================================
+func (t *SimpleChaincode) getMetadata(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1(function)")
+	}
+
+	functions := contractFunctions()
+	if len(args) == 1 {
+		var selected []functionMetadata
+		for _, f := range functions {
+			if f.Name == args[0] {
+				selected = append(selected, f)
+			}
+		}
+		if len(selected) == 0 {
+			return unknownFunction(args[0])
+		}
+		functions = selected
+	}
+
+	metadataAsBytes, err := json.Marshal(&contractMetadata{APIVersion: queryAPIVersion, Functions: functions})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(metadataAsBytes)
+}
+
+
+// ============================================================
+// contractFunctions lists the metadata of every function, filling in the roles
+// from functionRoles and the accepted argument counts from Args
+// ============================================================
+func contractFunctions() []functionMetadata {
+	functions := functionCatalog()
+	for i := range functions {
+		f := &functions[i]
+		f.Roles = functionRoles[f.Name]
+		if f.Roles == nil {
+			f.Roles = []string{}
+		}
+		if f.Args == nil {
+			f.Args = []argMetadata{}
+		}
+		if f.ArgCounts == nil {
+			f.ArgCounts = argCounts(f.Args)
+		}
+	}
+	sort.Slice(functions, func(i, j int) bool { return functions[i].Name < functions[j].Name })
+	return functions
+}
+
+// argCounts accepts every count from the required arguments up to all of them,
+// or nothing in particular when the last argument is variadic
+func argCounts(args []argMetadata) []int {
+	if len(args) > 0 && args[len(args)-1].Variadic {
+		return []int{}
+	}
+	required := 0
+	for _, arg := range args {
+		if !arg.Optional {
+			required++
+		}
+	}
+	counts := []int{}
+	for n := required; n <= len(args); n++ {
+		counts = append(counts, n)
+	}
+	return counts
+}
+
+// functionCatalog describes every function. Keep it next to functionRoles when
+// adding one: TestMetadata fails for a function missing from either.
+func functionCatalog() []functionMetadata {
+	shardId := argMetadata{Name: "ShardId", Type: "string"}
+	reason := argMetadata{Name: "Reason", Type: "string"}
+	pufId := argMetadata{Name: "PUFId", Type: "string"}
+	challengeHash := argMetadata{Name: "ChallengeHash", Type: "string", Description: "hex SHA-256 of the challenge"}
+	mspID := argMetadata{Name: "MSPID", Type: "string", Description: "MSP ID of the receiver org"}
+	pageSize := argMetadata{Name: "pageSize", Type: "integer", Description: "capped at " + strconv.Itoa(maxPageSize)}
+	bookmark := argMetadata{Name: "bookmark", Type: "string", Description: "empty for the first page"}
+	optional := func(arg argMetadata) argMetadata {
+		arg.Optional = true
+		return arg
+	}
+	publicKey := argMetadata{Name: "PublicKey", Type: "string", Description: "PEM encoded PKIX ECC public key"}
+	keySignature := argMetadata{Name: "Signature", Type: "string", Description: "base64 ASN.1 ECDSA signature of the SHA-256 of PublicKey by the caller's enrollment key"}
+	crps := []argMetadata{{Name: crpsTransientKey, Type: "string", Description: "CRP material"}}
+	receiver := func(name string) argMetadata {
+		return argMetadata{Name: name, Type: "string", Description: "MSPID:name, e.g. Org1MSP:peer11.org1"}
+	}
+	subject := argMetadata{Name: "Subject", Type: "string", Description: "MSP ID for an org, MSPID:name for an identity"}
+
+	shardRecords := envelopeSchema(recordSchema(schemaOf(shard{})))
+	// lookups by one shard field share their arguments
+	indexLookup := func(name string, field string) functionMetadata {
+		return functionMetadata{
+			Name:        name,
+			Description: "List the shards whose " + field + " matches, from the " + field + "~ShardId index",
+			Access:      accessRead,
+			Args:        []argMetadata{{Name: field, Type: "string"}, optional(pageSize), optional(bookmark)},
+			ArgCounts:   []int{1, 3},
+			Response:    shardRecords,
+		}
+	}
+	fieldQuery := func(name string, field string) functionMetadata {
+		return functionMetadata{
+			Name:        name,
+			Description: "List the shards whose " + field + " matches with a CouchDB rich query",
+			Access:      accessRead,
+			Args: []argMetadata{
+				{Name: field, Type: "string"},
+				{Name: "sortOrder", Type: "string", Optional: true, Enum: []string{"asc", "desc", ""}},
+				optional(pageSize),
+				optional(bookmark),
+			},
+			ArgCounts: []int{1, 2, 4},
+			Response:  shardRecords,
+		}
+	}
+	windowQuery := func(name string, field string) functionMetadata {
+		return functionMetadata{
+			Name:        name,
+			Description: "List the shards of a " + field + " created or last changed within [from, to), oldest first",
+			Access:      accessRead,
+			Args: []argMetadata{
+				{Name: field, Type: "string"},
+				{Name: "event", Type: "string", Enum: []string{"created", "changed"}},
+				{Name: "from", Type: "string", Description: "RFC 3339, empty for no lower bound"},
+				{Name: "to", Type: "string", Description: "RFC 3339, empty for no upper bound"},
+				optional(pageSize),
+				optional(bookmark),
+			},
+			ArgCounts: []int{4, 6},
+			Response:  shardRecords,
+		}
+	}
+
+	return []functionMetadata{
+		// ==== shards ====
+		{
+			Name:        "addShard",
+			Description: "Add a shard of a registered file",
+			Access:      accessWrite,
+			Args: []argMetadata{
+				{Name: "Sender", Type: "string"},
+				shardId,
+				{Name: "DataId", Type: "string"},
+				receiver("Receiver"),
+				{Name: "Threshold", Type: "integer", Description: "PUFs that must pass before release, 1 to PUFNum"},
+				{Name: "PUFNum", Type: "string", Description: "number of PUFs, or a JSON array of registered PUF IDs"},
+				{Name: "SuccessNum", Type: "integer", Description: "must be 0"},
+				{Name: "Challenges", Type: "json", Optional: true, Description: "JSON array of {PUFId, ChallengeHash} reserved for the shard"},
+			},
+			Response: nullSchema(),
+		},
+		{
+			Name:        "addShards",
+			Description: "Add up to " + strconv.Itoa(maxBatchSize) + " shards in one transaction",
+			Access:      accessWrite,
+			Args:        []argMetadata{{Name: "Shards", Type: "json", Description: "JSON array of shards"}},
+			Response:    nullSchema(),
+		},
+		{
+			Name:        "transferShard",
+			Description: "Assign a shard to a new Receiver",
+			Access:      accessWrite,
+			Args:        []argMetadata{shardId, receiver("newReceiver")},
+			Response:    nullSchema(),
+		},
+		{
+			Name:        "deleteShard",
+			Description: "Delete a shard, leaving a tombstone",
+			Access:      accessWrite,
+			Args:        []argMetadata{shardId, reason},
+			Response:    nullSchema(),
+		},
+		{
+			Name:        "revokeShard",
+			Description: "Revoke a shard in any status",
+			Access:      accessWrite,
+			Args:        []argMetadata{shardId, reason},
+			Response:    schemaOf(shard{}),
+		},
+		{
+			Name:        "releaseShard",
+			Description: "Release a verified shard to its Receiver",
+			Access:      accessWrite,
+			Args:        []argMetadata{shardId},
+			Response:    schemaOf(shard{}),
+		},
+		{
+			Name:        "confirmRetrieval",
+			Description: "Confirm a released shard has been retrieved",
+			Access:      accessWrite,
+			Args:        []argMetadata{shardId},
+			Response:    schemaOf(shard{}),
+		},
+		{
+			Name:        "readShard",
+			Description: "Read a shard, upgraded to the current schema version",
+			Access:      accessRead,
+			Args:        []argMetadata{shardId},
+			Response:    schemaOf(shard{}),
+		},
+		{
+			Name:        "readShardForReceiver",
+			Description: "Read a released shard as its Receiver",
+			Access:      accessRead,
+			Args:        []argMetadata{shardId},
+			Response:    schemaOf(shard{}),
+		},
+		{
+			Name:        "getReleaseStatus",
+			Description: "Report how far a shard is from being released",
+			Access:      accessRead,
+			Args:        []argMetadata{shardId},
+			Response:    schemaOf(releaseStatus{}),
+		},
+		{
+			Name:        "readTombstone",
+			Description: "Read the tombstone of a deleted shard",
+			Access:      accessRead,
+			Args:        []argMetadata{shardId},
+			Response:    schemaOf(tombstone{}),
+		},
+		{
+			Name:        "migrateShards",
+			Description: "Upgrade stored shards in a key range to the current schema version",
+			Access:      accessWrite,
+			Args: []argMetadata{
+				{Name: "startKey", Type: "string"},
+				{Name: "endKey", Type: "string"},
+				{Name: "limit", Type: "integer", Optional: true, Description: "capped at " + strconv.Itoa(maxMigrationBatch)},
+			},
+			Response: schemaOf(migrationResult{}),
+		},
+
+		// ==== data ====
+		{
+			Name:        "registerData",
+			Description: "Register a file before its shards are added",
+			Access:      accessWrite,
+			Args: []argMetadata{
+				{Name: "DataId", Type: "string"},
+				{Name: "ShardCount", Type: "integer"},
+				{Name: "ShardIds", Type: "json", Description: "JSON array of ShardCount ShardIds in split order"},
+				{Name: "TotalSize", Type: "integer", Description: "bytes"},
+			},
+			Response: nullSchema(),
+		},
+		{
+			Name:        "getData",
+			Description: "Read a registered file",
+			Access:      accessRead,
+			Args:        []argMetadata{{Name: "DataId", Type: "string"}},
+			Response:    schemaOf(data{}),
+		},
+		{
+			Name:        "getShardsForData",
+			Description: "List the shards of a file in split order, null for shards not added yet",
+			Access:      accessRead,
+			Args:        []argMetadata{{Name: "DataId", Type: "string"}},
+			Response:    shardRecords,
+		},
+
+		// ==== PUFs and challenges ====
+		{
+			Name:        "enrollPUFReference",
+			Description: "Enroll the reference a shard's PUF responses are verified against",
+			Access:      accessWrite,
+			Args: []argMetadata{
+				shardId,
+				pufId,
+				{Name: "Kind", Type: "string", Enum: []string{pufKindResponse, pufKindCommitment}},
+				challengeHash,
+				{Name: "MaxDistance", Type: "integer"},
+			},
+			Transient: []argMetadata{{Name: pufReferenceTransientKey, Type: "string", Description: "reference response"}},
+			Response:  nullSchema(),
+		},
+		{
+			Name:        "verifyPUFResponse",
+			Description: "Verify a PUF response for a shard, consuming its challenge",
+			Access:      accessWrite,
+			Args: []argMetadata{
+				shardId,
+				pufId,
+				challengeHash,
+			},
+			Transient: []argMetadata{{Name: pufResponseTransientKey, Type: "string", Description: "PUF response"}},
+			Response:  schemaOf(verificationResult{}),
+		},
+		{
+			Name:        "setChallengeBudget",
+			Description: "Set how many challenges a registered PUF may answer, at most its CRPCount",
+			Access:      accessWrite,
+			Args:        []argMetadata{pufId, {Name: "Budget", Type: "integer"}},
+			Response:    schemaOf(remainingChallenges{}),
+		},
+		{
+			Name:        "getRemainingChallenges",
+			Description: "Report consumed and remaining challenges of the given PUFs, or of every PUF",
+			Access:      accessRead,
+			Args:        []argMetadata{{Name: "PUFIds", Type: "string", Optional: true, Variadic: true}},
+			Response:    envelopeSchema(schemaOf(remainingChallenges{})),
+		},
+		{
+			Name:        "registerPUF",
+			Description: "Register a PUF device for the caller's org",
+			Access:      accessWrite,
+			Args:        []argMetadata{pufId, {Name: "CRPCount", Type: "integer"}},
+			Response:    schemaOf(puf{}),
+		},
+		{
+			Name:        "revokePUF",
+			Description: "Take a PUF device out of service",
+			Access:      accessWrite,
+			Args:        []argMetadata{pufId, reason},
+			Response:    schemaOf(puf{}),
+		},
+		{
+			Name:        "getPUF",
+			Description: "Read a registered PUF device",
+			Access:      accessRead,
+			Args:        []argMetadata{pufId},
+			Response:    schemaOf(puf{}),
+		},
+		{
+			Name:        "listPUFsByOrg",
+			Description: "List the PUF devices an org registered",
+			Access:      accessRead,
+			Args:        []argMetadata{{Name: "MSPID", Type: "string"}, optional(pageSize), optional(bookmark)},
+			ArgCounts:   []int{1, 3},
+			Response:    envelopeSchema(schemaOf(puf{})),
+		},
+
+		// ==== CRPs ====
+		{
+			Name:        "putCRPs",
+			Description: "Store a shard's CRP material in the receiver org's private collection",
+			Access:      accessWrite,
+			Args:        []argMetadata{shardId, mspID},
+			Transient:   crps,
+			Response:    nullSchema(),
+		},
+		{
+			Name:        "getCRPs",
+			Description: "Read a shard's CRP material from the caller's org collection",
+			Access:      accessRead,
+			Args:        []argMetadata{shardId},
+			Response:    map[string]interface{}{"description": "the CRP material exactly as stored, not JSON"},
+		},
+		{
+			Name:        "getCRPsHash",
+			Description: "Read the public hash of a shard's CRP material",
+			Access:      accessRead,
+			Args:        []argMetadata{shardId, mspID},
+			Response:    schemaOf(crpsHash{}),
+		},
+		{
+			Name:        "verifyCRPs",
+			Description: "Check CRP material against its public hash",
+			Access:      accessRead,
+			Args:        []argMetadata{shardId, mspID},
+			Transient:   crps,
+			Response:    schemaOf(crpsVerification{}),
+		},
+
+		// ==== queries ====
+		{
+			Name:        "queryShards",
+			Description: "Run a CouchDB query string",
+			Access:      accessRead,
+			Args:        []argMetadata{{Name: "queryString", Type: "json"}},
+			Response:    shardRecords,
+		},
+		{
+			Name:        "queryShardsWithPagination",
+			Description: "Run a CouchDB query string one page at a time",
+			Access:      accessRead,
+			Args:        []argMetadata{{Name: "queryString", Type: "json"}, pageSize, bookmark},
+			Response:    shardRecords,
+		},
+		{
+			Name:        "queryShardsStructured",
+			Description: "Run a structured query built from whitelisted fields and operators",
+			Access:      accessRead,
+			Args:        []argMetadata{{Name: "structuredQuery", Type: "json"}, optional(pageSize), optional(bookmark)},
+			ArgCounts:   []int{1, 3},
+			Response:    shardRecords,
+		},
+		{
+			Name:        "queryShardsBySender",
+			Description: "List the shards of a Sender with a CouchDB rich query",
+			Access:      accessRead,
+			Args:        []argMetadata{{Name: "Sender", Type: "string"}},
+			Response:    shardRecords,
+		},
+		{
+			Name:        "queryShardsBySenderWithPagination",
+			Description: "List the shards of a Sender one page at a time",
+			Access:      accessRead,
+			Args:        []argMetadata{{Name: "Sender", Type: "string"}, pageSize, bookmark},
+			Response:    shardRecords,
+		},
+		fieldQuery("queryShardsByReceiver", "Receiver"),
+		fieldQuery("queryShardsByDataId", "DataId"),
+		fieldQuery("queryShardsByStatus", "Status"),
+		windowQuery("queryShardsBySenderInWindow", "Sender"),
+		windowQuery("queryShardsByReceiverInWindow", "Receiver"),
+		windowQuery("queryShardsByDataIdInWindow", "DataId"),
+		{
+			Name:        "getShardsByRange",
+			Description: "List the shards with ShardIds in [startKey, endKey)",
+			Access:      accessRead,
+			Args:        []argMetadata{{Name: "startKey", Type: "string"}, {Name: "endKey", Type: "string"}},
+			Response:    shardRecords,
+		},
+		{
+			Name:        "getShardsByRangeWithPagination",
+			Description: "List the shards with ShardIds in [startKey, endKey) one page at a time",
+			Access:      accessRead,
+			Args:        []argMetadata{{Name: "startKey", Type: "string"}, {Name: "endKey", Type: "string"}, pageSize, bookmark},
+			Response:    shardRecords,
+		},
+		indexLookup("getShardsBySender", "Sender"),
+		indexLookup("getShardsByReceiver", "Receiver"),
+		indexLookup("getShardsByDataId", "DataId"),
+		indexLookup("getShardsByStatus", "Status"),
+
+		// ==== audit ====
+		{
+			Name:        "getHistoryForShard",
+			Description: "List every version of a shard",
+			Access:      accessRead,
+			Args:        []argMetadata{shardId},
+			Response:    envelopeSchema(schemaOf(historyRecord{})),
+		},
+		{
+			Name:        "getAuditTrailForData",
+			Description: "Merge the history of every shard of a file into one timeline",
+			Access:      accessRead,
+			Args:        []argMetadata{{Name: "DataId", Type: "string"}},
+			Response:    envelopeSchema(schemaOf(auditEntry{})),
+		},
+
+		// ==== endorsement ====
+		{
+			Name:        "getShardEndorsement",
+			Description: "Report which orgs must endorse changes to a shard",
+			Access:      accessRead,
+			Args:        []argMetadata{shardId},
+			Response:    schemaOf(shardEndorsement{}),
+		},
+		{
+			Name:        "setShardEndorsement",
+			Description: "Replace the orgs that must endorse changes to a shard, or reset them to the Sender's and Receiver's orgs, as an admin",
+			Access:      accessWrite,
+			Args:        []argMetadata{shardId, {Name: "MSPIDs", Type: "json", Optional: true, Description: "JSON array of MSP IDs"}},
+			Response:    schemaOf(shardEndorsement{}),
+		},
+
+		// ==== encryption keys ====
+		{
+			Name:        "publishKey",
+			Description: "Publish the caller's encryption public key",
+			Access:      accessWrite,
+			Args:        []argMetadata{publicKey, keySignature},
+			Response:    schemaOf(encryptionKey{}),
+		},
+		{
+			Name:        "rotateKey",
+			Description: "Replace the caller's active encryption public key",
+			Access:      accessWrite,
+			Args:        []argMetadata{publicKey, keySignature},
+			Response:    schemaOf(encryptionKey{}),
+		},
+		{
+			Name:        "revokeKey",
+			Description: "Revoke the caller's encryption public key, or as an admin that of another identity of its org",
+			Access:      accessWrite,
+			Args:        []argMetadata{reason, optional(receiver("Owner"))},
+			Response:    schemaOf(encryptionKey{}),
+		},
+		{
+			Name:        "getPublicKey",
+			Description: "Read an identity's current encryption public key",
+			Access:      accessRead,
+			Args:        []argMetadata{receiver("Owner")},
+			Response:    schemaOf(encryptionKey{}),
+		},
+
+		// ==== quotas ====
+		{
+			Name:        "setQuota",
+			Description: "Set the limits of an org or identity, or with Subject \"*\" the default of a scope",
+			Access:      accessWrite,
+			Args: []argMetadata{
+				{Name: "Scope", Type: "string", Enum: []string{quotaScopeOrg, quotaScopeIdentity}},
+				subject,
+				{Name: "MaxShards", Type: "integer", Description: "0 for unlimited"},
+				{Name: "MaxBytes", Type: "integer", Description: "0 for unlimited"},
+				{Name: "RateLimit", Type: "integer", Description: "shards per window, 0 for unlimited"},
+				{Name: "RateWindow", Type: "integer", Description: "seconds"},
+			},
+			Response: schemaOf(quota{}),
+		},
+		{
+			Name:        "getQuotaUsage",
+			Description: "Report the quota of the caller's org and identity, or of the named subject",
+			Access:      accessRead,
+			Args: []argMetadata{
+				{Name: "Scope", Type: "string", Optional: true, Enum: []string{quotaScopeOrg, quotaScopeIdentity}},
+				optional(subject),
+			},
+			ArgCounts: []int{0, 2},
+			Response:  envelopeSchema(schemaOf(quotaStatus{})),
+		},
+
+		// ==== access control and metadata ====
+		{
+			Name:        "getFunctionRoles",
+			Description: "List the roles each function requires",
+			Access:      accessRead,
+			Args:        []argMetadata{{Name: "function", Type: "string", Optional: true}},
+			Response:    schemaOf(map[string][]string{}),
+		},
+		{
+			Name:        "getCallerRoles",
+			Description: "Report the caller's identity and roles",
+			Access:      accessRead,
+			Response:    schemaOf(callerRoles{}),
+		},
+		{
+			Name:        "getMetadata",
+			Description: "Describe every function, or the named one",
+			Access:      accessRead,
+			Args:        []argMetadata{{Name: "function", Type: "string", Optional: true}},
+			Response:    schemaOf(contractMetadata{}),
+		},
+	}
+}
+
+
+// =======JSON schemas =====================================================================
+// Response schemas are derived from the Go types the functions marshal, so they
+// follow the code: a field is required unless its json tag has omitempty.
+// ===========================================================================================
+
+// schemaOf returns the JSON schema of the JSON encoding of v
+func schemaOf(v interface{}) map[string]interface{} {
+	return typeSchema(reflect.TypeOf(v))
+}
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(json.RawMessage{}) {
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Ptr:
+		schema := typeSchema(t.Elem())
+		if elemType, ok := schema["type"].(string); ok {
+			schema["type"] = []string{elemType, "null"}
+		}
+		return schema
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		required := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			// encoding/json promotes the fields of an untagged embedded struct,
+			// exported or not, e.g. the identity in callerRoles
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if field.Anonymous && tag == "" && embedded.Kind() == reflect.Struct {
+				schema := typeSchema(embedded)
+				for name, property := range schema["properties"].(map[string]interface{}) {
+					properties[name] = property
+				}
+				required = append(required, schema["required"].([]string)...)
+				continue
+			}
+			if field.PkgPath != "" {
+				continue
+			}
+			name := strings.Split(tag, ",")[0]
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = typeSchema(field.Type)
+			if !strings.Contains(tag, ",omitempty") {
+				required = append(required, name)
+			}
+		}
+		return map[string]interface{}{"type": "object", "properties": properties, "required": required}
+	}
+	// interface{} and anything else may hold any JSON value
+	return map[string]interface{}{}
+}
+
+// nullSchema is the schema of an empty payload
+func nullSchema() map[string]interface{} {
+	return map[string]interface{}{"type": "null"}
+}
+
+// recordSchema is the schema of a queryRecord whose Record matches record or is null
+func recordSchema(record map[string]interface{}) map[string]interface{} {
+	schema := schemaOf(queryRecord{})
+	schema["properties"].(map[string]interface{})["Record"] = map[string]interface{}{
+		"oneOf": []interface{}{record, nullSchema()},
+	}
+	return schema
+}
+
+// envelopeSchema is the schema of a queryResponse whose items match item
+func envelopeSchema(item map[string]interface{}) map[string]interface{} {
+	schema := schemaOf(queryResponse{})
+	schema["properties"].(map[string]interface{})["items"] = map[string]interface{}{"type": "array", "items": item}
+	return schema
+}
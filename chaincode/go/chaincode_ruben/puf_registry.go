@@ -0,0 +1,378 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright Receivership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// puf is a registered PUF device. Shards that name it in PUFIds may only be
+// enrolled and verified against it while it is active.
+type puf struct {
+	ObjectType	string    `json:"docType"`	// "puf"
+	SchemaVersion	int 	  `json:"SchemaVersion"`
+	PUFId		string    `json:"PUFId"`
+	OwnerMSP	string    `json:"OwnerMSP"`	// org that registered the device
+	RegisteredBy	string    `json:"RegisteredBy"`
+	EnrolledAt	string    `json:"EnrolledAt"`	// transaction timestamp of registerPUF, RFC 3339
+	CRPCount	int 	  `json:"CRPCount"`	// CRPs generated for the device, its challenge budget
+	Status		string    `json:"Status"`	// "active" or "revoked"
+	RevokedAt	string    `json:"RevokedAt,omitempty"`
+	RevokeReason	string    `json:"RevokeReason,omitempty"`
+}
+
+const (
+	pufObjectType   = "PUF"
+	pufOrgIndexName = "PUFOrg~MSPID~PUFId"
+
+	pufStatusActive  = "active"
+	pufStatusRevoked = "revoked"
+)
+
+
+// ============================================================
+// registerPUF - register a PUF device for the caller's org. Only admins may
+// register, so an uploader cannot claim another device's PUFId for its org.
+// Its CRP count also becomes the device's challenge budget, see challenges.go.
+// ============================================================
+func (t *SimpleChaincode) registerPUF(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1
+	// "PUFId", "CRPCount"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2(PUFId, CRPCount)")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	pufId := args[0]
+	crpCount, err := strconv.Atoi(args[1])
+	if err != nil || crpCount <= 0 {
+		return shim.Error("2nd argument must be a positive numeric string")
+	}
+	fmt.Println("- start registerPUF ", pufId)
+
+	_, err = getPUF(stub, pufId)
+	if err == nil {
+		return shim.Error("PUF " + pufId + " is already registered")
+	} else if err != errPUFNotFound {
+		return shim.Error(err.Error())
+	}
+
+	caller, err := getCaller(stub)
+	if err != nil {
+		return shim.Error("Failed to get caller identity: " + err.Error())
+	}
+	enrolledAt, err := getTxTimestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ==== The device cannot have answered more challenges than it has ====
+	counter, err := getChallengeCounter(stub, pufId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if counter.Consumed > crpCount {
+		return shim.Error(fmt.Sprintf("PUF %s has already consumed %d challenges", pufId, counter.Consumed))
+	}
+	counter.Budget = crpCount
+	err = putChallengeCounter(stub, counter)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	p := &puf{
+		ObjectType:    "puf",
+		SchemaVersion: schemaVersions["puf"],
+		PUFId:         pufId,
+		OwnerMSP:      caller.MSPID,
+		RegisteredBy:  caller.Name,
+		EnrolledAt:    enrolledAt,
+		CRPCount:      crpCount,
+		Status:        pufStatusActive,
+	}
+	pufAsBytes, err := putPUF(stub, p)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	orgIndexKey, err := stub.CreateCompositeKey(pufOrgIndexName, []string{caller.MSPID, pufId})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(orgIndexKey, []byte{0x00})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end registerPUF (success)")
+	return shim.Success(pufAsBytes)
+}
+
+
+// ============================================================
+// revokePUF - take a PUF device out of service. Only its owning org or an
+// admin may revoke it; a revoked device cannot be reinstated.
+// ============================================================
+func (t *SimpleChaincode) revokePUF(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1
+	// "PUFId", "Reason"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2(PUFId, Reason)")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+	pufId := args[0]
+	fmt.Println("- start revokePUF ", pufId)
+
+	p, err := getPUF(stub, pufId)
+	if err != nil {
+		return shim.Error(err.Error() + ": " + pufId)
+	}
+	caller, err := getCallerRoles(stub)
+	if err != nil {
+		return shim.Error("Failed to get caller identity: " + err.Error())
+	}
+	if caller.MSPID != p.OwnerMSP && !containsString(caller.Roles, roleAdmin) {
+		return shim.Error("PUF " + pufId + " belongs to " + p.OwnerMSP + ", not " + caller.MSPID)
+	}
+	if p.Status == pufStatusRevoked {
+		return shim.Error("PUF " + pufId + " is already revoked")
+	}
+
+	revokedAt, err := getTxTimestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	p.Status = pufStatusRevoked
+	p.RevokedAt = revokedAt
+	p.RevokeReason = args[1]
+	pufAsBytes, err := putPUF(stub, p)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end revokePUF (success)")
+	return shim.Success(pufAsBytes)
+}
+
+
+// ============================================================
+// getPUF - read a registered PUF device
+// ============================================================
+func (t *SimpleChaincode) getPUF(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1(PUFId)")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	p, err := getPUF(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error() + ": " + args[0])
+	}
+	pufAsBytes, err := json.Marshal(p)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(pufAsBytes)
+}
+
+
+// ============================================================
+// listPUFsByOrg - list the PUF devices an org registered, optionally paginated
+// ============================================================
+func (t *SimpleChaincode) listPUFsByOrg(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1           2
+	// "MSPID", "pageSize", "bookmark"
+	if len(args) != 1 && len(args) != 3 {
+		return queryError("Incorrect number of arguments. Expecting 1 or 3(MSPID, pageSize, bookmark)")
+	}
+	if len(args[0]) <= 0 {
+		return queryError("1st argument must be a non-empty string")
+	}
+
+	var resultsIterator shim.StateQueryIteratorInterface
+	var responseMetadata *pb.QueryResponseMetadata
+	var err error
+	if len(args) == 3 {
+		pageSize, err := parsePageSize(args[1])
+		if err != nil {
+			return queryError(err.Error())
+		}
+		resultsIterator, responseMetadata, err = stub.GetStateByPartialCompositeKeyWithPagination(pufOrgIndexName, []string{args[0]}, pageSize, args[2])
+		if err != nil {
+			return queryError(err.Error())
+		}
+	} else {
+		resultsIterator, err = stub.GetStateByPartialCompositeKey(pufOrgIndexName, []string{args[0]})
+		if err != nil {
+			return queryError(err.Error())
+		}
+	}
+	defer resultsIterator.Close()
+
+	items := []*puf{}
+	for resultsIterator.HasNext() {
+		indexEntry, err := resultsIterator.Next()
+		if err != nil {
+			return queryError(err.Error())
+		}
+		_, compositeKeyParts, err := stub.SplitCompositeKey(indexEntry.Key)
+		if err != nil {
+			return queryError(err.Error())
+		}
+		p, err := getPUF(stub, compositeKeyParts[1])
+		if err != nil {
+			return queryError(err.Error())
+		}
+		items = append(items, p)
+	}
+
+	queryResults, err := newQueryResponse(items, responseMetadata)
+	if err != nil {
+		return queryError(err.Error())
+	}
+	return shim.Success(queryResults)
+}
+
+
+// errPUFNotFound is returned by getPUF for an unregistered PUFId
+var errPUFNotFound = fmt.Errorf("PUF is not registered")
+
+// ============================================================
+// getPUF loads and decodes a registered PUF device
+// ============================================================
+func getPUF(stub shim.ChaincodeStubInterface, pufId string) (*puf, error) {
+	pufKey, err := stub.CreateCompositeKey(pufObjectType, []string{pufId})
+	if err != nil {
+		return nil, err
+	}
+	pufAsBytes, err := stub.GetState(pufKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get PUF: %s", err.Error())
+	} else if pufAsBytes == nil {
+		return nil, errPUFNotFound
+	}
+
+	p := &puf{}
+	err = json.Unmarshal(pufAsBytes, p)
+	if err != nil {
+		return nil, err
+	}
+	err = upgradeSchema(p.ObjectType, &p.SchemaVersion)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ============================================================
+// putPUF saves a PUF device and returns what was stored
+// ============================================================
+func putPUF(stub shim.ChaincodeStubInterface, p *puf) ([]byte, error) {
+	pufKey, err := stub.CreateCompositeKey(pufObjectType, []string{p.PUFId})
+	if err != nil {
+		return nil, err
+	}
+	pufAsBytes, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return pufAsBytes, stub.PutState(pufKey, pufAsBytes)
+}
+
+// ============================================================
+// checkActivePUF makes sure a PUF is registered and has not been revoked
+// ============================================================
+func checkActivePUF(stub shim.ChaincodeStubInterface, pufId string) error {
+	p, err := getPUF(stub, pufId)
+	if err != nil {
+		return fmt.Errorf("%s: %s", err.Error(), pufId)
+	}
+	if p.Status != pufStatusActive {
+		return fmt.Errorf("PUF %s is %s: %s", pufId, p.Status, p.RevokeReason)
+	}
+	return nil
+}
+
+// ============================================================
+// parsePUFIds reads the PUF argument of addShard: either a count, for shards
+// not tied to registered devices, or a JSON array naming the devices, e.g.
+// ["puf-1","puf-2","puf-3"]. newShardFromEntry checks the named devices.
+// ============================================================
+func parsePUFIds(arg string) (int, []string, error) {
+	if !strings.HasPrefix(strings.TrimSpace(arg), "[") {
+		pufNum, err := strconv.Atoi(arg)
+		if err != nil {
+			return 0, nil, fmt.Errorf("must be a numeric string or a JSON array of PUF IDs")
+		}
+		return pufNum, nil, nil
+	}
+
+	pufIds := []string{}
+	err := json.Unmarshal([]byte(arg), &pufIds)
+	if err != nil {
+		return 0, nil, fmt.Errorf("must be a numeric string or a JSON array of PUF IDs")
+	}
+	return len(pufIds), pufIds, nil
+}
+
+// checkPUFIds makes sure the PUFs a shard names are distinct and active
+func checkPUFIds(stub shim.ChaincodeStubInterface, pufIds []string) error {
+	for i, pufId := range pufIds {
+		if containsString(pufIds[:i], pufId) {
+			return fmt.Errorf("PUF %s is named more than once", pufId)
+		}
+		err := checkActivePUF(stub, pufId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================
+// checkShardPUF makes sure a PUF may be used for a shard: when the shard names
+// its devices, the PUF must be one of them and still active
+// ============================================================
+func checkShardPUF(stub shim.ChaincodeStubInterface, s *shard, pufId string) error {
+	if len(s.PUFIds) == 0 {
+		return nil
+	}
+	if !containsString(s.PUFIds, pufId) {
+		return fmt.Errorf("PUF %s is not one of the PUFIds of shard %s", pufId, s.ShardId)
+	}
+	return checkActivePUF(stub, pufId)
+}
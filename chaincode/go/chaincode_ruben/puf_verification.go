@@ -0,0 +1,540 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright Receivership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// pufReference is the enrolled reference a PUF's response is checked against
+type pufReference struct {
+	ObjectType	string    `json:"docType"`	// "pufReference"
+	SchemaVersion	int 	  `json:"SchemaVersion"`
+	ShardId		string    `json:"ShardId"`
+	PUFId		string    `json:"PUFId"`
+	Kind		string    `json:"Kind"`	// "response" or "commitment"
+	Reference	string    `json:"Reference"`	// hex SHA-256 of Salt and the response for a commitment, empty for a response
+	Salt		string    `json:"Salt,omitempty"`	// hex salt of a commitment, empty for commitments enrolled before salting
+	ChallengeHash	string    `json:"ChallengeHash,omitempty"`	// hex SHA-256 of the challenge the reference answers
+	Collection	string    `json:"Collection,omitempty"`	// Sender org's collection holding a response, empty for a commitment
+	MaxDistance	int 	  `json:"MaxDistance"`	// τ: largest Hamming distance accepted, 0 for a commitment
+}
+
+// pufPass records that a PUF has passed verification for a shard, so it is counted once
+type pufPass struct {
+	ObjectType	string    `json:"docType"`	// "pufPass"
+	SchemaVersion	int 	  `json:"SchemaVersion"`
+	ShardId		string    `json:"ShardId"`
+	PUFId		string    `json:"PUFId"`
+	Distance	int 	  `json:"Distance"`
+	VerifiedBy	string    `json:"VerifiedBy"`
+	TxId		string    `json:"TxId"`
+}
+
+// verificationResult is returned by verifyPUFResponse
+type verificationResult struct {
+	ShardId		string    `json:"ShardId"`
+	PUFId		string    `json:"PUFId"`
+	Distance	int 	  `json:"Distance"`
+	MaxDistance	int 	  `json:"MaxDistance"`
+	SuccessNum	int 	  `json:"SuccessNum"`
+	Threshold	int 	  `json:"Threshold"`
+}
+
+const (
+	pufRefIndexName  = "PUFRef~ShardId~PUFId"
+	pufPassIndexName = "PUFPass~ShardId~PUFId"
+
+	pufKindResponse   = "response"
+	pufKindCommitment = "commitment"
+
+	// pufReferenceTransientKey and pufResponseTransientKey are the transient map
+	// entries carrying the reference and the submitted response, so neither
+	// appears in the transaction
+	pufReferenceTransientKey = "pufReference"
+	pufResponseTransientKey  = "pufResponse"
+
+	// pufReferenceCollectionPrefix + the Sender's MSP ID names the collection keeping
+	// reference responses, which a verifier could otherwise replay, out of the public
+	// state. Only the Sender's org is a member, so Receivers of other orgs never hold
+	// them. The Receiver's verifyPUFResponse is endorsed by the Sender org's peers,
+	// so these collections leave memberOnlyRead off.
+	pufReferenceCollectionPrefix = "collectionPUFReferences"
+
+	// pufSharedReferenceCollection held the responses of both orgs before
+	// pufReference version 4. They are no longer verified, only deleted.
+	pufSharedReferenceCollection = "collectionPUFReferences"
+)
+
+
+// ============================================================
+// enrollPUFReference - enroll the reference response of one of the shard's PUFs
+// to the challenge it answers, which is reserved for the shard.
+// The response is passed in the transient map under "pufReference". For Kind
+// "response" it is kept in the Sender org's PUF references collection, so the
+// Receiver must belong to another org; for a "commitment" only its salted
+// SHA-256 is stored. Only the shard's Sender may enroll, and at most PUFNum PUFs
+// can be enrolled per shard.
+// ============================================================
+func (t *SimpleChaincode) enrollPUFReference(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0          1        2                          3                              4
+	// "ShardId", "PUFId", "response"|"commitment", "hex SHA-256 of the challenge", "MaxDistance"
+	if len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 5(ShardId, PUFId, Kind, ChallengeHash, MaxDistance)")
+	}
+	for i, arg := range args {
+		if len(arg) <= 0 {
+			return shim.Error("argument " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+	shardId := args[0]
+	pufId := args[1]
+	kind := args[2]
+	challengeHash, err := parseChallengeHash(args[3])
+	if err != nil {
+		return shim.Error("4th argument: " + err.Error())
+	}
+	maxDistance, err := strconv.Atoi(args[4])
+	if err != nil || maxDistance < 0 {
+		return shim.Error("5th argument must be a non-negative numeric string")
+	}
+	reference, err := getTransientPUFBytes(stub, pufReferenceTransientKey, "the reference response")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	switch kind {
+	case pufKindResponse:
+		if maxDistance > len(reference)*8 {
+			return shim.Error("MaxDistance exceeds the length of the reference response")
+		}
+	case pufKindCommitment:
+		if maxDistance != 0 {
+			return shim.Error("MaxDistance must be 0 for a commitment")
+		}
+	default:
+		return shim.Error("3rd argument must be \"" + pufKindResponse + "\" or \"" + pufKindCommitment + "\"")
+	}
+	fmt.Println("- start enrollPUFReference ", shardId, pufId)
+
+	caller, err := getCaller(stub)
+	if err != nil {
+		return shim.Error("Failed to get caller identity: " + err.Error())
+	}
+
+	shardJSON, err := getShard(stub, shardId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !caller.is(shardJSON.Sender, shardJSON.SenderMSP) {
+		return shim.Error("Caller " + caller.String() + " is not the Sender of shard " + shardId)
+	}
+	if kind == pufKindResponse && shardJSON.ReceiverMSP == shardJSON.SenderMSP {
+		return shim.Error("the Receiver of shard " + shardId + " belongs to " + shardJSON.SenderMSP + ", whose peers would hold the reference response; enroll a commitment")
+	}
+	err = checkShardStatus(shardJSON, "enrollPUFReference", statusCreated, statusAssigned)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkShardPUF(stub, shardJSON, pufId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	refKey, err := stub.CreateCompositeKey(pufRefIndexName, []string{shardId, pufId})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	refAsBytes, err := stub.GetState(refKey)
+	if err != nil {
+		return shim.Error("Failed to get PUF reference: " + err.Error())
+	} else if refAsBytes != nil {
+		return shim.Error("PUF " + pufId + " is already enrolled for shard " + shardId)
+	}
+
+	// ==== Count the PUFs already enrolled for this shard ====
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(pufRefIndexName, []string{shardId})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+	enrolled := 0
+	for resultsIterator.HasNext() {
+		if _, err := resultsIterator.Next(); err != nil {
+			return shim.Error(err.Error())
+		}
+		enrolled++
+	}
+	if enrolled >= shardJSON.PUFNum {
+		return shim.Error("shard " + shardId + " already has PUFNum=" + strconv.Itoa(shardJSON.PUFNum) + " PUFs enrolled")
+	}
+
+	err = reserveEnrolledChallenge(stub, shardId, pufId, challengeHash)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	ref := &pufReference{
+		ObjectType:    "pufReference",
+		SchemaVersion: schemaVersions["pufReference"],
+		ShardId:       shardId,
+		PUFId:         pufId,
+		Kind:          kind,
+		MaxDistance:   maxDistance,
+		ChallengeHash: challengeHash,
+	}
+	if kind == pufKindCommitment {
+		// derived from the transaction so every endorser computes the same salt
+		salt := sha256.Sum256([]byte(stub.GetTxID() + "\x00" + shardId + "\x00" + pufId))
+		ref.Salt = hex.EncodeToString(salt[:])
+		ref.Reference = hex.EncodeToString(saltedDigest(salt[:], reference))
+	} else {
+		ref.Collection = pufReferenceCollectionPrefix + shardJSON.SenderMSP
+		err = stub.PutPrivateData(ref.Collection, refKey, reference)
+		if err != nil {
+			return shim.Error("Failed to put private data in " + ref.Collection + ": " + err.Error())
+		}
+	}
+	refJSONasBytes, err := json.Marshal(ref)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(refKey, refJSONasBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ==== The first reference hands the shard to its Receiver for verification ====
+	if shardJSON.Status == statusCreated {
+		previous := *shardJSON
+		err = transitionShard(shardJSON, statusAssigned)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, err = putShardStatus(stub, &previous, shardJSON)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = emitShardEvent(stub, eventShardAssigned, shardJSON)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	fmt.Println("- end enrollPUFReference (success)")
+	return shim.Success(nil)
+}
+
+
+// ============================================================
+// verifyPUFResponse - check a PUF's response against its enrolled reference.
+// Only the shard's Receiver, or a verifier of the Receiver's org on its behalf,
+// may submit responses, passing them in the transient map under "pufResponse".
+// A response passes when its Hamming distance to the reference is at most τ
+// (or, for a commitment, when it hashes to the commitment). Each PUF that
+// passes raises the shard's SuccessNum once; a second submission is rejected.
+// The challenge must be the one the PUF was enrolled with, or for references
+// enrolled without one, a challenge reserved for the shard. It is consumed,
+// see challenges.go.
+// ============================================================
+func (t *SimpleChaincode) verifyPUFResponse(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0          1        2
+	// "ShardId", "PUFId", "hex SHA-256 of the challenge"
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3(ShardId, PUFId, ChallengeHash)")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+	if len(args[2]) <= 0 {
+		return shim.Error("3rd argument must be a non-empty string")
+	}
+	shardId := args[0]
+	pufId := args[1]
+	challengeHash, err := parseChallengeHash(args[2])
+	if err != nil {
+		return shim.Error("3rd argument: " + err.Error())
+	}
+	response, err := getTransientPUFBytes(stub, pufResponseTransientKey, "the response")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("- start verifyPUFResponse ", shardId, pufId)
+
+	caller, err := getCallerRoles(stub)
+	if err != nil {
+		return shim.Error("Failed to get caller identity: " + err.Error())
+	}
+
+	shardJSON, err := getShard(stub, shardId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !caller.is(shardJSON.Receiver, shardJSON.ReceiverMSP) &&
+		!(containsString(caller.Roles, roleVerifier) && len(shardJSON.ReceiverMSP) > 0 && caller.MSPID == shardJSON.ReceiverMSP) {
+		return shim.Error("Caller " + caller.String() + " is neither the Receiver of shard " + shardId + " nor a verifier of its org")
+	}
+	// PUFs past the Threshold may still be verified until the shard is released
+	err = checkShardStatus(shardJSON, "verifyPUFResponse", statusAssigned, statusVerified)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkShardPUF(stub, shardJSON, pufId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	refKey, err := stub.CreateCompositeKey(pufRefIndexName, []string{shardId, pufId})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	refAsBytes, err := stub.GetState(refKey)
+	if err != nil {
+		return shim.Error("Failed to get PUF reference: " + err.Error())
+	} else if refAsBytes == nil {
+		return shim.Error("PUF " + pufId + " is not enrolled for shard " + shardId)
+	}
+	ref := pufReference{}
+	err = json.Unmarshal(refAsBytes, &ref)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = upgradeSchema(ref.ObjectType, &ref.SchemaVersion)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ==== Reject a second submission from the same PUF ====
+	passKey, err := stub.CreateCompositeKey(pufPassIndexName, []string{shardId, pufId})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	passAsBytes, err := stub.GetState(passKey)
+	if err != nil {
+		return shim.Error("Failed to get PUF verification: " + err.Error())
+	} else if passAsBytes != nil {
+		return shim.Error("PUF " + pufId + " has already been verified for shard " + shardId)
+	}
+
+	// ==== A transfer may have moved the Receiver into the org holding the reference ====
+	if ref.Kind == pufKindResponse && ref.Collection == pufReferenceCollectionPrefix+shardJSON.ReceiverMSP {
+		return shim.Error("the reference of PUF " + pufId + " is kept in " + ref.Collection + ", which the Receiver of shard " + shardId + " belongs to")
+	}
+
+	distance, err := pufDistance(stub, refKey, &ref, response)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if distance > ref.MaxDistance && ref.Kind == pufKindCommitment {
+		return shim.Error("PUF response rejected: it does not match the enrolled commitment")
+	} else if distance > ref.MaxDistance {
+		return shim.Error("PUF response rejected: Hamming distance " + strconv.Itoa(distance) + " exceeds τ=" + strconv.Itoa(ref.MaxDistance))
+	}
+
+	// ==== Only the challenge reserved for this shard and PUF is accepted, once ====
+	if len(ref.ChallengeHash) > 0 && challengeHash != ref.ChallengeHash {
+		return shim.Error("challenge " + challengeHash + " is not the one PUF " + pufId + " was enrolled with for shard " + shardId)
+	}
+	err = useChallenge(stub, shardId, pufId, challengeHash)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	pass := &pufPass{
+		ObjectType:    "pufPass",
+		SchemaVersion: schemaVersions["pufPass"],
+		ShardId:       shardId,
+		PUFId:         pufId,
+		Distance:      distance,
+		VerifiedBy:    caller.Name,
+		TxId:          stub.GetTxID(),
+	}
+	passJSONasBytes, err := json.Marshal(pass)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(passKey, passJSONasBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	previous := *shardJSON
+	shardJSON.SuccessNum++
+	if shardJSON.Status == statusAssigned && shardJSON.SuccessNum >= shardJSON.Threshold {
+		err = transitionShard(shardJSON, statusVerified)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	_, err = putShardStatus(stub, &previous, shardJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = emitShardEvent(stub, eventPUFVerified, shardJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result := &verificationResult{
+		ShardId:     shardId,
+		PUFId:       pufId,
+		Distance:    distance,
+		MaxDistance: ref.MaxDistance,
+		SuccessNum:  shardJSON.SuccessNum,
+		Threshold:   shardJSON.Threshold,
+	}
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end verifyPUFResponse (success)")
+	return shim.Success(resultAsBytes)
+}
+
+
+// ============================================================
+// pufDistance returns the Hamming distance between a submitted response and an
+// enrolled reference. A commitment matches exactly or not at all.
+// ============================================================
+func pufDistance(stub shim.ChaincodeStubInterface, refKey string, ref *pufReference, response []byte) (int, error) {
+	if ref.Kind == pufKindCommitment {
+		reference, err := hex.DecodeString(ref.Reference)
+		if err != nil {
+			return 0, err
+		}
+		salt, err := hex.DecodeString(ref.Salt)
+		if err != nil {
+			return 0, err
+		}
+		if bytes.Equal(saltedDigest(salt, response), reference) {
+			return 0, nil
+		}
+		return len(reference) * 8, nil
+	}
+	// responses enrolled before the collection existed were public and may have been replayed
+	if len(ref.Reference) > 0 {
+		return 0, fmt.Errorf("PUF %s was enrolled for shard %s with a public reference and cannot be verified", ref.PUFId, ref.ShardId)
+	}
+	// and those enrolled before version 4 were shared with the Receiver's org
+	if len(ref.Collection) == 0 {
+		return 0, fmt.Errorf("PUF %s was enrolled for shard %s in %s, which Receivers belong to, and cannot be verified", ref.PUFId, ref.ShardId, pufSharedReferenceCollection)
+	}
+	reference, err := stub.GetPrivateData(ref.Collection, refKey)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get private data from %s: %s", ref.Collection, err.Error())
+	} else if reference == nil {
+		return 0, fmt.Errorf("no reference for PUF %s of shard %s in %s", ref.PUFId, ref.ShardId, ref.Collection)
+	}
+	return hammingDistance(reference, response)
+}
+
+// deletePUFRecords removes the PUF references and passes of a deleted shard, so
+// a shard added again under its ShardId is enrolled and verified afresh
+func deletePUFRecords(stub shim.ChaincodeStubInterface, shardId string) error {
+	for _, indexName := range []string{pufRefIndexName, pufPassIndexName} {
+		resultsIterator, err := stub.GetStateByPartialCompositeKey(indexName, []string{shardId})
+		if err != nil {
+			return err
+		}
+		keys := []string{}
+		collections := map[string]string{}
+		for resultsIterator.HasNext() {
+			responseRange, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return err
+			}
+			keys = append(keys, responseRange.Key)
+			if indexName == pufRefIndexName {
+				ref := pufReference{}
+				if err := json.Unmarshal(responseRange.Value, &ref); err != nil {
+					resultsIterator.Close()
+					return err
+				}
+				collections[responseRange.Key] = ref.Collection
+				if len(ref.Collection) == 0 {
+					collections[responseRange.Key] = pufSharedReferenceCollection
+				}
+			}
+		}
+		resultsIterator.Close()
+
+		for _, key := range keys {
+			err = stub.DelState(key)
+			if err != nil {
+				return fmt.Errorf("Failed to delete %s: %s", key, err.Error())
+			}
+			if collection, ok := collections[key]; ok {
+				err = stub.DelPrivateData(collection, key)
+				if err != nil {
+					return fmt.Errorf("Failed to delete private data from %s: %s", collection, err.Error())
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// saltedDigest returns the SHA-256 of salt followed by response. An empty salt
+// gives the plain SHA-256 of older commitments.
+func saltedDigest(salt []byte, response []byte) []byte {
+	digest := sha256.Sum256(append(append([]byte{}, salt...), response...))
+	return digest[:]
+}
+
+// getTransientPUFBytes reads a reference or response from the transient map
+func getTransientPUFBytes(stub shim.ChaincodeStubInterface, key string, what string) ([]byte, error) {
+	transientMap, err := stub.GetTransient()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get transient map: %s", err.Error())
+	}
+	value, ok := transientMap[key]
+	if !ok || len(value) == 0 {
+		return nil, fmt.Errorf("%s must be passed in the transient map under %q", what, key)
+	}
+	return value, nil
+}
+
+// hammingDistance counts the bits that differ between two equally long byte strings
+func hammingDistance(a, b []byte) (int, error) {
+	if len(a) != len(b) {
+		return 0, fmt.Errorf("response length %d does not match reference length %d", len(b), len(a))
+	}
+	distance := 0
+	for i := range a {
+		distance += bits.OnesCount8(a[i] ^ b[i])
+	}
+	return distance, nil
+}
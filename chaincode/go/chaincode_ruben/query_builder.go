@@ -0,0 +1,234 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright Receivership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// structuredQuery is the client's description of a shard query, e.g.
+//   {"filters":[{"field":"Receiver","op":"$eq","value":"peer11.org1"},
+//               {"field":"SuccessNum","op":"$gte","value":3}],
+//    "sort":[{"field":"ShardId","order":"desc"}]}
+// Only the fields, operators and sort keys whitelisted below are accepted.
+type structuredQuery struct {
+	Filters	[]queryFilter	`json:"filters"`
+	Sort	[]querySort	`json:"sort"`
+}
+
+type queryFilter struct {
+	Field	string		`json:"field"`
+	Op	string		`json:"op"`
+	Value	interface{}	`json:"value"`
+}
+
+type querySort struct {
+	Field	string    `json:"field"`
+	Order	string    `json:"order"`	// "asc" or "desc"
+}
+
+// queryFieldKind tells how a whitelisted field's values are checked
+type queryFieldKind int
+
+const (
+	queryFieldName   queryFieldKind = iota // lower-cased string, like Sender and Receiver in addShard
+	queryFieldString                       // string compared as is
+	queryFieldNumber                       // integer
+)
+
+// queryFields are the shard fields a structured query may filter on
+var queryFields = map[string]queryFieldKind{
+	"Sender":     queryFieldName,
+	"Receiver":   queryFieldName,
+	"DataId":     queryFieldName,
+	"ShardId":    queryFieldString,
+	"Status":     queryFieldString,
+	"Threshold":  queryFieldNumber,
+	"PUFNum":     queryFieldNumber,
+	"SuccessNum": queryFieldNumber,
+	"CreatedAt":  queryFieldString,
+	"UpdatedAt":  queryFieldString,
+}
+
+// queryOperators are the CouchDB operators a structured query may use
+var queryOperators = map[string]bool{
+	"$eq":  true,
+	"$ne":  true,
+	"$gt":  true,
+	"$gte": true,
+	"$lt":  true,
+	"$lte": true,
+	"$in":  true,
+}
+
+// querySortFields are the shard fields a structured query may sort on
+var querySortFields = map[string]bool{
+	"ShardId":   true,
+	"Sender":    true,
+	"Receiver":  true,
+	"DataId":    true,
+	"CreatedAt": true,
+	"UpdatedAt": true,
+}
+
+
+// ===== Structured query ==================================================================
+// queryShardsStructured builds a rich query from a structuredQuery instead of executing a
+// client supplied selector. docType is always forced to "shard".
+//
+//   0                 1           2
+// "structuredQuery", "pageSize", "bookmark"
+//
+// Only available on state databases that support rich query (e.g. CouchDB)
+// =========================================================================================
+func (t *SimpleChaincode) queryShardsStructured(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 && len(args) != 3 {
+		return queryError("Incorrect number of arguments. Expecting 1 or 3(structuredQuery, pageSize, bookmark)")
+	}
+
+	query := structuredQuery{}
+	err := json.Unmarshal([]byte(args[0]), &query)
+	if err != nil {
+		return queryError("1st argument must be a structured query: " + err.Error())
+	}
+	queryString, err := buildQueryString(&query)
+	if err != nil {
+		return queryError(err.Error())
+	}
+
+	var queryResults []byte
+	if len(args) == 3 {
+		pageSize, err := parsePageSize(args[1])
+		if err != nil {
+			return queryError(err.Error())
+		}
+		queryResults, err = getQueryResultForQueryStringWithPagination(stub, queryString, pageSize, args[2])
+		if err != nil {
+			return queryError(err.Error())
+		}
+	} else {
+		queryResults, err = getQueryResultForQueryString(stub, queryString)
+		if err != nil {
+			return queryError(err.Error())
+		}
+	}
+	return shim.Success(queryResults)
+}
+
+
+// =========================================================================================
+// buildQueryString validates a structured query against the whitelists and marshals it
+// into a CouchDB selector
+// =========================================================================================
+func buildQueryString(query *structuredQuery) (string, error) {
+	selector := map[string]interface{}{}
+	for _, filter := range query.Filters {
+		kind, ok := queryFields[filter.Field]
+		if !ok {
+			return "", fmt.Errorf("field %q cannot be queried", filter.Field)
+		}
+		if !queryOperators[filter.Op] {
+			return "", fmt.Errorf("operator %q is not allowed", filter.Op)
+		}
+
+		var value interface{}
+		var err error
+		if filter.Op == "$in" {
+			values, ok := filter.Value.([]interface{})
+			if !ok || len(values) == 0 {
+				return "", fmt.Errorf("$in on %s needs a non-empty array", filter.Field)
+			}
+			checked := make([]interface{}, len(values))
+			for i, v := range values {
+				checked[i], err = checkQueryValue(filter.Field, kind, v)
+				if err != nil {
+					return "", err
+				}
+			}
+			value = checked
+		} else {
+			value, err = checkQueryValue(filter.Field, kind, filter.Value)
+			if err != nil {
+				return "", err
+			}
+		}
+
+		conditions, ok := selector[filter.Field].(map[string]interface{})
+		if !ok {
+			conditions = map[string]interface{}{}
+			selector[filter.Field] = conditions
+		}
+		if _, exists := conditions[filter.Op]; exists {
+			return "", fmt.Errorf("operator %s is given twice for %s", filter.Op, filter.Field)
+		}
+		conditions[filter.Op] = value
+	}
+	// always applied last, so no filter can widen the query beyond shards
+	selector["docType"] = "shard"
+
+	richQuery := &richQuery{Selector: selector}
+	for _, sort := range query.Sort {
+		if !querySortFields[sort.Field] {
+			return "", fmt.Errorf("cannot sort on field %q", sort.Field)
+		}
+		order := strings.ToLower(sort.Order)
+		if order == "" {
+			order = "asc"
+		}
+		if order != "asc" && order != "desc" {
+			return "", fmt.Errorf("sort order must be \"asc\" or \"desc\"")
+		}
+		richQuery.Sort = append(richQuery.Sort, map[string]string{sort.Field: order})
+	}
+
+	queryAsBytes, err := json.Marshal(richQuery)
+	if err != nil {
+		return "", err
+	}
+	return string(queryAsBytes), nil
+}
+
+// checkQueryValue makes sure a filter value is a plain string or integer of the
+// field's kind, so no operator object can be smuggled in through it
+func checkQueryValue(field string, kind queryFieldKind, value interface{}) (interface{}, error) {
+	switch kind {
+	case queryFieldName, queryFieldString:
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("value for %s must be a string", field)
+		}
+		if kind == queryFieldName {
+			s = strings.ToLower(s)
+		}
+		return s, nil
+	case queryFieldNumber:
+		n, ok := value.(float64)
+		if !ok || n != float64(int64(n)) {
+			return nil, fmt.Errorf("value for %s must be an integer", field)
+		}
+		return int64(n), nil
+	}
+	return nil, fmt.Errorf("field %q cannot be queried", field)
+}
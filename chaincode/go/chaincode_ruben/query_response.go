@@ -0,0 +1,160 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright Receivership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// queryAPIVersion is bumped whenever the shape of a query response changes
+const queryAPIVersion = "v1"
+
+// queryResponse is the envelope every query function returns. On failure the
+// envelope carries only the error and is returned as the shim error message.
+type queryResponse struct {
+	APIVersion		string    	`json:"apiVersion"`
+	Items			interface{}	`json:"items"`
+	Bookmark		string    	`json:"bookmark"`	// pass back to fetch the next page, empty on the last page
+	FetchedRecordsCount	int32		`json:"fetchedRecordsCount,omitempty"`
+	Error			string    	`json:"error,omitempty"`
+}
+
+// queryRecord is one state entry returned by a query
+type queryRecord struct {
+	Key		string    		`json:"Key"`
+	Record		json.RawMessage		`json:"Record"`
+}
+
+// historyRecord is one modification of a key returned by a history query
+type historyRecord struct {
+	TxId		string    		`json:"TxId"`
+	Value		json.RawMessage		`json:"Value"`	// null when the key was deleted
+	Timestamp	string    		`json:"Timestamp"`	// RFC 3339
+	IsDelete	bool    		`json:"IsDelete"`
+}
+
+
+// =========================================================================================
+// constructQueryResponseFromIterator drains a state iterator into query records,
+// handing out shards upgraded to the current schema
+// =========================================================================================
+func constructQueryResponseFromIterator(resultsIterator shim.StateQueryIteratorInterface) ([]queryRecord, error) {
+	records := []queryRecord{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		record, err := currentRecord(queryResponse.Value)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, queryRecord{Key: queryResponse.Key, Record: record})
+	}
+	return records, nil
+}
+
+// =========================================================================================
+// constructHistoryFromIterator drains a history iterator into history records
+// =========================================================================================
+func constructHistoryFromIterator(resultsIterator shim.HistoryQueryIteratorInterface) ([]historyRecord, error) {
+	records := []historyRecord{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		// if it was a delete operation on given key, then we need to set the
+		// corresponding value null. Else, we will write the response.Value
+		// as-is (as the Value itself a JSON shard)
+		value := json.RawMessage("null")
+		if !response.IsDelete {
+			value, err = jsonRecord(response.Value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		timestamp := ""
+		if response.Timestamp != nil {
+			timestamp = time.Unix(response.Timestamp.Seconds, int64(response.Timestamp.Nanos)).UTC().Format(time.RFC3339Nano)
+		}
+		records = append(records, historyRecord{TxId: response.TxId, Value: value, Timestamp: timestamp, IsDelete: response.IsDelete})
+	}
+	return records, nil
+}
+
+// =========================================================================================
+// newQueryResponse wraps items in the versioned envelope, adding the bookmark and
+// fetched record count when the query was paginated
+// =========================================================================================
+func newQueryResponse(items interface{}, responseMetadata *pb.QueryResponseMetadata) ([]byte, error) {
+	response := &queryResponse{APIVersion: queryAPIVersion, Items: items}
+	if responseMetadata != nil {
+		response.Bookmark = responseMetadata.Bookmark
+		response.FetchedRecordsCount = responseMetadata.FetchedRecordsCount
+	}
+	return json.Marshal(response)
+}
+
+// =========================================================================================
+// queryError returns a failed query as an envelope carrying only the error
+// =========================================================================================
+func queryError(message string) pb.Response {
+	response := &queryResponse{APIVersion: queryAPIVersion, Items: []interface{}{}, Error: message}
+	responseAsBytes, err := json.Marshal(response)
+	if err != nil {
+		return shim.Error(message)
+	}
+	return shim.Error(string(responseAsBytes))
+}
+
+// jsonRecord returns a stored value as JSON. Values that are not JSON, such as
+// index entries, are kept as a JSON string.
+func jsonRecord(value []byte) (json.RawMessage, error) {
+	if json.Valid(value) {
+		return json.RawMessage(value), nil
+	}
+	return json.Marshal(string(value))
+}
+
+// currentRecord returns a stored value as JSON like jsonRecord, decoding shards
+// so they are returned at the current schema version
+func currentRecord(value []byte) (json.RawMessage, error) {
+	doc := struct {
+		ObjectType string `json:"docType"`
+	}{}
+	if json.Unmarshal(value, &doc) != nil || doc.ObjectType != "shard" {
+		return jsonRecord(value)
+	}
+	return shardRecord(value)
+}
+
+// shardRecord decodes a stored shard and returns it at the current schema version
+func shardRecord(shardAsBytes []byte) (json.RawMessage, error) {
+	s, err := decodeShard(shardAsBytes)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(s)
+}
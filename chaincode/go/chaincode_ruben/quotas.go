@@ -0,0 +1,464 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright Receivership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// =======Quotas ===========================================================================
+// Shards and registered bytes are counted per org (MSP ID) and per identity (the
+// caller's MSP ID and common name, MSPID:name). An admin sets the limits with setQuota, for one subject
+// or as the default of a scope (Subject "*"); a limit of 0 means unlimited.
+//
+// The rate limit caps the shards added within a window. Chaincode cannot see
+// block numbers, so the window is measured on transaction timestamps: with the
+// orderer's BatchTimeout of 2s (configtx.yaml) a 10 second window spans about
+// five blocks.
+//
+// Windows only move forward: a transaction whose timestamp falls before the
+// current window is counted in the current window rather than reopening an
+// earlier one, so a client cannot backdate its proposals to spend a past window
+// again. The client also picks the timestamp, and a far-future one would move
+// the org's window ahead and lock every identity of the org out until then.
+// The stored window cannot bound it, as it may be arbitrarily old after an
+// idle period, so a timestamp more than maxClockSkew ahead of the endorsing
+// peer's clock is refused. This check does not change what is written, so
+// endorsers whose clocks differ by less than the skew agree.
+//
+// The org's usage document, QuotaUsage~org~MSPID, is a hot key: every addShard,
+// addShards and registerData of the org reads and writes it. When several of
+// them are ordered into the same block, the first one commits and the others
+// are invalidated with MVCC_READ_CONFLICT and have to be submitted again.
+// Clients of one org should batch shards with addShards rather than send
+// concurrent addShard calls. Orgs do not share usage documents, so their
+// transactions do not conflict unless they touch the same data or shard.
+// ===========================================================================================
+
+// quota holds the limits of one org or identity
+type quota struct {
+	ObjectType	string    `json:"docType"`	// "quota"
+	SchemaVersion	int 	  `json:"SchemaVersion"`
+	Scope		string    `json:"Scope"`	// "org" or "identity"
+	Subject		string    `json:"Subject"`	// MSP ID, MSPID:name of an identity, or "*" for the scope's default
+	MaxShards	int 	  `json:"MaxShards"`	// shards stored at once
+	MaxBytes	int64 	  `json:"MaxBytes"`	// TotalSize of all data registered
+	RateLimit	int 	  `json:"RateLimit"`	// shards added per window
+	RateWindow	int64 	  `json:"RateWindow"`	// window length in seconds
+	UpdatedBy	string    `json:"UpdatedBy,omitempty"`
+	UpdatedAt	string    `json:"UpdatedAt,omitempty"`	// transaction timestamp of the last setQuota, RFC 3339
+}
+
+// quotaUsage is what one org or identity has used
+type quotaUsage struct {
+	ObjectType	string    `json:"docType"`	// "quotaUsage"
+	SchemaVersion	int 	  `json:"SchemaVersion"`
+	Scope		string    `json:"Scope"`
+	Subject		string    `json:"Subject"`
+	Shards		int 	  `json:"Shards"`	// shards added and not deleted
+	Bytes		int64 	  `json:"Bytes"`	// TotalSize of all data registered
+	WindowStart	int64 	  `json:"WindowStart"`	// unix seconds the current rate window started at
+	WindowShards	int 	  `json:"WindowShards"`	// shards added in the current rate window
+}
+
+// quotaStatus is one item returned by getQuotaUsage. A nil Remaining value is unlimited.
+type quotaStatus struct {
+	Quota			*quota      `json:"Quota"`
+	Usage			*quotaUsage `json:"Usage"`
+	RemainingShards		*int        `json:"RemainingShards"`
+	RemainingBytes		*int64      `json:"RemainingBytes"`
+	RemainingInWindow	*int        `json:"RemainingInWindow"`
+}
+
+const (
+	quotaObjectType      = "Quota~Scope~Subject"
+	quotaUsageObjectType = "QuotaUsage~Scope~Subject"
+
+	quotaScopeOrg      = "org"
+	quotaScopeIdentity = "identity"
+
+	// quotaDefaultSubject names the limits of every subject of a scope without its own
+	quotaDefaultSubject = "*"
+
+	// maxClockSkew is how far, in seconds, a transaction timestamp may run ahead
+	// of the endorsing peer's clock
+	maxClockSkew = 300
+)
+
+
+// ============================================================
+// setQuota - set the limits of an org or identity, or the default of a scope
+// ============================================================
+func (t *SimpleChaincode) setQuota(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1          2            3           4            5
+	// "Scope", "Subject", "MaxShards", "MaxBytes", "RateLimit", "RateWindow"
+	if len(args) != 6 {
+		return shim.Error("Incorrect number of arguments. Expecting 6(Scope, Subject, MaxShards, MaxBytes, RateLimit, RateWindow)")
+	}
+	if args[0] != quotaScopeOrg && args[0] != quotaScopeIdentity {
+		return shim.Error("1st argument must be " + quotaScopeOrg + " or " + quotaScopeIdentity)
+	}
+	if len(args[1]) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+	maxShards, err := strconv.Atoi(args[2])
+	if err != nil || maxShards < 0 {
+		return shim.Error("3rd argument must be a non-negative numeric string")
+	}
+	maxBytes, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil || maxBytes < 0 {
+		return shim.Error("4th argument must be a non-negative numeric string")
+	}
+	rateLimit, err := strconv.Atoi(args[4])
+	if err != nil || rateLimit < 0 {
+		return shim.Error("5th argument must be a non-negative numeric string")
+	}
+	rateWindow, err := strconv.ParseInt(args[5], 10, 64)
+	if err != nil || rateWindow < 0 {
+		return shim.Error("6th argument must be a non-negative numeric string")
+	}
+	if rateLimit > 0 && rateWindow == 0 {
+		return shim.Error("6th argument must be positive when a RateLimit is set")
+	}
+	subject, err := quotaSubject(args[0], args[1])
+	if err != nil {
+		return shim.Error("2nd argument " + err.Error())
+	}
+	fmt.Println("- start setQuota ", args[0], subject)
+
+	caller, err := getCaller(stub)
+	if err != nil {
+		return shim.Error("Failed to get caller identity: " + err.Error())
+	}
+	updatedAt, err := getTxTimestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	q := &quota{
+		ObjectType:    "quota",
+		SchemaVersion: schemaVersions["quota"],
+		Scope:         args[0],
+		Subject:       subject,
+		MaxShards:     maxShards,
+		MaxBytes:      maxBytes,
+		RateLimit:     rateLimit,
+		RateWindow:    rateWindow,
+		UpdatedBy:     caller.Name,
+		UpdatedAt:     updatedAt,
+	}
+	quotaKey, err := stub.CreateCompositeKey(quotaObjectType, []string{q.Scope, q.Subject})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	quotaAsBytes, err := json.Marshal(q)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(quotaKey, quotaAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end setQuota (success)")
+	return shim.Success(quotaAsBytes)
+}
+
+
+// ============================================================
+// getQuotaUsage - return the limits, usage and remaining quota of the caller's
+// org and identity, or of the named subject for admins and auditors
+// ============================================================
+func (t *SimpleChaincode) getQuotaUsage(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0        1
+	// "Scope", "Subject"(both optional)
+	if len(args) != 0 && len(args) != 2 {
+		return queryError("Incorrect number of arguments. Expecting 0 or 2(Scope, Subject)")
+	}
+
+	caller, err := getCallerRoles(stub)
+	if err != nil {
+		return queryError("Failed to get caller identity: " + err.Error())
+	}
+	subjects := [][2]string{{quotaScopeOrg, caller.MSPID}, {quotaScopeIdentity, caller.String()}}
+	if len(args) == 2 {
+		if args[0] != quotaScopeOrg && args[0] != quotaScopeIdentity {
+			return queryError("1st argument must be " + quotaScopeOrg + " or " + quotaScopeIdentity)
+		}
+		if len(args[1]) <= 0 {
+			return queryError("2nd argument must be a non-empty string")
+		}
+		subject, err := quotaSubject(args[0], args[1])
+		if err != nil {
+			return queryError("2nd argument " + err.Error())
+		}
+		own := (args[0] == quotaScopeOrg && subject == caller.MSPID) || (args[0] == quotaScopeIdentity && subject == caller.String())
+		if !own && !containsString(caller.Roles, roleAdmin) && !containsString(caller.Roles, roleAuditor) {
+			return queryError("Caller " + caller.String() + " may only query its own quota")
+		}
+		subjects = [][2]string{{args[0], subject}}
+	}
+
+	now, err := stub.GetTxTimestamp()
+	if err != nil {
+		return queryError("Failed to get transaction timestamp: " + err.Error())
+	}
+	items := []*quotaStatus{}
+	for _, s := range subjects {
+		q, err := getQuota(stub, s[0], s[1])
+		if err != nil {
+			return queryError(err.Error())
+		}
+		u, err := getQuotaUsage(stub, s[0], s[1])
+		if err != nil {
+			return queryError(err.Error())
+		}
+		advanceWindow(q, u, now.Seconds)
+		items = append(items, newQuotaStatus(q, u))
+	}
+
+	queryResults, err := newQueryResponse(items, nil)
+	if err != nil {
+		return queryError(err.Error())
+	}
+	return shim.Success(queryResults)
+}
+
+
+// ============================================================
+// chargeQuota counts shards being added and bytes being registered against the
+// caller's org and identity, failing when either would go over its limits
+// ============================================================
+func chargeQuota(stub shim.ChaincodeStubInterface, shards int, bytes int64) error {
+	caller, err := getCallerRoles(stub)
+	if err != nil {
+		return fmt.Errorf("Failed to get caller identity: %s", err.Error())
+	}
+	now, err := stub.GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("Failed to get transaction timestamp: %s", err.Error())
+	}
+	if peerNow := time.Now().Unix(); now.Seconds > peerNow+maxClockSkew {
+		return fmt.Errorf("transaction timestamp %s is more than %d seconds ahead of the peer's clock, %s", time.Unix(now.Seconds, 0).UTC().Format(time.RFC3339), maxClockSkew, time.Unix(peerNow, 0).UTC().Format(time.RFC3339))
+	}
+
+	for _, s := range [][2]string{{quotaScopeOrg, caller.MSPID}, {quotaScopeIdentity, caller.String()}} {
+		q, err := getQuota(stub, s[0], s[1])
+		if err != nil {
+			return err
+		}
+		u, err := getQuotaUsage(stub, s[0], s[1])
+		if err != nil {
+			return err
+		}
+		advanceWindow(q, u, now.Seconds)
+
+		if q.MaxShards > 0 && u.Shards+shards > q.MaxShards {
+			return fmt.Errorf("quota exceeded: %s %s may store %d shards and has %d, cannot add %d", u.Scope, u.Subject, q.MaxShards, u.Shards, shards)
+		}
+		if q.MaxBytes > 0 && u.Bytes+bytes > q.MaxBytes {
+			return fmt.Errorf("quota exceeded: %s %s may register %d bytes and has %d, cannot add %d", u.Scope, u.Subject, q.MaxBytes, u.Bytes, bytes)
+		}
+		if q.RateLimit > 0 && u.WindowShards+shards > q.RateLimit {
+			return fmt.Errorf("rate limit exceeded: %s %s may add %d shards every %d seconds and has added %d since %s", u.Scope, u.Subject, q.RateLimit, q.RateWindow, u.WindowShards, time.Unix(u.WindowStart, 0).UTC().Format(time.RFC3339))
+		}
+
+		u.Shards += shards
+		u.Bytes += bytes
+		u.WindowShards += shards
+		err = putQuotaUsage(stub, u)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================
+// releaseQuota gives back the quota of shards deleted by the caller. Shards
+// added before quotas were tracked may take the count below zero, so it stops there.
+// ============================================================
+func releaseQuota(stub shim.ChaincodeStubInterface, shards int) error {
+	caller, err := getCallerRoles(stub)
+	if err != nil {
+		return fmt.Errorf("Failed to get caller identity: %s", err.Error())
+	}
+	for _, s := range [][2]string{{quotaScopeOrg, caller.MSPID}, {quotaScopeIdentity, caller.String()}} {
+		u, err := getQuotaUsage(stub, s[0], s[1])
+		if err != nil {
+			return err
+		}
+		u.Shards -= shards
+		if u.Shards < 0 {
+			u.Shards = 0
+		}
+		err = putQuotaUsage(stub, u)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// advanceWindow starts a new rate window when the transaction falls past the
+// current one. Windows are aligned to multiples of RateWindow and never move
+// back: an earlier transaction counts in the current window, see chargeQuota.
+func advanceWindow(q *quota, u *quotaUsage, now int64) {
+	if q.RateWindow <= 0 {
+		return
+	}
+	start := now - now%q.RateWindow
+	if start > u.WindowStart {
+		u.WindowStart = start
+		u.WindowShards = 0
+	}
+}
+
+// newQuotaStatus works out the remaining quota for getQuotaUsage
+func newQuotaStatus(q *quota, u *quotaUsage) *quotaStatus {
+	status := &quotaStatus{Quota: q, Usage: u}
+	if q.MaxShards > 0 {
+		remaining := q.MaxShards - u.Shards
+		if remaining < 0 {
+			remaining = 0
+		}
+		status.RemainingShards = &remaining
+	}
+	if q.MaxBytes > 0 {
+		remaining := q.MaxBytes - u.Bytes
+		if remaining < 0 {
+			remaining = 0
+		}
+		status.RemainingBytes = &remaining
+	}
+	if q.RateLimit > 0 {
+		remaining := q.RateLimit - u.WindowShards
+		if remaining < 0 {
+			remaining = 0
+		}
+		status.RemainingInWindow = &remaining
+	}
+	return status
+}
+
+// quotaSubject normalises a subject the way callers are named: identities are
+// MSPID:name with a lower case name like getCaller, MSP IDs are kept as they are
+func quotaSubject(scope string, subject string) (string, error) {
+	if scope != quotaScopeIdentity || subject == quotaDefaultSubject {
+		return subject, nil
+	}
+	id, err := parseIdentity(subject)
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+// ============================================================
+// getQuota loads the limits of a subject, falling back to the scope's default
+// and then to no limits at all
+// ============================================================
+func getQuota(stub shim.ChaincodeStubInterface, scope string, subject string) (*quota, error) {
+	for _, s := range []string{subject, quotaDefaultSubject} {
+		quotaKey, err := stub.CreateCompositeKey(quotaObjectType, []string{scope, s})
+		if err != nil {
+			return nil, err
+		}
+		quotaAsBytes, err := stub.GetState(quotaKey)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get quota: %s", err.Error())
+		} else if quotaAsBytes == nil {
+			continue
+		}
+
+		q := &quota{}
+		err = json.Unmarshal(quotaAsBytes, q)
+		if err != nil {
+			return nil, err
+		}
+		err = upgradeSchema(q.ObjectType, &q.SchemaVersion)
+		if err != nil {
+			return nil, err
+		}
+		return q, nil
+	}
+	return &quota{
+		ObjectType:    "quota",
+		SchemaVersion: schemaVersions["quota"],
+		Scope:         scope,
+		Subject:       quotaDefaultSubject,
+	}, nil
+}
+
+// ============================================================
+// getQuotaUsage loads what a subject has used, zero when it has used nothing
+// ============================================================
+func getQuotaUsage(stub shim.ChaincodeStubInterface, scope string, subject string) (*quotaUsage, error) {
+	usageKey, err := stub.CreateCompositeKey(quotaUsageObjectType, []string{scope, subject})
+	if err != nil {
+		return nil, err
+	}
+	usageAsBytes, err := stub.GetState(usageKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get quota usage: %s", err.Error())
+	}
+
+	u := &quotaUsage{
+		ObjectType:    "quotaUsage",
+		SchemaVersion: schemaVersions["quotaUsage"],
+		Scope:         scope,
+		Subject:       subject,
+	}
+	if usageAsBytes == nil {
+		return u, nil
+	}
+	err = json.Unmarshal(usageAsBytes, u)
+	if err != nil {
+		return nil, err
+	}
+	err = upgradeSchema(u.ObjectType, &u.SchemaVersion)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// ============================================================
+// putQuotaUsage saves what a subject has used
+// ============================================================
+func putQuotaUsage(stub shim.ChaincodeStubInterface, u *quotaUsage) error {
+	usageKey, err := stub.CreateCompositeKey(quotaUsageObjectType, []string{u.Scope, u.Subject})
+	if err != nil {
+		return err
+	}
+	usageAsBytes, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(usageKey, usageAsBytes)
+}
@@ -0,0 +1,271 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright Receivership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// roles a caller can hold. They are read from the "role" attribute of the
+// caller's certificate (comma separated, e.g. role=uploader,receiver) and from
+// the roles the configuration grants to the caller's MSP.
+const (
+	roleUploader = "uploader"
+	roleReceiver = "receiver"
+	roleVerifier = "verifier"
+	roleAuditor  = "auditor"
+	roleAdmin    = "admin"
+)
+
+// roleAttribute is the Fabric CA attribute holding a caller's roles
+const roleAttribute = "role"
+
+// statusForbidden is the response status of a call denied by checkAccess
+const statusForbidden = 403
+
+// knownRoles lists every role, in the order they are documented
+var knownRoles = []string{roleUploader, roleReceiver, roleVerifier, roleAuditor, roleAdmin}
+
+// readerRoles may call the read-only functions
+var readerRoles = knownRoles
+
+// functionRoles maps every function Invoke dispatches to the roles allowed to
+// call it; the caller must hold at least one. An empty list leaves the function
+// open to any caller. Invoke rejects a function missing here as unknown.
+var functionRoles = map[string][]string{
+	"addShard":           {roleUploader},
+	"addShards":          {roleUploader},
+	"transferShard":      {roleUploader, roleReceiver},
+	"deleteShard":        {roleUploader},
+	"enrollPUFReference": {roleUploader},
+	"registerData":       {roleUploader},
+	"putCRPs":            {roleUploader},
+	"revokeShard":        {roleUploader},
+	"setChallengeBudget": {roleUploader, roleAdmin},
+	"revokePUF":          {roleUploader, roleAdmin},
+
+	"verifyPUFResponse":    {roleReceiver, roleVerifier},
+	"releaseShard":         {roleReceiver},
+	"readShardForReceiver": {roleReceiver},
+	"getCRPs":              {roleReceiver},
+	"confirmRetrieval":     {roleReceiver},
+	"verifyCRPs":           readerRoles,
+
+	"readTombstone":             {roleAuditor, roleAdmin},
+	"getHistoryForShard":        {roleAuditor, roleAdmin},
+	"getAuditTrailForData":      {roleAuditor, roleAdmin},
+	"queryShards":               {roleAuditor, roleAdmin},
+	"queryShardsWithPagination": {roleAuditor, roleAdmin},
+
+	// shard queries would show any shard before its release, see readShard
+	"getShardsForData":                  {roleAuditor, roleAdmin},
+	"queryShardsBySender":               {roleAuditor, roleAdmin},
+	"queryShardsBySenderWithPagination": {roleAuditor, roleAdmin},
+	"queryShardsByReceiver":             {roleAuditor, roleAdmin},
+	"queryShardsByDataId":               {roleAuditor, roleAdmin},
+	"queryShardsStructured":             {roleAuditor, roleAdmin},
+	"getShardsByRange":                  {roleAuditor, roleAdmin},
+	"getShardsByRangeWithPagination":    {roleAuditor, roleAdmin},
+	"getShardsBySender":                 {roleAuditor, roleAdmin},
+	"getShardsByReceiver":               {roleAuditor, roleAdmin},
+	"getShardsByDataId":                 {roleAuditor, roleAdmin},
+	"getShardsByStatus":                 {roleAuditor, roleAdmin},
+	"queryShardsByStatus":               {roleAuditor, roleAdmin},
+	"queryShardsBySenderInWindow":       {roleAuditor, roleAdmin},
+	"queryShardsByReceiverInWindow":     {roleAuditor, roleAdmin},
+	"queryShardsByDataIdInWindow":       {roleAuditor, roleAdmin},
+
+	"migrateShards":       {roleAdmin},
+	"setQuota":            {roleAdmin},
+	"setShardEndorsement": {roleAdmin},
+	"registerPUF":         {roleAdmin},
+
+	"readShard":              readerRoles,
+	"getReleaseStatus":       readerRoles,
+	"getData":                readerRoles,
+	"getCRPsHash":            readerRoles,
+	"getRemainingChallenges": readerRoles,
+	"getPUF":                 readerRoles,
+	"listPUFsByOrg":          readerRoles,
+	"getPublicKey":           readerRoles,
+	"getShardEndorsement":    readerRoles,
+
+	// every identity manages its own encryption key, whatever its roles
+	"publishKey": {},
+	"rotateKey":  {},
+	"revokeKey":  {},
+
+	"getFunctionRoles": {},
+	"getCallerRoles":   {},
+	"getQuotaUsage":    {},
+	"getMetadata":      {},
+}
+
+// callerRoles is returned by getCallerRoles
+type callerRoles struct {
+	identity
+	Roles	[]string  `json:"Roles"`
+}
+
+
+// ===========================================================
+// checkAccess returns an authorization error response when the caller holds
+// none of the roles function requires, nil when the call may proceed
+// ===========================================================
+func checkAccess(stub shim.ChaincodeStubInterface, function string) *pb.Response {
+	required, ok := functionRoles[function]
+	if !ok {
+		return authorizationError("function " + function + " has no roles defined")
+	}
+	if len(required) == 0 {
+		return nil
+	}
+
+	caller, err := getCallerRoles(stub)
+	if err != nil {
+		return authorizationError("cannot read caller identity: " + err.Error())
+	}
+	for _, role := range required {
+		if containsString(caller.Roles, role) {
+			return nil
+		}
+	}
+	return authorizationError(fmt.Sprintf("%s requires one of the roles [%s], caller %s of %s has [%s]",
+		function, strings.Join(required, ","), caller.Name, caller.MSPID, strings.Join(caller.Roles, ",")))
+}
+
+// authorizationError is the response of every denied call
+func authorizationError(reason string) *pb.Response {
+	return &pb.Response{
+		Status:  statusForbidden,
+		Message: "access denied: " + reason,
+	}
+}
+
+// getCallerRoles collects the roles of the caller from its certificate's role
+// attribute and from the roles the configuration grants to its MSP
+func getCallerRoles(stub shim.ChaincodeStubInterface) (*callerRoles, error) {
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	roles := []string{}
+	value, found, err := cid.GetAttributeValue(stub, roleAttribute)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		for _, role := range strings.Split(value, ",") {
+			role = strings.TrimSpace(role)
+			if role != "" && !containsString(roles, role) {
+				roles = append(roles, role)
+			}
+		}
+	}
+	for _, role := range config.MSPRoles[caller.MSPID] {
+		if !containsString(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+	sort.Strings(roles)
+
+	return &callerRoles{identity: *caller, Roles: roles}, nil
+}
+
+// parseMSPRoles parses an Init roles setting, MSPID:role[|role...]
+func parseMSPRoles(setting string) (string, []string, error) {
+	parts := strings.SplitN(setting, ":", 2)
+	if len(parts) != 2 || len(parts[0]) <= 0 {
+		return "", nil, fmt.Errorf("roles must be of the form MSPID:role[|role...]")
+	}
+	roles := []string{}
+	if parts[1] == "" {
+		return parts[0], roles, nil
+	}
+	for _, role := range strings.Split(parts[1], "|") {
+		if !containsString(knownRoles, role) {
+			return "", nil, fmt.Errorf("unknown role %q, expecting one of %s", role, strings.Join(knownRoles, ", "))
+		}
+		if !containsString(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+	return parts[0], roles, nil
+}
+
+
+// ============================================================
+// getFunctionRoles - list the roles each function requires, or the roles of a
+// single function. An empty list means any caller.
+// ============================================================
+func (t *SimpleChaincode) getFunctionRoles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1(function)")
+	}
+
+	result := functionRoles
+	if len(args) == 1 {
+		required, ok := functionRoles[args[0]]
+		if !ok {
+			return shim.Error("function " + args[0] + " is not defined")
+		}
+		result = map[string][]string{args[0]: required}
+	}
+
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(resultAsBytes)
+}
+
+
+// ============================================================
+// getCallerRoles - report the caller's MSP ID, name and roles
+// ============================================================
+func (t *SimpleChaincode) getCallerRoles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	caller, err := getCallerRoles(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	callerAsBytes, err := json.Marshal(caller)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(callerAsBytes)
+}
@@ -0,0 +1,211 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright Receivership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// releaseStatus is returned by getReleaseStatus
+type releaseStatus struct {
+	ShardId		string    `json:"ShardId"`
+	Receiver	string    `json:"Receiver"`
+	Status		string    `json:"Status"`	// "pending verification", "ready", "released" or "revoked"
+	ShardStatus	string    `json:"ShardStatus"`	// lifecycle status of the shard
+	SuccessNum	int 	  `json:"SuccessNum"`
+	Threshold	int 	  `json:"Threshold"`
+	ReleasedTo	string    `json:"ReleasedTo,omitempty"`
+	ReleasedAt	string    `json:"ReleasedAt,omitempty"`
+}
+
+const (
+	releaseStatusPending  = "pending verification"
+	releaseStatusReady    = "ready"
+	releaseStatusReleased = "released"
+	releaseStatusRevoked  = "revoked"
+)
+
+
+// ============================================================
+// releaseShard - release a shard to its Receiver once at least Threshold of
+// its PUFNum PUFs have passed verifyPUFResponse, and record the release
+// ============================================================
+func (t *SimpleChaincode) releaseShard(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1(ShardId)")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	shardId := args[0]
+	fmt.Println("- start releaseShard ", shardId)
+
+	shardJSON, err := getShardForReceiver(stub, shardId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	releasedAt, err := getTxTimestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	previous := *shardJSON
+	err = transitionShard(shardJSON, statusReleased)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	shardJSON.ReleasedTo = shardJSON.Receiver
+	shardJSON.ReleasedAt = releasedAt
+
+	shardJSONasBytes, err := putShardStatus(stub, &previous, shardJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = emitShardEvent(stub, eventShardReleased, shardJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end releaseShard (success)")
+	return shim.Success(shardJSONasBytes)
+}
+
+
+// ============================================================
+// readShardForReceiver - read a shard as its Receiver without recording a
+// release. Refused until at least Threshold PUFs have passed verification.
+// ============================================================
+func (t *SimpleChaincode) readShardForReceiver(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1(ShardId)")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	shardJSON, err := getShardForReceiver(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	shardJSONasBytes, err := json.Marshal(shardJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(shardJSONasBytes)
+}
+
+
+// ============================================================
+// getReleaseStatus - report whether a shard is still pending verification,
+// ready to be released, or already released. Only the shard's Sender and
+// Receiver, auditors and admins may ask.
+// ============================================================
+func (t *SimpleChaincode) getReleaseStatus(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1(ShardId)")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+
+	shardJSON, err := getShard(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	caller, err := getCallerRoles(stub)
+	if err != nil {
+		return shim.Error("Failed to get caller identity: " + err.Error())
+	}
+	if !containsString(caller.Roles, roleAuditor) && !containsString(caller.Roles, roleAdmin) &&
+		!caller.is(shardJSON.Sender, shardJSON.SenderMSP) && !caller.is(shardJSON.Receiver, shardJSON.ReceiverMSP) {
+		return shim.Error("Caller " + caller.String() + " is neither the Sender nor the Receiver of shard " + shardJSON.ShardId)
+	}
+
+	status := &releaseStatus{
+		ShardId:     shardJSON.ShardId,
+		Receiver:    shardJSON.Receiver,
+		Status:      releaseStatusReady,
+		ShardStatus: shardJSON.Status,
+		SuccessNum:  shardJSON.SuccessNum,
+		Threshold:   shardJSON.Threshold,
+		ReleasedTo:  shardJSON.ReleasedTo,
+		ReleasedAt:  shardJSON.ReleasedAt,
+	}
+	switch shardJSON.Status {
+	case statusCreated, statusAssigned:
+		status.Status = releaseStatusPending
+	case statusReleased, statusRetrieved:
+		status.Status = releaseStatusReleased
+	case statusRevoked:
+		status.Status = releaseStatusRevoked
+	}
+
+	statusAsBytes, err := json.Marshal(status)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(statusAsBytes)
+}
+
+
+// ============================================================
+// getShardForReceiver loads a shard on behalf of its Receiver, refusing other
+// callers, shards that have not yet been Verified and revoked shards
+// ============================================================
+func getShardForReceiver(stub shim.ChaincodeStubInterface, shardId string) (*shard, error) {
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get caller identity: %s", err.Error())
+	}
+
+	shardJSON, err := getShard(stub, shardId)
+	if err != nil {
+		return nil, err
+	}
+	err = checkShardForReceiver(caller, shardJSON)
+	if err != nil {
+		return nil, err
+	}
+	return shardJSON, nil
+}
+
+// checkShardForReceiver refuses a shard to a caller other than its Receiver, and
+// to the Receiver while the shard is not yet Verified or is revoked
+func checkShardForReceiver(caller *identity, s *shard) error {
+	if !caller.is(s.Receiver, s.ReceiverMSP) {
+		return fmt.Errorf("Caller %s is not the Receiver of shard %s", caller.String(), s.ShardId)
+	}
+	if s.Status == statusCreated || s.Status == statusAssigned {
+		return fmt.Errorf("shard %s is %s: %d of %d required PUFs verified", s.ShardId, releaseStatusPending, s.SuccessNum, s.Threshold)
+	}
+	if s.Status == statusRevoked {
+		return fmt.Errorf("shard %s is %s: %s", s.ShardId, statusRevoked, s.RevokeReason)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright Receivership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// richQuery is a CouchDB Mango query
+type richQuery struct {
+	Selector	map[string]interface{}	`json:"selector"`
+	Sort		[]map[string]string	`json:"sort,omitempty"`
+	UseIndex	[]string		`json:"use_index,omitempty"`
+}
+
+// shardFieldIndexes names the CouchDB index shipped in META-INF/statedb/couchdb/indexes
+// for each shard field that has a parameterized rich query
+var shardFieldIndexes = map[string][]string{
+	"Sender":   {"_design/indexSenderDoc", "indexSender"},
+	"Receiver": {"_design/indexReceiverDoc", "indexReceiver"},
+	"DataId":   {"_design/indexDataIdDoc", "indexDataId"},
+	"Status":   {"_design/indexStatusDoc", "indexStatus"},
+}
+
+
+// ===== Parameterized rich queries ========================================================
+// queryShardsByReceiver and queryShardsByDataId select shards on one field using the
+// CouchDB indexes shipped with the chaincode, optionally sorted by ShardId and paginated:
+//
+//   0        1                       2           3
+// "value", "asc"|"desc"|"",       "pageSize", "bookmark"
+//
+// Only available on state databases that support rich query (e.g. CouchDB)
+// =========================================================================================
+func (t *SimpleChaincode) queryShardsByReceiver(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return queryShardsByField(stub, "Receiver", args)
+}
+
+func (t *SimpleChaincode) queryShardsByDataId(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return queryShardsByField(stub, "DataId", args)
+}
+
+
+// =========================================================================================
+// queryShardsByField runs the parameterized rich query for one indexed shard field
+// =========================================================================================
+func queryShardsByField(stub shim.ChaincodeStubInterface, field string, args []string) pb.Response {
+	if len(args) != 1 && len(args) != 2 && len(args) != 4 {
+		return queryError("Incorrect number of arguments. Expecting 1, 2 or 4(" + field + ", sortOrder, pageSize, bookmark)")
+	}
+	if len(args[0]) <= 0 {
+		return queryError("1st argument must be a non-empty string")
+	}
+	value := strings.ToLower(args[0])
+	if field == "Status" {
+		status, err := parseShardStatus(args[0])
+		if err != nil {
+			return queryError(err.Error())
+		}
+		value = status
+	}
+	sortOrder := ""
+	if len(args) >= 2 {
+		sortOrder = strings.ToLower(args[1])
+	}
+
+	queryString, err := shardFieldQueryString(field, value, sortOrder)
+	if err != nil {
+		return queryError(err.Error())
+	}
+
+	var queryResults []byte
+	if len(args) == 4 {
+		pageSize, err := parsePageSize(args[2])
+		if err != nil {
+			return queryError(err.Error())
+		}
+		queryResults, err = getQueryResultForQueryStringWithPagination(stub, queryString, pageSize, args[3])
+		if err != nil {
+			return queryError(err.Error())
+		}
+	} else {
+		queryResults, err = getQueryResultForQueryString(stub, queryString)
+		if err != nil {
+			return queryError(err.Error())
+		}
+	}
+	return shim.Success(queryResults)
+}
+
+
+// =========================================================================================
+// shardFieldQueryString builds the selector for docType "shard" and field == value.
+// The query is marshaled rather than formatted, so value cannot alter its structure.
+// =========================================================================================
+func shardFieldQueryString(field string, value string, sortOrder string) (string, error) {
+	index, ok := shardFieldIndexes[field]
+	if !ok {
+		return "", fmt.Errorf("no index for shard field %s", field)
+	}
+
+	query := &richQuery{
+		Selector: map[string]interface{}{"docType": "shard", field: value},
+		UseIndex: index,
+	}
+	switch sortOrder {
+	case "":
+	case "asc", "desc":
+		// CouchDB only sorts on an index when every sort field is in it, in the same direction
+		query.Sort = []map[string]string{{"docType": sortOrder}, {field: sortOrder}, {"ShardId": sortOrder}}
+	default:
+		return "", fmt.Errorf("sortOrder must be \"asc\" or \"desc\"")
+	}
+
+	queryAsBytes, err := json.Marshal(query)
+	if err != nil {
+		return "", err
+	}
+	return string(queryAsBytes), nil
+}
@@ -0,0 +1,258 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright Receivership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// =======Schema versions ===================================================================
+// Every stored document carries the SchemaVersion of its docType it was written with.
+// Documents written before versioning have none and count as version 1.
+// A reader upgrades an older document when loading it; migrateShards rewrites
+// stored shards so queries see the current version too.
+//
+// shard history:
+//   1 - Sender, ShardId, DataId, Receiver, Threshold, PUFNum, SuccessNum and the
+//       transfer and release fields
+//   2 - Status, Released when upgrading a shard with ReleasedTo and Created
+//       otherwise; SuccessNum was client-supplied and is reset for the latter
+//   3 - PUFIds, left empty when upgrading: older shards only have a PUFNum
+//   4 - ModifiedByMSP, ModifiedBySubject and ModifiedIn, left empty when upgrading
+//       until the shard is next written
+//   5 - SenderMSP and ReceiverMSP, left empty when upgrading: such shards keep the
+//       chaincode-wide endorsement policy until an admin gives setShardEndorsement
+//       a list of MSP IDs, and no caller passes their Sender and Receiver checks,
+//       which compare MSP IDs too
+//   6 - CreatedAt and UpdatedAt, left empty when upgrading. CreatedAt stays empty;
+//       UpdatedAt is set by the shard's next change, not by migrateShards
+//
+// tombstone history:
+//   1 - ShardId, DataId, Sender, Receiver, DeletedBy, DeletedAt, Reason, TxId
+//   2 - DeletedByMSP and DeletedBySubject, left empty when upgrading
+//
+// data history:
+//   1 - DataId, Owner, ShardCount, ShardIds, TotalSize, ShardsAdded, Complete
+//   2 - OwnerMSP, left empty when upgrading: no shard can be added to such a file
+//
+// pufReference history:
+//   1 - ShardId, PUFId, Kind, Reference (public hex response or SHA-256), MaxDistance
+//   2 - Salt; a response's Reference moves to collectionPUFReferences. Upgraded
+//       commitments keep an empty Salt and still verify, upgraded responses do not.
+//   3 - ChallengeHash, left empty when upgrading: such a reference verifies
+//       against any challenge reserved for its shard and PUF
+//   4 - Collection: a response moves to the Sender org's collectionPUFReferences<MSPID>.
+//       Upgraded responses stay in the shared collectionPUFReferences, which the
+//       Receiver's org is a member of, and no longer verify.
+//
+// encryptionKey history:
+//   1 - Owner, OwnerMSP, PublicKey, Fingerprint, Signature, Version, Status and
+//       the rotation and revocation fields
+//   2 - Certificate, left empty when upgrading: senders cannot check the Signature
+//       of such a key and refuse it until its owner rotates it
+// ===========================================================================================
+var schemaVersions = map[string]int{
+	"shard":            6,
+	"tombstone":        2,
+	"data":             2,
+	"pufReference":     4,
+	"pufPass":          1,
+	"crpsHash":         1,
+	"config":           1,
+	"challenge":        1,
+	"challengeCounter": 1,
+	"puf":              1,
+	"encryptionKey":    2,
+	"quota":            1,
+	"quotaUsage":       1,
+}
+
+// shardUpgrades moves a shard from the version it is keyed by to the next one
+var shardUpgrades = map[int]func(s *shard){
+	1: deriveShardStatus,
+	2: func(s *shard) {},
+	3: func(s *shard) {},
+	4: func(s *shard) {},
+	5: func(s *shard) {},
+}
+
+// maxMigrationBatch caps the number of shards one migrateShards transaction rewrites
+const maxMigrationBatch = maxPageSize
+
+// migrationResult is returned by migrateShards
+type migrationResult struct {
+	Scanned		int       `json:"Scanned"`
+	Migrated	int       `json:"Migrated"`
+	NextKey		string    `json:"NextKey"`	// startKey of the next batch, empty once the range is done
+}
+
+
+// ===========================================================
+// upgradeSchema checks the version of a document other than a shard and stamps
+// it with the current one. Changes to those documents have only added optional
+// fields so far, which need no conversion.
+// ===========================================================
+func upgradeSchema(docType string, version *int) error {
+	current := schemaVersions[docType]
+	if *version > current {
+		return fmt.Errorf("%s was written with schema version %d, this chaincode knows up to %d", docType, *version, current)
+	}
+	*version = current
+	return nil
+}
+
+// ===========================================================
+// upgradeShard brings a decoded shard up to the current schema version and
+// reports whether anything had to change
+// ===========================================================
+func upgradeShard(s *shard) (bool, error) {
+	current := schemaVersions["shard"]
+	if s.SchemaVersion == 0 {
+		s.SchemaVersion = 1
+	}
+	if s.SchemaVersion > current {
+		return false, fmt.Errorf("shard %s was written with schema version %d, this chaincode knows up to %d", s.ShardId, s.SchemaVersion, current)
+	}
+	upgraded := false
+	for s.SchemaVersion < current {
+		shardUpgrades[s.SchemaVersion](s)
+		s.SchemaVersion++
+		upgraded = true
+	}
+	return upgraded, nil
+}
+
+// ===========================================================
+// decodeShard decodes a stored shard and upgrades it to the current schema version
+// ===========================================================
+func decodeShard(shardAsBytes []byte) (*shard, error) {
+	s := &shard{}
+	err := json.Unmarshal(shardAsBytes, s)
+	if err != nil {
+		return nil, err
+	}
+	_, err = upgradeShard(s)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+
+// ============================================================
+// migrateShards - rewrite the shards with keys in [startKey, endKey) that are
+// older than the current schema version, at most limit (default and cap
+// maxMigrationBatch) of them per transaction. Call again with the returned
+// NextKey as startKey until it comes back empty. Empty keys leave the range open.
+// ============================================================
+func (t *SimpleChaincode) migrateShards(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0           1         2
+	// "startKey", "endKey", "limit"
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 or 3(startKey, endKey, limit)")
+	}
+	startKey := args[0]
+	endKey := args[1]
+	limit := maxMigrationBatch
+	if len(args) == 3 {
+		var err error
+		limit, err = strconv.Atoi(args[2])
+		if err != nil || limit <= 0 {
+			return shim.Error("3rd argument must be a positive numeric string")
+		}
+		if limit > maxMigrationBatch {
+			limit = maxMigrationBatch
+		}
+	}
+	fmt.Printf("- start migrateShards [%s, %s) limit %d\n", startKey, endKey, limit)
+
+	// paginated queries are not available to update transactions, so the batch
+	// is bounded by counting instead
+	resultsIterator, err := stub.GetStateByRange(startKey, endKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	result := &migrationResult{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if result.Scanned == limit {
+			result.NextKey = queryResponse.Key
+			break
+		}
+		result.Scanned++
+
+		s := &shard{}
+		err = json.Unmarshal(queryResponse.Value, s)
+		if err != nil || s.ObjectType != "shard" {
+			// not a shard, nothing to migrate
+			continue
+		}
+		upgraded, err := upgradeShard(s)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if !upgraded {
+			continue
+		}
+		// a migration changes how the shard is stored, not the shard, so UpdatedAt
+		// keeps the time of its last change, empty when that is not recorded. The
+		// times are not recovered from the shard's history: history reads are not
+		// validated at commit and need not be enabled on every peer.
+		updatedAt := s.UpdatedAt
+		err = stampShard(stub, s)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		s.UpdatedAt = updatedAt
+
+		shardJSONasBytes, err := json.Marshal(s)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = stub.PutState(queryResponse.Key, shardJSONasBytes)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		// fields added by an upgrade may be indexed, so write every entry again
+		err = updateShardIndexes(stub, nil, s)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		result.Migrated++
+	}
+
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- end migrateShards: %s\n", string(resultAsBytes))
+	return shim.Success(resultAsBytes)
+}
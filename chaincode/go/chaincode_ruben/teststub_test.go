@@ -0,0 +1,640 @@
+package main
+
+import (
+	"container/list"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// testStub wraps the shim MockStub with what it lacks for this chaincode: a
+// creator identity, a fake CouchDB rich-query backend, key history, paginated
+// queries, and rollback of a transaction's writes and key-level endorsement
+// policies when it fails, as a peer would.
+type testStub struct {
+	*shim.MockStub
+
+	args      [][]byte
+	creator   []byte
+	transient map[string][]byte
+
+	txCount int
+	txTime  time.Time // timestamp of tx1; each transaction is one second later
+
+	history map[string][]*queryresult.KeyModification
+	pending []pendingWrite
+	event   *pb.ChaincodeEvent
+	events  []*pb.ChaincodeEvent
+
+	reads map[string]bool // keys read with GetState, while invokeBlock endorses
+}
+
+type pendingWrite struct {
+	key string
+	mod *queryresult.KeyModification
+}
+
+func newTestStub() *testStub {
+	return &testStub{
+		MockStub: shim.NewMockStub("chaincode_ruben", new(SimpleChaincode)),
+		txTime:   time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		history:  map[string][]*queryresult.KeyModification{},
+	}
+}
+
+// invoke runs one transaction as creator. When it fails, its writes, history
+// and event are discarded.
+func (s *testStub) invoke(creator []byte, function string, args ...string) pb.Response {
+	return s.run(creator, function, args, false)
+}
+
+// invokeWithTransient runs one transaction as creator with the given transient map
+func (s *testStub) invokeWithTransient(creator []byte, transient map[string][]byte, function string, args ...string) pb.Response {
+	s.transient = transient
+	defer func() { s.transient = nil }()
+	return s.run(creator, function, args, false)
+}
+
+// init runs Init as creator with the given arguments
+func (s *testStub) init(creator []byte, args ...string) pb.Response {
+	return s.run(creator, "init", args, true)
+}
+
+func (s *testStub) run(creator []byte, function string, args []string, isInit bool) pb.Response {
+	s.txCount++
+	txID := "tx" + strconv.Itoa(s.txCount)
+
+	s.args = [][]byte{[]byte(function)}
+	for _, arg := range args {
+		s.args = append(s.args, []byte(arg))
+	}
+	s.creator = creator
+	s.pending = nil
+	s.event = nil
+
+	snapshot := make(map[string][]byte, len(s.State))
+	for key, value := range s.State {
+		snapshot[key] = value
+	}
+	policies := make(map[string][]byte, len(s.EndorsementPolicies))
+	for key, value := range s.EndorsementPolicies {
+		policies[key] = value
+	}
+
+	s.MockTransactionStart(txID)
+	now := s.txTime.Add(time.Duration(s.txCount-1) * time.Second)
+	s.TxTimestamp = &timestamp.Timestamp{Seconds: now.Unix(), Nanos: int32(now.Nanosecond())}
+
+	var res pb.Response
+	if isInit {
+		res = new(SimpleChaincode).Init(s)
+	} else {
+		res = new(SimpleChaincode).Invoke(s)
+	}
+	s.MockTransactionEnd(txID)
+
+	if res.Status != shim.OK {
+		s.restore(snapshot)
+		s.EndorsementPolicies = policies
+		return res
+	}
+	for _, write := range s.pending {
+		s.history[write.key] = append(s.history[write.key], write.mod)
+	}
+	if s.event != nil {
+		s.events = append(s.events, s.event)
+	}
+	return res
+}
+
+// blockTx is one transaction of a block run by invokeBlock
+type blockTx struct {
+	creator  []byte
+	function string
+	args     []string
+}
+
+// endorsement is what invokeBlock keeps of a simulated transaction
+type endorsement struct {
+	res      pb.Response
+	reads    map[string]bool
+	writes   map[string][]byte // nil for a deleted key
+	policies map[string][]byte
+	pending  []pendingWrite
+	event    *pb.ChaincodeEvent
+}
+
+// invokeBlock endorses every transaction against the same state, as peers do
+// for the transactions ordered into one block, then commits them in order. A
+// transaction that read a key written by an earlier valid transaction of the
+// block is invalidated with MVCC_READ_CONFLICT, as the committing peer does.
+// Only GetState reads are checked; range and rich queries are not.
+func (s *testStub) invokeBlock(txs ...blockTx) []pb.Response {
+	base := copyState(s.State)
+	basePolicies := copyState(s.EndorsementPolicies)
+	baseHistory := s.history
+	baseEvents := len(s.events)
+
+	endorsements := []endorsement{}
+	for _, tx := range txs {
+		s.restore(copyState(base))
+		s.EndorsementPolicies = copyState(basePolicies)
+		s.history = copyHistory(baseHistory)
+		s.reads = map[string]bool{}
+		res := s.run(tx.creator, tx.function, tx.args, false)
+		endorsements = append(endorsements, endorsement{
+			res:      res,
+			reads:    s.reads,
+			writes:   changedKeys(base, s.State),
+			policies: changedKeys(basePolicies, s.EndorsementPolicies),
+			pending:  s.pending,
+			event:    s.event,
+		})
+	}
+	s.reads = nil
+
+	state := copyState(base)
+	policies := copyState(basePolicies)
+	s.history = baseHistory
+	s.events = s.events[:baseEvents]
+	written := map[string]bool{}
+	responses := []pb.Response{}
+	for _, e := range endorsements {
+		if e.res.Status != shim.OK {
+			responses = append(responses, e.res)
+			continue
+		}
+		if key, ok := readConflict(e.reads, written); ok {
+			responses = append(responses, shim.Error("MVCC_READ_CONFLICT on "+key))
+			continue
+		}
+		applyChanges(state, e.writes)
+		applyChanges(policies, e.policies)
+		for key := range e.writes {
+			written[key] = true
+		}
+		for _, write := range e.pending {
+			s.history[write.key] = append(s.history[write.key], write.mod)
+		}
+		if e.event != nil {
+			s.events = append(s.events, e.event)
+		}
+		responses = append(responses, e.res)
+	}
+	s.restore(state)
+	s.EndorsementPolicies = policies
+	return responses
+}
+
+func copyState(state map[string][]byte) map[string][]byte {
+	c := make(map[string][]byte, len(state))
+	for key, value := range state {
+		c[key] = value
+	}
+	return c
+}
+
+func copyHistory(history map[string][]*queryresult.KeyModification) map[string][]*queryresult.KeyModification {
+	c := make(map[string][]*queryresult.KeyModification, len(history))
+	for key, mods := range history {
+		c[key] = append([]*queryresult.KeyModification(nil), mods...)
+	}
+	return c
+}
+
+// changedKeys lists the keys whose value differs from base, nil for deleted ones
+func changedKeys(base map[string][]byte, state map[string][]byte) map[string][]byte {
+	changes := map[string][]byte{}
+	for key, value := range state {
+		if old, ok := base[key]; !ok || string(old) != string(value) {
+			changes[key] = value
+		}
+	}
+	for key := range base {
+		if _, ok := state[key]; !ok {
+			changes[key] = nil
+		}
+	}
+	return changes
+}
+
+func applyChanges(state map[string][]byte, changes map[string][]byte) {
+	for key, value := range changes {
+		if value == nil {
+			delete(state, key)
+		} else {
+			state[key] = value
+		}
+	}
+}
+
+// readConflict returns the first key, in key order, that was read and written
+func readConflict(reads map[string]bool, written map[string]bool) (string, bool) {
+	keys := []string{}
+	for key := range reads {
+		if written[key] {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return "", false
+	}
+	sort.Strings(keys)
+	return keys[0], true
+}
+
+// putRaw writes a value straight into the world state, bypassing the chaincode,
+// e.g. a document written by an older chaincode version
+func (s *testStub) putRaw(key string, value []byte) {
+	s.State[key] = value
+	s.restore(s.State)
+}
+
+func (s *testStub) restore(snapshot map[string][]byte) {
+	keys := make([]string, 0, len(snapshot))
+	for key := range snapshot {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	s.Keys = list.New()
+	for _, key := range keys {
+		s.Keys.PushBack(key)
+	}
+	s.State = snapshot
+}
+
+// lastEvent returns the event of the last successful transaction that set one
+func (s *testStub) lastEvent() *pb.ChaincodeEvent {
+	if len(s.events) == 0 {
+		return nil
+	}
+	return s.events[len(s.events)-1]
+}
+
+func (s *testStub) GetArgs() [][]byte {
+	return s.args
+}
+
+func (s *testStub) GetStringArgs() []string {
+	args := make([]string, len(s.args))
+	for i, arg := range s.args {
+		args[i] = string(arg)
+	}
+	return args
+}
+
+func (s *testStub) GetFunctionAndParameters() (string, []string) {
+	args := s.GetStringArgs()
+	if len(args) == 0 {
+		return "", []string{}
+	}
+	return args[0], args[1:]
+}
+
+func (s *testStub) GetCreator() ([]byte, error) {
+	return s.creator, nil
+}
+
+func (s *testStub) GetTransient() (map[string][]byte, error) {
+	return s.transient, nil
+}
+
+func (s *testStub) SetEvent(name string, payload []byte) error {
+	if name == "" {
+		return fmt.Errorf("event name can not be nil string")
+	}
+	s.event = &pb.ChaincodeEvent{TxId: s.TxID, EventName: name, Payload: payload}
+	return nil
+}
+
+func (s *testStub) GetState(key string) ([]byte, error) {
+	if s.reads != nil {
+		s.reads[key] = true
+	}
+	return s.MockStub.GetState(key)
+}
+
+func (s *testStub) PutState(key string, value []byte) error {
+	if err := s.MockStub.PutState(key, value); err != nil {
+		return err
+	}
+	s.pending = append(s.pending, pendingWrite{key, &queryresult.KeyModification{TxId: s.TxID, Value: value, Timestamp: s.TxTimestamp}})
+	return nil
+}
+
+// DelState also drops the key's endorsement policy, as a peer does
+func (s *testStub) DelState(key string) error {
+	if err := s.MockStub.DelState(key); err != nil {
+		return err
+	}
+	delete(s.EndorsementPolicies, key)
+	s.pending = append(s.pending, pendingWrite{key, &queryresult.KeyModification{TxId: s.TxID, Timestamp: s.TxTimestamp, IsDelete: true}})
+	return nil
+}
+
+// DelPrivateData is not implemented by MockStub
+func (s *testStub) DelPrivateData(collection string, key string) error {
+	delete(s.PvtState[collection], key)
+	return nil
+}
+
+func (s *testStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	return &historyIterator{mods: s.history[key]}, nil
+}
+
+func (s *testStub) GetStateByRangeWithPagination(startKey, endKey string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	iter, err := s.MockStub.GetStateByRange(startKey, endKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	kvs, err := drain(iter)
+	if err != nil {
+		return nil, nil, err
+	}
+	it, metadata := page(kvs, pageSize, bookmark)
+	return it, metadata, nil
+}
+
+func (s *testStub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	iter, err := s.MockStub.GetStateByPartialCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	kvs, err := drain(iter)
+	if err != nil {
+		return nil, nil, err
+	}
+	it, metadata := page(kvs, pageSize, bookmark)
+	return it, metadata, nil
+}
+
+// GetQueryResult is the fake rich-query backend. It understands the subset of
+// CouchDB Mango queries the chaincode builds: a selector of equalities and
+// $eq/$ne/$gt/$gte/$lt/$lte/$in conditions, and sort. use_index is ignored.
+func (s *testStub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	kvs, err := s.richQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	return &sliceIterator{kvs: kvs}, nil
+}
+
+func (s *testStub) GetQueryResultWithPagination(query string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	kvs, err := s.richQuery(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	it, metadata := page(kvs, pageSize, bookmark)
+	return it, metadata, nil
+}
+
+func (s *testStub) richQuery(query string) ([]*queryresult.KV, error) {
+	var q struct {
+		Selector map[string]interface{} `json:"selector"`
+		Sort     []map[string]string    `json:"sort"`
+	}
+	if err := json.Unmarshal([]byte(query), &q); err != nil {
+		return nil, fmt.Errorf("invalid query: %s", err)
+	}
+
+	kvs := []*queryresult.KV{}
+	docs := map[string]map[string]interface{}{}
+	for elem := s.Keys.Front(); elem != nil; elem = elem.Next() {
+		key := elem.Value.(string)
+		if strings.HasPrefix(key, "\x00") {
+			continue // composite keys are not CouchDB documents
+		}
+		doc := map[string]interface{}{}
+		if err := json.Unmarshal(s.State[key], &doc); err != nil {
+			continue
+		}
+		ok, err := matchSelector(doc, q.Selector)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			kvs = append(kvs, &queryresult.KV{Key: key, Value: s.State[key]})
+			docs[key] = doc
+		}
+	}
+
+	sort.SliceStable(kvs, func(i, j int) bool {
+		for _, sortField := range q.Sort {
+			for field, order := range sortField {
+				c, _ := compareValues(docs[kvs[i].Key][field], docs[kvs[j].Key][field])
+				if c == 0 {
+					continue
+				}
+				if order == "desc" {
+					return c > 0
+				}
+				return c < 0
+			}
+		}
+		return false
+	})
+	return kvs, nil
+}
+
+func matchSelector(doc map[string]interface{}, selector map[string]interface{}) (bool, error) {
+	for field, condition := range selector {
+		value := doc[field]
+		operators, isOperators := condition.(map[string]interface{})
+		if !isOperators {
+			operators = map[string]interface{}{"$eq": condition}
+		}
+		for op, operand := range operators {
+			ok, err := matchOperator(value, op, operand)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
+
+func matchOperator(value interface{}, op string, operand interface{}) (bool, error) {
+	if op == "$in" {
+		operands, ok := operand.([]interface{})
+		if !ok {
+			return false, fmt.Errorf("$in needs an array")
+		}
+		for _, o := range operands {
+			if c, ok := compareValues(value, o); ok && c == 0 {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	c, ok := compareValues(value, operand)
+	switch op {
+	case "$eq":
+		return ok && c == 0, nil
+	case "$ne":
+		return !ok || c != 0, nil
+	case "$gt":
+		return ok && c > 0, nil
+	case "$gte":
+		return ok && c >= 0, nil
+	case "$lt":
+		return ok && c < 0, nil
+	case "$lte":
+		return ok && c <= 0, nil
+	}
+	return false, fmt.Errorf("unsupported operator %s", op)
+}
+
+func compareValues(a, b interface{}) (int, bool) {
+	switch x := a.(type) {
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(x, y), true
+	case float64:
+		y, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		if x < y {
+			return -1, true
+		} else if x > y {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// page returns the pageSize results after bookmark, the key of the last result
+// of the previous page
+func page(kvs []*queryresult.KV, pageSize int32, bookmark string) (*sliceIterator, *pb.QueryResponseMetadata) {
+	start := 0
+	if bookmark != "" {
+		for i, kv := range kvs {
+			if kv.Key == bookmark {
+				start = i + 1
+				break
+			}
+		}
+	}
+	end := start + int(pageSize)
+	if end > len(kvs) {
+		end = len(kvs)
+	}
+	result := kvs[start:end]
+
+	metadata := &pb.QueryResponseMetadata{FetchedRecordsCount: int32(len(result))}
+	if end < len(kvs) && len(result) > 0 {
+		metadata.Bookmark = result[len(result)-1].Key
+	}
+	return &sliceIterator{kvs: result}, metadata
+}
+
+func drain(iter shim.StateQueryIteratorInterface) ([]*queryresult.KV, error) {
+	defer iter.Close()
+	kvs := []*queryresult.KV{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		kvs = append(kvs, kv)
+	}
+	return kvs, nil
+}
+
+type sliceIterator struct {
+	kvs []*queryresult.KV
+	pos int
+}
+
+func (it *sliceIterator) HasNext() bool { return it.pos < len(it.kvs) }
+func (it *sliceIterator) Close() error  { return nil }
+func (it *sliceIterator) Next() (*queryresult.KV, error) {
+	if !it.HasNext() {
+		return nil, fmt.Errorf("no more results")
+	}
+	it.pos++
+	return it.kvs[it.pos-1], nil
+}
+
+type historyIterator struct {
+	mods []*queryresult.KeyModification
+	pos  int
+}
+
+func (it *historyIterator) HasNext() bool { return it.pos < len(it.mods) }
+func (it *historyIterator) Close() error  { return nil }
+func (it *historyIterator) Next() (*queryresult.KeyModification, error) {
+	if !it.HasNext() {
+		return nil, fmt.Errorf("no more history")
+	}
+	it.pos++
+	return it.mods[it.pos-1], nil
+}
+
+// attrOID is the certificate extension Fabric CA stores identity attributes in
+var attrOID = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}
+
+// newIdentity returns a serialized creator identity for a self-signed
+// certificate with the given common name and Fabric CA attributes
+func newIdentity(t *testing.T, mspID string, commonName string, attrs map[string]string) []byte {
+	t.Helper()
+	creator, _ := newIdentityWithKey(t, mspID, commonName, attrs)
+	return creator
+}
+
+// newIdentityWithKey is newIdentity also returning the identity's enrollment key
+func newIdentityWithKey(t *testing.T, mspID string, commonName string, attrs map[string]string) ([]byte, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{mspID}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if attrs != nil {
+		value, err := json.Marshal(map[string]interface{}{"attrs": attrs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.ExtraExtensions = []pkix.Extension{{Id: attrOID, Value: value}}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	creator, err := proto.Marshal(&msp.SerializedIdentity{Mspid: mspID, IdBytes: certPEM})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return creator, key
+}
@@ -0,0 +1,177 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright Receivership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// windowTimeFields maps the event a time-window query selects on to the shard
+// field holding its transaction timestamp
+var windowTimeFields = map[string]string{
+	"created": "CreatedAt",
+	"changed": "UpdatedAt",
+}
+
+// shardWindowIndexes names the CouchDB index shipped in META-INF/statedb/couchdb/indexes
+// for each field and time field pair a time-window query selects on
+var shardWindowIndexes = map[string][]string{
+	"Sender/CreatedAt":   {"_design/indexSenderCreatedAtDoc", "indexSenderCreatedAt"},
+	"Sender/UpdatedAt":   {"_design/indexSenderUpdatedAtDoc", "indexSenderUpdatedAt"},
+	"Receiver/CreatedAt": {"_design/indexReceiverCreatedAtDoc", "indexReceiverCreatedAt"},
+	"Receiver/UpdatedAt": {"_design/indexReceiverUpdatedAtDoc", "indexReceiverUpdatedAt"},
+	"DataId/CreatedAt":   {"_design/indexDataIdCreatedAtDoc", "indexDataIdCreatedAt"},
+	"DataId/UpdatedAt":   {"_design/indexDataIdUpdatedAtDoc", "indexDataIdUpdatedAt"},
+}
+
+
+// ===== Time-window queries ===============================================================
+// queryShardsBySenderInWindow, queryShardsByReceiverInWindow and queryShardsByDataIdInWindow
+// return the shards of one Sender, Receiver or DataId created or last changed within
+// [from, to), oldest first, optionally paginated:
+//
+//   0        1                     2       3     4           5
+// "value", "created"|"changed", "from", "to", "pageSize", "bookmark"
+//
+// from and to are RFC 3339; either may be empty for an open window. Shards carry
+// transaction timestamps to the second, so windows are too. "changed" matches the
+// last change only, getHistoryForShard has the earlier ones. Shards written
+// before they carried these times are never "created" in a window, and only
+// "changed" in one once they are next written.
+//
+// Only available on state databases that support rich query (e.g. CouchDB)
+// =========================================================================================
+func (t *SimpleChaincode) queryShardsBySenderInWindow(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return queryShardsInWindow(stub, "Sender", args)
+}
+
+func (t *SimpleChaincode) queryShardsByReceiverInWindow(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return queryShardsInWindow(stub, "Receiver", args)
+}
+
+func (t *SimpleChaincode) queryShardsByDataIdInWindow(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return queryShardsInWindow(stub, "DataId", args)
+}
+
+
+// =========================================================================================
+// queryShardsInWindow runs the time-window rich query for one indexed shard field
+// =========================================================================================
+func queryShardsInWindow(stub shim.ChaincodeStubInterface, field string, args []string) pb.Response {
+	if len(args) != 4 && len(args) != 6 {
+		return queryError("Incorrect number of arguments. Expecting 4 or 6(" + field + ", event, from, to, pageSize, bookmark)")
+	}
+	if len(args[0]) <= 0 {
+		return queryError("1st argument must be a non-empty string")
+	}
+	timeField, ok := windowTimeFields[strings.ToLower(args[1])]
+	if !ok {
+		return queryError("2nd argument must be \"created\" or \"changed\"")
+	}
+	from, err := parseWindowBound(args[2])
+	if err != nil {
+		return queryError("3rd argument " + err.Error())
+	}
+	to, err := parseWindowBound(args[3])
+	if err != nil {
+		return queryError("4th argument " + err.Error())
+	}
+	if len(from) > 0 && len(to) > 0 && from >= to {
+		return queryError("the window must end after it starts")
+	}
+
+	queryString, err := shardWindowQueryString(field, strings.ToLower(args[0]), timeField, from, to)
+	if err != nil {
+		return queryError(err.Error())
+	}
+
+	var queryResults []byte
+	if len(args) == 6 {
+		pageSize, err := parsePageSize(args[4])
+		if err != nil {
+			return queryError(err.Error())
+		}
+		queryResults, err = getQueryResultForQueryStringWithPagination(stub, queryString, pageSize, args[5])
+		if err != nil {
+			return queryError(err.Error())
+		}
+	} else {
+		queryResults, err = getQueryResultForQueryString(stub, queryString)
+		if err != nil {
+			return queryError(err.Error())
+		}
+	}
+	return shim.Success(queryResults)
+}
+
+// parseWindowBound normalises an RFC 3339 bound to the UTC, whole-second form
+// getTxTimestamp stores, so bounds and stored values compare as strings.
+// A fractional bound is rounded up to the next second: stored times are whole
+// seconds, so a time at or after such a bound is also at or after the rounded one.
+func parseWindowBound(bound string) (string, error) {
+	if len(bound) == 0 {
+		return "", nil
+	}
+	parsed, err := time.Parse(time.RFC3339Nano, bound)
+	if err != nil {
+		return "", fmt.Errorf("must be an RFC 3339 time or empty")
+	}
+	if parsed.Nanosecond() != 0 {
+		parsed = parsed.Truncate(time.Second).Add(time.Second)
+	}
+	return parsed.UTC().Format(time.RFC3339), nil
+}
+
+
+// =========================================================================================
+// shardWindowQueryString builds the selector for docType "shard", field == value and
+// timeField within [from, to), sorted on the index so results come oldest first
+// =========================================================================================
+func shardWindowQueryString(field string, value string, timeField string, from string, to string) (string, error) {
+	index, ok := shardWindowIndexes[field+"/"+timeField]
+	if !ok {
+		return "", fmt.Errorf("no index for shard fields %s and %s", field, timeField)
+	}
+
+	// shards without the time field, written before it existed, never match
+	window := map[string]interface{}{"$gt": ""}
+	if len(from) > 0 {
+		window = map[string]interface{}{"$gte": from}
+	}
+	if len(to) > 0 {
+		window["$lt"] = to
+	}
+	query := &richQuery{
+		Selector: map[string]interface{}{"docType": "shard", field: value, timeField: window},
+		Sort:     []map[string]string{{"docType": "asc"}, {field: "asc"}, {timeField: "asc"}},
+		UseIndex: index,
+	}
+	queryAsBytes, err := json.Marshal(query)
+	if err != nil {
+		return "", err
+	}
+	return string(queryAsBytes), nil
+}
@@ -0,0 +1,302 @@
+// Package shardevents decodes the chaincode events emitted by chaincode_ruben
+// whenever a shard changes state, so off-chain receivers can react to them
+// instead of polling queryShardsBySender.
+//
+// Events are read from a Source. Wrap the event stream of whichever SDK the
+// application uses in a Source, or use ChannelSource for a plain channel,
+// which is also how a mock event source is built in tests.
+//
+// A Listener survives dropped connections: it redials its BlockSource from the
+// Checkpoint of the last event it handled and skips what it has already seen.
+package shardevents
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Event names set by chaincode_ruben, one per shard state change.
+const (
+	ShardAdded       = "ShardAdded"
+	ShardAssigned    = "ShardAssigned"
+	ShardTransferred = "ShardTransferred"
+	ShardDeleted     = "ShardDeleted"
+	PUFVerified      = "PUFVerified"
+	ShardReleased    = "ShardReleased"
+	ShardRetrieved   = "ShardRetrieved"
+	ShardRevoked     = "ShardRevoked"
+
+	// ShardsAdded is set once by addShards for the whole batch. Its payload
+	// lists the shards in ShardIds and Shards and leaves ShardId empty; use
+	// Expand to handle it like one ShardAdded per shard.
+	ShardsAdded = "ShardsAdded"
+)
+
+// ShardEvent is a decoded shard event.
+type ShardEvent struct {
+	Name string `json:"-"`
+
+	ShardId  string `json:"ShardId"`
+	DataId   string `json:"DataId"`
+	Sender   string `json:"Sender"`
+	Receiver string `json:"Receiver"`
+	TxId     string `json:"TxId"`
+
+	PrevReceiver string `json:"PrevReceiver,omitempty"`
+	SuccessNum   int    `json:"SuccessNum"`
+	Threshold    int    `json:"Threshold"`
+	Status       string `json:"Status"`
+
+	ShardIds []string       `json:"ShardIds,omitempty"`
+	Shards   []ShardSummary `json:"Shards,omitempty"`
+}
+
+// ShardSummary describes one shard of a ShardsAdded batch.
+type ShardSummary struct {
+	ShardId  string `json:"ShardId"`
+	DataId   string `json:"DataId"`
+	Sender   string `json:"Sender"`
+	Receiver string `json:"Receiver"`
+}
+
+// Expand turns a ShardsAdded event into one ShardAdded event per shard of the
+// batch. Any other event is returned as is. Batches from chaincode that did not
+// yet send Shards expand to events carrying only the ShardId.
+func (e *ShardEvent) Expand() []*ShardEvent {
+	if e.Name != ShardsAdded {
+		return []*ShardEvent{e}
+	}
+	shards := e.Shards
+	if len(shards) == 0 {
+		for _, shardId := range e.ShardIds {
+			shards = append(shards, ShardSummary{ShardId: shardId})
+		}
+	}
+	events := make([]*ShardEvent, 0, len(shards))
+	for _, s := range shards {
+		events = append(events, &ShardEvent{
+			Name:     ShardAdded,
+			ShardId:  s.ShardId,
+			DataId:   s.DataId,
+			Sender:   s.Sender,
+			Receiver: s.Receiver,
+			TxId:     e.TxId,
+		})
+	}
+	return events
+}
+
+// Source delivers raw chaincode events. Recv returns io.EOF once the source
+// has no more events.
+type Source interface {
+	Recv() (*pb.ChaincodeEvent, error)
+}
+
+// ChannelSource is a Source reading from a channel; it ends when the channel
+// is closed.
+type ChannelSource <-chan *pb.ChaincodeEvent
+
+// Recv implements Source.
+func (c ChannelSource) Recv() (*pb.ChaincodeEvent, error) {
+	event, ok := <-c
+	if !ok {
+		return nil, io.EOF
+	}
+	return event, nil
+}
+
+// Handler is called for every decoded event. Returning an error stops Subscribe.
+type Handler func(*ShardEvent) error
+
+// Decode parses the payload of a raw chaincode event. Events that are not
+// shard events are rejected.
+func Decode(event *pb.ChaincodeEvent) (*ShardEvent, error) {
+	if event == nil {
+		return nil, fmt.Errorf("nil chaincode event")
+	}
+	if !isShardEvent(event.EventName) {
+		return nil, fmt.Errorf("unknown shard event %q", event.EventName)
+	}
+
+	shardEvent := &ShardEvent{}
+	if err := json.Unmarshal(event.Payload, shardEvent); err != nil {
+		return nil, fmt.Errorf("failed to decode %s payload: %s", event.EventName, err)
+	}
+	if event.EventName == ShardsAdded {
+		if len(shardEvent.ShardIds) == 0 {
+			return nil, fmt.Errorf("%s payload has no ShardIds", event.EventName)
+		}
+		if len(shardEvent.Shards) > 0 && len(shardEvent.Shards) != len(shardEvent.ShardIds) {
+			return nil, fmt.Errorf("%s payload lists %d ShardIds but %d Shards", event.EventName, len(shardEvent.ShardIds), len(shardEvent.Shards))
+		}
+	} else if len(shardEvent.ShardId) <= 0 {
+		return nil, fmt.Errorf("%s payload has no ShardId", event.EventName)
+	}
+	if len(event.TxId) > 0 && event.TxId != shardEvent.TxId {
+		return nil, fmt.Errorf("%s payload tx id %s does not match event tx id %s", event.EventName, shardEvent.TxId, event.TxId)
+	}
+	shardEvent.Name = event.EventName
+	return shardEvent, nil
+}
+
+// Subscribe reads events from src until it is exhausted, passing each shard
+// event whose name is in names (every shard event when names is empty) to
+// handle. Events from other chaincode functions are skipped. Subscribe
+// returns nil when src reports io.EOF.
+func Subscribe(src Source, handle Handler, names ...string) error {
+	for {
+		event, err := src.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if !isShardEvent(event.EventName) || !wanted(event.EventName, names) {
+			continue
+		}
+		shardEvent, err := Decode(event)
+		if err != nil {
+			return err
+		}
+		if err := handle(shardEvent); err != nil {
+			return err
+		}
+	}
+}
+
+// Checkpoint identifies the last event a Listener has seen. A transaction sets
+// at most one event, so its block number and tx id are unique.
+type Checkpoint struct {
+	BlockNumber uint64
+	TxId        string
+}
+
+// BlockSource delivers raw chaincode events together with the number of the
+// block they were committed in. Recv returns io.EOF once the source has no
+// more events; any other error is treated as a lost connection.
+type BlockSource interface {
+	Recv() (uint64, *pb.ChaincodeEvent, error)
+}
+
+// Dialer opens a BlockSource delivering events from the block of from onwards,
+// or from the first block for the zero Checkpoint. Events of that block that
+// were already seen may be delivered again; the Listener skips them.
+type Dialer func(from Checkpoint) (BlockSource, error)
+
+// Listener subscribes to shard events through Dial and redials from its
+// Checkpoint whenever dialing or receiving fails.
+type Listener struct {
+	Dial Dialer
+
+	// MaxRetries is how many consecutive failures Listen redials after
+	// before it returns the last error. Receiving a new event resets the count.
+	MaxRetries int
+
+	// Checkpoint is the last event seen. Listen resumes after it, and
+	// advances it past every event it receives, filtered out or not.
+	Checkpoint Checkpoint
+}
+
+// Listen passes every shard event whose name is in names (every shard event
+// when names is empty) to handle, reconnecting as needed. It returns nil when
+// the source reports io.EOF, and the handler's error when handle fails; the
+// Checkpoint then still points before the failed event.
+func (l *Listener) Listen(handle Handler, names ...string) error {
+	failures := 0
+	for {
+		received, err := l.listen(handle, names)
+		if err == nil {
+			return nil
+		}
+		if stop, ok := err.(stopError); ok {
+			return stop.err
+		}
+		if received > 0 {
+			failures = 0
+		}
+		failures++
+		if failures > l.MaxRetries {
+			return fmt.Errorf("giving up after %d failed attempts: %s", failures, err)
+		}
+	}
+}
+
+// stopError wraps an error that redialing cannot fix
+type stopError struct {
+	err error
+}
+
+func (e stopError) Error() string {
+	return e.err.Error()
+}
+
+// listen reads one connection until it fails or ends, and reports how many
+// events it received past the Checkpoint
+func (l *Listener) listen(handle Handler, names []string) (int, error) {
+	src, err := l.Dial(l.Checkpoint)
+	if err != nil {
+		return 0, err
+	}
+
+	from := l.Checkpoint
+	replaying := len(from.TxId) > 0
+	received := 0
+	for {
+		blockNumber, event, err := src.Recv()
+		if err == io.EOF {
+			return received, nil
+		} else if err != nil {
+			return received, err
+		}
+
+		// skip what was seen before the connection was lost
+		if replaying {
+			if blockNumber < from.BlockNumber {
+				continue
+			}
+			if blockNumber == from.BlockNumber {
+				if event.TxId == from.TxId {
+					replaying = false
+				}
+				continue
+			}
+			replaying = false
+		}
+		received++
+
+		if isShardEvent(event.EventName) && wanted(event.EventName, names) {
+			shardEvent, err := Decode(event)
+			if err != nil {
+				return received, stopError{err}
+			}
+			if err := handle(shardEvent); err != nil {
+				return received, stopError{err}
+			}
+		}
+		l.Checkpoint = Checkpoint{BlockNumber: blockNumber, TxId: event.TxId}
+	}
+}
+
+func isShardEvent(name string) bool {
+	switch name {
+	case ShardAdded, ShardAssigned, ShardTransferred, ShardDeleted, PUFVerified, ShardReleased, ShardRetrieved, ShardRevoked, ShardsAdded:
+		return true
+	}
+	return false
+}
+
+func wanted(name string, names []string) bool {
+	if len(names) == 0 {
+		return true
+	}
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,195 @@
+package shardevents
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+func shardEvent(t *testing.T, name string, shardId string, txId string) *pb.ChaincodeEvent {
+	t.Helper()
+	payload, err := json.Marshal(&ShardEvent{ShardId: shardId, DataId: "data-0", Sender: "peer01.org1", Receiver: "peer11.org1", TxId: txId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &pb.ChaincodeEvent{EventName: name, TxId: txId, Payload: payload}
+}
+
+func TestSubscribeFilters(t *testing.T) {
+	events := make(chan *pb.ChaincodeEvent, 4)
+	events <- shardEvent(t, ShardAdded, "shard-0", "tx1")
+	events <- &pb.ChaincodeEvent{EventName: "somethingElse", TxId: "tx2", Payload: []byte("not json")}
+	events <- shardEvent(t, ShardTransferred, "shard-0", "tx3")
+	events <- shardEvent(t, ShardAdded, "shard-1", "tx4")
+	close(events)
+
+	got := []string{}
+	err := Subscribe(ChannelSource(events), func(e *ShardEvent) error {
+		got = append(got, e.Name+" "+e.ShardId)
+		return nil
+	}, ShardAdded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, ",") != "ShardAdded shard-0,ShardAdded shard-1" {
+		t.Fatalf("unexpected events %v", got)
+	}
+
+	bad := make(chan *pb.ChaincodeEvent, 1)
+	bad <- &pb.ChaincodeEvent{EventName: ShardAdded, TxId: "tx5", Payload: []byte(`{"ShardId":"shard-0","TxId":"tx6"}`)}
+	close(bad)
+	err = Subscribe(ChannelSource(bad), func(*ShardEvent) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "does not match event tx id") {
+		t.Fatalf("expected a tx id mismatch, got %v", err)
+	}
+}
+
+func TestExpandBatch(t *testing.T) {
+	payload, err := json.Marshal(&ShardEvent{
+		TxId:     "tx1",
+		ShardIds: []string{"shard-0", "shard-1"},
+		Shards: []ShardSummary{
+			{ShardId: "shard-0", DataId: "data-0", Sender: "peer01.org1", Receiver: "peer11.org1"},
+			{ShardId: "shard-1", DataId: "data-0", Sender: "peer01.org1", Receiver: "peer02.org2"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err := Decode(&pb.ChaincodeEvent{EventName: ShardsAdded, TxId: "tx1", Payload: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := batch.Expand()
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	for i, receiver := range []string{"peer11.org1", "peer02.org2"} {
+		e := events[i]
+		if e.Name != ShardAdded || e.ShardId != batch.ShardIds[i] || e.DataId != "data-0" || e.Sender != "peer01.org1" || e.Receiver != receiver || e.TxId != "tx1" {
+			t.Fatalf("unexpected expanded event %+v", e)
+		}
+	}
+
+	single := &ShardEvent{Name: ShardDeleted, ShardId: "shard-0"}
+	if events := single.Expand(); len(events) != 1 || events[0] != single {
+		t.Fatalf("expected a single event to expand to itself, got %v", events)
+	}
+
+	_, err = Decode(&pb.ChaincodeEvent{EventName: ShardsAdded, Payload: []byte(`{"ShardIds":["shard-0","shard-1"],"Shards":[{"ShardId":"shard-0"}]}`)})
+	if err == nil || !strings.Contains(err.Error(), "lists 2 ShardIds but 1 Shards") {
+		t.Fatalf("expected a mismatch error, got %v", err)
+	}
+}
+
+// block is one event of the fake chain
+type block struct {
+	number uint64
+	event  *pb.ChaincodeEvent
+}
+
+// fakeSource delivers its blocks and loses the connection after failAfter
+// of them, never when failAfter is negative
+type fakeSource struct {
+	blocks    []block
+	failAfter int
+}
+
+func (f *fakeSource) Recv() (uint64, *pb.ChaincodeEvent, error) {
+	if f.failAfter == 0 {
+		return 0, nil, errors.New("connection lost")
+	}
+	if len(f.blocks) == 0 {
+		return 0, nil, io.EOF
+	}
+	f.failAfter--
+	b := f.blocks[0]
+	f.blocks = f.blocks[1:]
+	return b.number, b.event, nil
+}
+
+func TestListenerReconnects(t *testing.T) {
+	chain := []block{
+		{1, shardEvent(t, ShardAdded, "shard-0", "tx1")},
+		{1, shardEvent(t, ShardAdded, "shard-1", "tx2")},
+		{2, &pb.ChaincodeEvent{EventName: "somethingElse", TxId: "tx3"}},
+		{2, shardEvent(t, ShardTransferred, "shard-0", "tx4")},
+		{3, shardEvent(t, ShardDeleted, "shard-1", "tx5")},
+	}
+
+	// the connection drops after 2 events, then after 3 of which 2 are replayed, then stays up
+	failures := []int{2, 3, -1}
+	dials := []string{}
+	listener := &Listener{
+		MaxRetries: 1,
+		Dial: func(from Checkpoint) (BlockSource, error) {
+			dials = append(dials, fmt.Sprintf("%d/%s", from.BlockNumber, from.TxId))
+			src := &fakeSource{failAfter: failures[0]}
+			failures = failures[1:]
+			for _, b := range chain {
+				if b.number >= from.BlockNumber {
+					src.blocks = append(src.blocks, b)
+				}
+			}
+			return src, nil
+		},
+	}
+
+	got := []string{}
+	err := listener.Listen(func(e *ShardEvent) error {
+		got = append(got, e.TxId)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, ",") != "tx1,tx2,tx4,tx5" {
+		t.Fatalf("expected every shard event exactly once, got %v", got)
+	}
+	if strings.Join(dials, ",") != "0/,1/tx2,2/tx3" {
+		t.Fatalf("unexpected dial checkpoints %v", dials)
+	}
+	if listener.Checkpoint != (Checkpoint{BlockNumber: 3, TxId: "tx5"}) {
+		t.Fatalf("unexpected final checkpoint %+v", listener.Checkpoint)
+	}
+}
+
+func TestListenerGivesUp(t *testing.T) {
+	dials := 0
+	listener := &Listener{
+		MaxRetries: 2,
+		Checkpoint: Checkpoint{BlockNumber: 7, TxId: "tx7"},
+		Dial: func(from Checkpoint) (BlockSource, error) {
+			dials++
+			return &fakeSource{blocks: []block{{7, shardEvent(t, ShardAdded, "shard-0", "tx7")}}, failAfter: 1}, nil
+		},
+	}
+	err := listener.Listen(func(e *ShardEvent) error {
+		t.Fatalf("replayed event %s was handled again", e.TxId)
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "giving up after 3 failed attempts: connection lost") {
+		t.Fatalf("expected Listen to give up, got %v", err)
+	}
+	if dials != 3 {
+		t.Fatalf("expected 3 dials, got %d", dials)
+	}
+
+	stop := errors.New("stop")
+	listener = &Listener{
+		Dial: func(from Checkpoint) (BlockSource, error) {
+			return &fakeSource{blocks: []block{{1, shardEvent(t, ShardAdded, "shard-0", "tx1")}}, failAfter: -1}, nil
+		},
+	}
+	if err := listener.Listen(func(*ShardEvent) error { return stop }); err != stop {
+		t.Fatalf("expected the handler's error, got %v", err)
+	}
+	if listener.Checkpoint != (Checkpoint{}) {
+		t.Fatalf("checkpoint moved past an event that was not handled: %+v", listener.Checkpoint)
+	}
+}